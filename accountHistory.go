@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type valueSnapshot struct {
+	Date        time.Time `json:"date"`
+	Cash        float64   `json:"cash"`
+	Escrow      float64   `json:"escrow"`
+	SharesValue float64   `json:"sharesValue"`
+	BondsValue  float64   `json:"bondsValue"`
+	Debt        float64   `json:"debt"`
+	NetWorth    float64   `json:"netWorth"`
+}
+
+type periodReturn struct {
+	Since   time.Time `json:"since"`
+	Change  float64   `json:"change"`
+	Percent *float64  `json:"percent,omitempty"` // Left out when the starting net worth was zero
+}
+
+// snapshotAccountValues records every account's value for the day, run nightly by the scheduler
+func (Env env) snapshotAccountValues(ctx context.Context) {
+	err := Env.DBPool.QueryRow(ctx, `INSERT INTO account_value_snapshots (snapshot_date, account_name, cash, escrow, shares_value, bonds_value, debt, net_worth)
+		SELECT $1, account_name, cash, escrow, share_value, bond_value, debt, net_worth FROM (`+accountValuesSQL+`) account_values
+		ON CONFLICT (snapshot_date, account_name) DO NOTHING`, time.Now().UTC().Format(time.DateOnly)).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println("Value snapshot Err", err)
+	}
+}
+
+// returnSince compares the latest snapshot to the last one on or before since
+func returnSince(history []valueSnapshot, since time.Time) *periodReturn {
+	if len(history) == 0 {
+		return nil
+	}
+	latest := history[len(history)-1]
+	var base *valueSnapshot
+	for i := range history {
+		if history[i].Date.After(since) {
+			break
+		}
+		base = &history[i]
+	}
+	if base == nil {
+		return nil
+	}
+	theReturn := periodReturn{
+		Since:  base.Date,
+		Change: latest.NetWorth - base.NetWorth,
+	}
+	if base.NetWorth != 0 {
+		percent := theReturn.Change / base.NetWorth * 100
+		if base.NetWorth < 0 {
+			percent = -percent
+		}
+		theReturn.Percent = &percent
+	}
+	return &theReturn
+}
+
+// getAccountHistory takes from and to dates, defaulting to the last year
+func (Env env) getAccountHistory(w http.ResponseWriter, r *http.Request) {
+	account := r.PathValue("name")
+	if !Env.checkDetailsVisible(w, r, account) {
+		return
+	}
+	params := r.URL.Query()
+	to := time.Now().UTC()
+	var err error
+	if params.Has("to") {
+		to, err = parseHistoryTime(params.Get("to"), true)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.AddDate(-1, 0, 0)
+	if params.Has("from") {
+		from, err = parseHistoryTime(params.Get("from"), false)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	// Every snapshot up to to, so the returns can reach back before from
+	snapshotRows, err := Env.DBPool.Query(r.Context(), `SELECT snapshot_date, cash, escrow, shares_value, bonds_value, debt, net_worth FROM account_value_snapshots WHERE account_name = $1 AND snapshot_date < $2 ORDER BY snapshot_date`, account, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Value history Err", err)
+		return
+	}
+	defer snapshotRows.Close()
+	allHistory := []valueSnapshot{}
+	for snapshotRows.Next() {
+		var curSnapshot valueSnapshot
+		err = snapshotRows.Scan(&curSnapshot.Date, &curSnapshot.Cash, &curSnapshot.Escrow, &curSnapshot.SharesValue, &curSnapshot.BondsValue, &curSnapshot.Debt, &curSnapshot.NetWorth)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Value history scan Err", err)
+			return
+		}
+		allHistory = append(allHistory, curSnapshot)
+	}
+	if snapshotRows.Err() != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Value history Err", snapshotRows.Err())
+		return
+	}
+	returnObj := struct {
+		Account string                   `json:"account"`
+		History []valueSnapshot          `json:"history"`
+		Returns map[string]*periodReturn `json:"returns"`
+	}{
+		Account: account,
+		History: []valueSnapshot{},
+		Returns: map[string]*periodReturn{},
+	}
+	for _, snapshot := range allHistory {
+		if !snapshot.Date.Before(from) {
+			returnObj.History = append(returnObj.History, snapshot)
+		}
+	}
+	if len(allHistory) > 0 {
+		latestDate := allHistory[len(allHistory)-1].Date
+		returnObj.Returns["1d"] = returnSince(allHistory, latestDate.AddDate(0, 0, -1))
+		returnObj.Returns["7d"] = returnSince(allHistory, latestDate.AddDate(0, 0, -7))
+		returnObj.Returns["30d"] = returnSince(allHistory, latestDate.AddDate(0, 0, -30))
+		returnObj.Returns["all"] = returnSince(allHistory, allHistory[0].Date)
+	}
+	json.NewEncoder(w).Encode(returnObj)
+}
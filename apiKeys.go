@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const apiKeyPrefix = "nwc_"
+
+// What each API key scope lets a key do through authorize. Every key can read.
+var apiKeyScopeCapabilities = map[string][]capability{
+	"read":      {capView},
+	"trade":     {capView, capTrade},
+	"send_cash": {capView, capSendCash},
+}
+
+type apiKeyFormat struct {
+	KeyId       string     `json:"keyId"`
+	Key         string     `json:"key,omitempty"` // Only ever returned when the key is created
+	KeyPrefix   string     `json:"keyPrefix"`
+	Label       string     `json:"label"`
+	Scopes      []string   `json:"scopes"`
+	CashLimit   *float64   `json:"cashLimit,omitempty"`
+	IpAllowlist []string   `json:"ipAllowlist"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedIp  *string    `json:"lastUsedIp,omitempty"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+}
+
+// apiKeyGrant rides along in the request context of API key requests, so authorize can
+// narrow what the owning nation could otherwise do down to the key's scopes
+type apiKeyGrant struct {
+	KeyId        string
+	Owner        string
+	Capabilities []capability
+	CashLimit    *float64
+}
+
+type apiKeyCtxKey struct{}
+
+func apiKeyFromContext(ctx context.Context) *apiKeyGrant {
+	keyGrant, _ := ctx.Value(apiKeyCtxKey{}).(*apiKeyGrant)
+	return keyGrant
+}
+
+func hashApiKey(key string) string {
+	keyHash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(keyHash[:])
+}
+
+func ipAllowed(allowlist []string, ip string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	parsedIp := net.ParseIP(ip)
+	for _, allowed := range allowlist {
+		if _, allowedNet, err := net.ParseCIDR(allowed); err == nil {
+			if parsedIp != nil && allowedNet.Contains(parsedIp) {
+				return true
+			}
+		} else if allowedIp := net.ParseIP(allowed); allowedIp != nil && allowedIp.Equal(parsedIp) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyApiKey looks the key up and checks it's usable from ip, recording the use
+func (Env env) verifyApiKey(ctx context.Context, key string, ip string) (*apiKeyGrant, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, errUnauthorized
+	}
+	keyGrant := apiKeyGrant{}
+	var scopes, allowlist []string
+	err := Env.DBPool.QueryRow(ctx, `SELECT key_id, account_name, scopes, cash_limit, ip_allowlist FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > $2)`, hashApiKey(key), time.Now().UTC()).Scan(&keyGrant.KeyId, &keyGrant.Owner, &scopes, &keyGrant.CashLimit, &allowlist)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, errUnauthorized
+		}
+		return nil, err
+	}
+	if !ipAllowed(allowlist, ip) {
+		log.Println("API key", keyGrant.KeyId, "used from disallowed address", ip)
+		return nil, errUnauthorized
+	}
+	for _, scope := range scopes {
+		for _, scopeCap := range apiKeyScopeCapabilities[scope] {
+			if !slices.Contains(keyGrant.Capabilities, scopeCap) {
+				keyGrant.Capabilities = append(keyGrant.Capabilities, scopeCap)
+			}
+		}
+	}
+	err = Env.DBPool.QueryRow(ctx, `UPDATE api_keys SET last_used_at = $1, last_used_ip = $2 WHERE key_id = $3`, time.Now().UTC(), ip, keyGrant.KeyId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println("API key last used Err", err)
+	}
+	return &keyGrant, nil
+}
+
+func (Env env) createApiKey(w http.ResponseWriter, r *http.Request) {
+	var received struct {
+		Label         string
+		Scopes        []string
+		CashLimit     *float64
+		IpAllowlist   []string
+		ExpiresInDays int // 0 for a key that doesn't expire
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil || len(received.Scopes) == 0 || received.ExpiresInDays < 0 || (received.CashLimit != nil && *received.CashLimit < 0) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, scope := range received.Scopes {
+		if apiKeyScopeCapabilities[scope] == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if received.IpAllowlist == nil {
+		received.IpAllowlist = []string{}
+	}
+	for _, allowed := range received.IpAllowlist {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	keyBytes := make([]byte, 32)
+	_, err = rand.Read(keyBytes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	theKey := apiKeyFormat{
+		Key:         apiKeyPrefix + hex.EncodeToString(keyBytes),
+		Label:       received.Label,
+		Scopes:      received.Scopes,
+		CashLimit:   received.CashLimit,
+		IpAllowlist: received.IpAllowlist,
+		CreatedAt:   time.Now().UTC(),
+	}
+	theKey.KeyPrefix = theKey.Key[:len(apiKeyPrefix)+8]
+	if received.ExpiresInDays > 0 {
+		expires := theKey.CreatedAt.AddDate(0, 0, received.ExpiresInDays)
+		theKey.ExpiresAt = &expires
+	}
+	err = Env.DBPool.QueryRow(r.Context(), `INSERT INTO api_keys (account_name, key_hash, key_prefix, label, scopes, cash_limit, ip_allowlist, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING key_id`, r.Header.Get("NationName"), hashApiKey(theKey.Key), theKey.KeyPrefix, theKey.Label, theKey.Scopes, theKey.CashLimit, theKey.IpAllowlist, theKey.CreatedAt, theKey.ExpiresAt).Scan(&theKey.KeyId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("API key create Err", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(theKey)
+}
+
+func (Env env) listApiKeys(w http.ResponseWriter, r *http.Request) {
+	keyRows, err := Env.DBPool.Query(r.Context(), `SELECT key_id, key_prefix, label, scopes, cash_limit, ip_allowlist, created_at, expires_at, last_used_at, last_used_ip, revoked_at FROM api_keys WHERE account_name = $1 ORDER BY created_at DESC`, r.Header.Get("NationName"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("API key list Err", err)
+		return
+	}
+	defer keyRows.Close()
+	theKeys := []apiKeyFormat{}
+	for keyRows.Next() {
+		var thisKey apiKeyFormat
+		err = keyRows.Scan(&thisKey.KeyId, &thisKey.KeyPrefix, &thisKey.Label, &thisKey.Scopes, &thisKey.CashLimit, &thisKey.IpAllowlist, &thisKey.CreatedAt, &thisKey.ExpiresAt, &thisKey.LastUsedAt, &thisKey.LastUsedIp, &thisKey.RevokedAt)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("API key scan Err", err)
+			return
+		}
+		theKeys = append(theKeys, thisKey)
+	}
+	json.NewEncoder(w).Encode(theKeys)
+}
+
+func (Env env) revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	tag, err := Env.DBPool.Exec(r.Context(), `UPDATE api_keys SET revoked_at = $1 WHERE key_id = $2 AND account_name = $3 AND revoked_at IS NULL`, time.Now().UTC(), r.PathValue("keyId"), r.Header.Get("NationName"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("API key revoke Err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
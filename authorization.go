@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type capability string
+
+// The things a nation can be allowed to do on behalf of a region account
+const (
+	capView             capability = "view"
+	capSendCash         capability = "send_cash"
+	capTrade            capability = "trade"
+	capLend             capability = "lend"
+	capWriteOff         capability = "write_off"
+	capMintShares       capability = "mint_shares"
+	capCorporateActions capability = "corporate_actions"
+	capManageMembers    capability = "manage_members"
+)
+
+var allCapabilities = []capability{capView, capSendCash, capTrade, capLend, capWriteOff, capMintShares, capCorporateActions, capManageMembers}
+
+// What the built in perm levels grant when a member has no custom role
+var builtinRoleCapabilities = map[string][]capability{
+	"admin":   allCapabilities,
+	"trader":  {capView, capSendCash, capTrade, capLend, capWriteOff, capMintShares},
+	"citizen": {capView},
+}
+
+var errUnauthorized = errors.New("actor lacks the capability on this account")
+
+type authGrant struct {
+	Account       string
+	Actor         string
+	Role          string
+	Capabilities  []capability
+	SpendingLimit *float64 // The most a single payment or order may move, nil for no limit
+}
+
+func (grant authGrant) can(needed capability) bool {
+	return slices.Contains(grant.Capabilities, needed)
+}
+
+func (grant authGrant) canSpend(amount float64) bool {
+	return grant.SpendingLimit == nil || amount <= *grant.SpendingLimit
+}
+
+// covers reports whether grant holds everything in capabilities, with a spending limit
+// no looser than limit. Used so members can't hand out more than they hold.
+func (grant authGrant) covers(capabilities []capability, limit *float64) bool {
+	for _, thisCap := range capabilities {
+		if !grant.can(thisCap) {
+			return false
+		}
+	}
+	return grant.SpendingLimit == nil || (limit != nil && *limit <= *grant.SpendingLimit)
+}
+
+func validCapability(name string) bool {
+	return slices.Contains(allCapabilities, capability(name))
+}
+
+// authorize resolves what actor may do with account, see resolveGrant. Requests made
+// with an API key are further limited to the key's scopes and cash limit.
+func (Env env) authorize(ctx context.Context, actor string, account string, needed capability) (authGrant, error) {
+	keyGrant := apiKeyFromContext(ctx)
+	if keyGrant != nil && !slices.Contains(keyGrant.Capabilities, needed) {
+		return authGrant{Account: account, Actor: actor}, errUnauthorized
+	}
+	grant, err := Env.resolveGrant(ctx, actor, account, needed)
+	if err != nil || keyGrant == nil {
+		return grant, err
+	}
+	var keyCapabilities []capability
+	for _, thisCap := range grant.Capabilities {
+		if slices.Contains(keyGrant.Capabilities, thisCap) {
+			keyCapabilities = append(keyCapabilities, thisCap)
+		}
+	}
+	grant.Capabilities = keyCapabilities
+	// Never let a key pass for an admin in the role checks some handlers make
+	grant.Role = "api_key"
+	if keyGrant.CashLimit != nil && (grant.SpendingLimit == nil || *keyGrant.CashLimit < *grant.SpendingLimit) {
+		grant.SpendingLimit = keyGrant.CashLimit
+	}
+	return grant, nil
+}
+
+// resolveGrant works out what actor may do with account. Nations have every capability over
+// their own account and none over anyone else's. On a region the member's custom
+// role, if they have one, replaces their built in perm level, except that admins
+// always keep everything. Frozen accounts, or frozen actors, can only view.
+// Returns pgx.ErrNoRows if the account doesn't exist and errUnauthorized if the
+// capability isn't held.
+func (Env env) resolveGrant(ctx context.Context, actor string, account string, needed capability) (authGrant, error) {
+	grant := authGrant{
+		Account: account,
+		Actor:   actor,
+	}
+	var accountType string
+	var frozen bool
+	err := Env.DBPool.QueryRow(ctx, `SELECT account_type, frozen OR COALESCE((SELECT frozen FROM accounts WHERE account_name = $2), FALSE) FROM accounts WHERE account_name = $1`, account, actor).Scan(&accountType, &frozen)
+	if err != nil {
+		return grant, err
+	}
+	if frozen && needed != capView {
+		log.Println("Frozen account", account, "or actor", actor)
+		return grant, errUnauthorized
+	}
+	if accountType == "nation" {
+		if actor != account {
+			return grant, errUnauthorized
+		}
+		grant.Role = "owner"
+		grant.Capabilities = allCapabilities
+		return grant, nil
+	}
+	var permission string
+	var customRole *string
+	var customCaps []string
+	err = Env.DBPool.QueryRow(ctx, `SELECT permission, custom_role, region_roles.capabilities, region_roles.spending_limit FROM nation_permissions LEFT JOIN region_roles ON region_roles.region_name = nation_permissions.region_name AND region_roles.role_name = nation_permissions.custom_role WHERE nation_permissions.region_name = $1 AND nation_name = $2`, account, actor).Scan(&permission, &customRole, &customCaps, &grant.SpendingLimit)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return grant, errUnauthorized
+		}
+		return grant, err
+	}
+	grant.Role = permission
+	grant.Capabilities = builtinRoleCapabilities[permission]
+	if permission == "admin" {
+		grant.SpendingLimit = nil
+	} else if customRole != nil {
+		grant.Role = *customRole
+		grant.Capabilities = nil
+		for _, thisCap := range customCaps {
+			grant.Capabilities = append(grant.Capabilities, capability(thisCap))
+		}
+	}
+	if !grant.can(needed) {
+		return grant, errUnauthorized
+	}
+	return grant, nil
+}
+
+// authorizeTicker authorizes against the region that issued ticker, returning that region
+func (Env env) authorizeTicker(ctx context.Context, dbTx pgx.Tx, actor string, ticker string, needed capability) (string, authGrant, error) {
+	var region string
+	err := dbTx.QueryRow(ctx, `SELECT region FROM stocks WHERE ticker = $1`, ticker).Scan(&region)
+	if err != nil {
+		return "", authGrant{}, err
+	}
+	grant, err := Env.authorize(ctx, actor, region, needed)
+	return region, grant, err
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type bondSeriesFormat struct {
+	SeriesId           string    `json:"seriesId,omitempty"`
+	Region             string    `json:"region"`
+	FaceValue          float64   `json:"faceValue"`          // Paid per bond on purchase and repaid at maturity
+	CouponRate         float64   `json:"couponRate"`         // Annual percentage of face value
+	CouponIntervalDays int       `json:"couponIntervalDays"` // Days between coupon payments
+	IssuedAt           time.Time `json:"issuedAt,omitempty"`
+	NextCoupon         time.Time `json:"nextCoupon,omitempty"`
+	Maturity           time.Time `json:"maturity"`
+	QuantityIssued     int       `json:"quantityIssued"`
+	QuantitySold       int       `json:"quantitySold"`
+	Matured            bool      `json:"matured"`
+	Status             string    `json:"status"`         // current, arrears or defaulted
+	MissedPayments     int       `json:"missedPayments"` // Coupon runs in a row the region couldn't pay
+}
+
+type bondHoldingFormat struct {
+	SeriesId   string
+	Region     string
+	Quantity   int
+	FaceValue  float64
+	CouponRate float64
+	Maturity   time.Time
+	Status     string
+}
+
+// bondDefaultAfter is how many coupon runs in a row a region can miss before its series
+// defaults. Defaulted series are no longer settled by the coupon job.
+const bondDefaultAfter = 3
+
+var (
+	errBondUnfunded    = errors.New("region can't cover what the bond series owes")
+	errBondUnavailable = errors.New("bond series isn't open for that many purchases")
+)
+
+// The coupon owed per bond for one interval, on the same Actual/365 basis as loans
+func (theSeries bondSeriesFormat) couponPerBond() float64 {
+	return theSeries.FaceValue * (theSeries.CouponRate / 100) * float64(theSeries.CouponIntervalDays) / dayCountBasis
+}
+
+func (Env env) issueBonds(w http.ResponseWriter, r *http.Request) {
+	log.Println("Bond Issuance")
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	var newSeries bondSeriesFormat
+	err := decoder.Decode(&newSeries)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("JSON Err", err)
+		return
+	}
+	newSeries.IssuedAt = time.Now().UTC()
+	newSeries.NextCoupon = newSeries.IssuedAt.AddDate(0, 0, newSeries.CouponIntervalDays)
+	if newSeries.FaceValue <= 0 || newSeries.CouponRate < 0 || newSeries.CouponIntervalDays < 1 || newSeries.QuantityIssued < 1 || !newSeries.Maturity.After(newSeries.IssuedAt) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("issueBonds tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	_, err = Env.authorize(r.Context(), r.Header.Get("NationName"), newSeries.Region, capCorporateActions)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("issueBonds auth err", err)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `INSERT INTO bond_series (region, face_value, coupon_rate, coupon_interval_days, issued_at, next_coupon, maturity, quantity_issued) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING series_id`, newSeries.Region, newSeries.FaceValue, newSeries.CouponRate, newSeries.CouponIntervalDays, newSeries.IssuedAt, newSeries.NextCoupon, newSeries.Maturity.UTC(), newSeries.QuantityIssued).Scan(&newSeries.SeriesId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("issueBonds insert err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("issueBonds commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder.Encode(struct {
+		SeriesId string `json:"seriesId"`
+	}{
+		SeriesId: newSeries.SeriesId,
+	})
+}
+
+type bondPurchase struct {
+	SeriesId string
+	Buyer    string
+	Quantity int
+}
+
+func (Env env) buyBonds(w http.ResponseWriter, r *http.Request) {
+	log.Println("Bond Purchase")
+	decoder := json.NewDecoder(r.Body)
+	var sentData bondPurchase
+	err := decoder.Decode(&sentData)
+	if err != nil || sentData.Quantity < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("buyBonds tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), sentData.Buyer, capTrade)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("buyBonds auth err", err)
+		return
+	}
+	var faceValue float64
+	err = dbTx.QueryRow(r.Context(), `SELECT face_value FROM bond_series WHERE series_id = $1`, sentData.SeriesId).Scan(&faceValue)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("buyBonds series err", err)
+		return
+	}
+	if !grant.canSpend(faceValue * float64(sentData.Quantity)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Println("Spending limit exceeded", grant.Actor, grant.Role)
+		return
+	}
+	actionId, err := proposeRegionAction(r.Context(), dbTx, sentData.Buyer, "bond_purchase", faceValue*float64(sentData.Quantity), sentData, grant.Actor)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("buyBonds action err", err)
+		return
+	}
+	if actionId == "" {
+		err = Env.settleBondPurchase(r.Context(), dbTx, sentData)
+		if err != nil {
+			if err == errBondUnavailable {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			log.Println("buyBonds err", err)
+			return
+		}
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("buyBonds commit err", err)
+		return
+	}
+	if actionId != "" {
+		encodePendingAction(w, actionId)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// settleBondPurchase pays the issuer for bonds out of the series' unsold stock and
+// delivers them to the buyer
+func (Env env) settleBondPurchase(ctx context.Context, dbTx pgx.Tx, thePurchase bondPurchase) error {
+	var theSeries bondSeriesFormat
+	err := dbTx.QueryRow(ctx, `SELECT region, face_value, quantity_issued, quantity_sold, matured, bond_status::TEXT FROM bond_series WHERE series_id = $1 FOR UPDATE`, thePurchase.SeriesId).Scan(&theSeries.Region, &theSeries.FaceValue, &theSeries.QuantityIssued, &theSeries.QuantitySold, &theSeries.Matured, &theSeries.Status)
+	if err != nil {
+		return err
+	}
+	if theSeries.Matured || theSeries.Status == "defaulted" || theSeries.QuantitySold+thePurchase.Quantity > theSeries.QuantityIssued || theSeries.Region == thePurchase.Buyer {
+		return errBondUnavailable
+	}
+	err = Env.handCashTransaction(&transactionFormat{
+		Sender:   thePurchase.Buyer,
+		Receiver: theSeries.Region,
+		Value:    float32(theSeries.FaceValue * float64(thePurchase.Quantity)),
+		Message:  `Bond Purchase - Series ` + thePurchase.SeriesId,
+		Kind:     "bond",
+	}, ctx, dbTx)
+	if err != nil {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE bond_series SET quantity_sold = quantity_sold + $1 WHERE series_id = $2`, thePurchase.Quantity, thePurchase.SeriesId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `INSERT INTO bond_holdings (series_id, account_name, quantity) VALUES ($1, $2, $3) ON CONFLICT (series_id, account_name) DO UPDATE SET quantity = bond_holdings.quantity + EXCLUDED.quantity`, thePurchase.SeriesId, thePurchase.Buyer, thePurchase.Quantity).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+func (Env env) listBonds(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	var allSeries []bondSeriesFormat
+	seriesRows, err := Env.DBPool.Query(r.Context(), `SELECT series_id, region, face_value, coupon_rate, coupon_interval_days, issued_at, next_coupon, maturity, quantity_issued, quantity_sold, matured, bond_status::TEXT, missed_payments FROM bond_series ORDER BY maturity ASC`)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("listBonds err", err)
+		return
+	}
+	defer seriesRows.Close()
+	for seriesRows.Next() {
+		var thisSeries bondSeriesFormat
+		err := seriesRows.Scan(&thisSeries.SeriesId, &thisSeries.Region, &thisSeries.FaceValue, &thisSeries.CouponRate, &thisSeries.CouponIntervalDays, &thisSeries.IssuedAt, &thisSeries.NextCoupon, &thisSeries.Maturity, &thisSeries.QuantityIssued, &thisSeries.QuantitySold, &thisSeries.Matured, &thisSeries.Status, &thisSeries.MissedPayments)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("listBonds scan err", err)
+			return
+		}
+		allSeries = append(allSeries, thisSeries)
+	}
+	encoder.Encode(struct {
+		AllBonds []bondSeriesFormat `json:"allBonds"`
+	}{
+		AllBonds: allSeries,
+	})
+}
+
+func getBondHoldings(ctx context.Context, dbConn *pgxpool.Conn, acct string) ([]bondHoldingFormat, error) {
+	var holdings []bondHoldingFormat
+	holdingsReader, err := dbConn.Query(ctx, `SELECT bond_series.series_id, region, quantity, face_value, coupon_rate, maturity, bond_status::TEXT FROM bond_holdings, bond_series WHERE bond_holdings.series_id = bond_series.series_id AND account_name = $1 AND quantity > 0 ORDER BY maturity ASC`, acct)
+	if err != nil {
+		return nil, err
+	}
+	defer holdingsReader.Close()
+	for holdingsReader.Next() {
+		var currentHolding bondHoldingFormat
+		err := holdingsReader.Scan(&currentHolding.SeriesId, &currentHolding.Region, &currentHolding.Quantity, &currentHolding.FaceValue, &currentHolding.CouponRate, &currentHolding.Maturity, &currentHolding.Status)
+		if err != nil {
+			return nil, err
+		}
+		holdings = append(holdings, currentHolding)
+	}
+	return holdings, holdingsReader.Err()
+}
+
+// Pays every coupon that has fallen due, catching up any missed runs, and repays
+// principal on series that have reached maturity. Each series settles in its own
+// transaction so a region that can't cover its coupons doesn't hold up the rest.
+// A series the region can't pay goes into arrears, then defaults after bondDefaultAfter runs.
+func (Env env) payBondCoupons(ctx context.Context) error {
+	log.Println("Paying Bond Coupons")
+	runTime := time.Now().UTC()
+	dueRows, err := Env.DBPool.Query(ctx, `SELECT series_id FROM bond_series WHERE matured = FALSE AND bond_status != 'defaulted' AND (next_coupon <= $1 OR maturity <= $1)`, runTime)
+	if err != nil {
+		log.Println("Bond coupon job err", err)
+		return err
+	}
+	dueSeries, err := pgx.CollectRows(dueRows, pgx.RowTo[string])
+	if err != nil {
+		log.Println("Bond coupon job err", err)
+		return err
+	}
+	for _, seriesId := range dueSeries {
+		err = Env.settleBondSeries(ctx, seriesId, runTime)
+		if err == errBondUnfunded {
+			err = Env.recordMissedPayment(ctx, seriesId)
+		}
+		if err != nil {
+			log.Println("Bond series", seriesId, "settlement err", err)
+		}
+	}
+	return nil
+}
+
+func (Env env) recordMissedPayment(ctx context.Context, seriesId string) error {
+	var status string
+	err := Env.DBPool.QueryRow(ctx, `UPDATE bond_series SET missed_payments = missed_payments + 1, bond_status = CASE WHEN missed_payments + 1 >= $1 THEN 'defaulted' ELSE 'arrears' END::bondStatus WHERE series_id = $2 RETURNING bond_status::TEXT`, bondDefaultAfter, seriesId).Scan(&status)
+	if err != nil {
+		return err
+	}
+	log.Println("Bond series", seriesId, "missed a payment, now", status)
+	return nil
+}
+
+func (Env env) settleBondSeries(ctx context.Context, seriesId string, runTime time.Time) error {
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback(ctx)
+	theSeries := bondSeriesFormat{SeriesId: seriesId}
+	err = dbTx.QueryRow(ctx, `SELECT region, face_value, coupon_rate, coupon_interval_days, next_coupon, maturity FROM bond_series WHERE series_id = $1 AND matured = FALSE FOR UPDATE`, seriesId).Scan(&theSeries.Region, &theSeries.FaceValue, &theSeries.CouponRate, &theSeries.CouponIntervalDays, &theSeries.NextCoupon, &theSeries.Maturity)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	holderRows, err := dbTx.Query(ctx, `SELECT account_name, quantity FROM bond_holdings WHERE series_id = $1 AND quantity > 0`, seriesId)
+	if err != nil {
+		return err
+	}
+	holders := map[string]int{}
+	for holderRows.Next() {
+		var holder string
+		var quantity int
+		err = holderRows.Scan(&holder, &quantity)
+		if err != nil {
+			holderRows.Close()
+			return err
+		}
+		holders[holder] = quantity
+	}
+	holderRows.Close()
+	if holderRows.Err() != nil {
+		return holderRows.Err()
+	}
+	couponsDue := 0
+	for !theSeries.NextCoupon.After(runTime) && !theSeries.NextCoupon.After(theSeries.Maturity) {
+		couponsDue += 1
+		theSeries.NextCoupon = theSeries.NextCoupon.AddDate(0, 0, theSeries.CouponIntervalDays)
+	}
+	hasMatured := !theSeries.Maturity.After(runTime)
+	var owed, regionCash float64
+	for _, quantity := range holders {
+		if couponsDue > 0 {
+			owed += theSeries.couponPerBond() * float64(quantity*couponsDue)
+		}
+		if hasMatured {
+			owed += theSeries.FaceValue * float64(quantity)
+		}
+	}
+	err = dbTx.QueryRow(ctx, `SELECT cash_in_hand FROM accounts WHERE account_name = $1 FOR UPDATE`, theSeries.Region).Scan(&regionCash)
+	if err != nil {
+		return err
+	}
+	if regionCash < owed {
+		return errBondUnfunded
+	}
+	for holder, quantity := range holders {
+		if couponsDue > 0 && theSeries.CouponRate > 0 {
+			err = Env.handCashTransaction(&transactionFormat{
+				Sender:   theSeries.Region,
+				Receiver: holder,
+				Value:    float32(theSeries.couponPerBond() * float64(quantity*couponsDue)),
+				Message:  `Bond Coupon x` + strconv.Itoa(couponsDue) + ` - Series ` + seriesId,
+				Kind:     "bond",
+			}, ctx, dbTx)
+			if err != nil {
+				return err
+			}
+		}
+		if hasMatured {
+			err = Env.handCashTransaction(&transactionFormat{
+				Sender:   theSeries.Region,
+				Receiver: holder,
+				Value:    float32(theSeries.FaceValue * float64(quantity)),
+				Message:  `Bond Principal - Series ` + seriesId,
+				Kind:     "bond",
+			}, ctx, dbTx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if hasMatured {
+		err = dbTx.QueryRow(ctx, `DELETE FROM bond_holdings WHERE series_id = $1`, seriesId).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE bond_series SET next_coupon = $1, matured = $2, bond_status = 'current', missed_payments = 0 WHERE series_id = $3`, theSeries.NextCoupon, hasMatured, seriesId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return dbTx.Commit(ctx)
+}
@@ -11,11 +11,15 @@ import (
 )
 
 type transactionFormat struct {
-	Timecode time.Time `firestore:"timestamp" json:"timecode,omitempty"`
-	Sender   string    `firestore:"sender" json:"sender"`
-	Receiver string    `firestore:"receiver" json:"receiver"`
-	Value    float32   `firestore:"value" json:"value"`
-	Message  string    `firestoe:"message,omitempty" json:"message"`
+	Timecode  time.Time `firestore:"timestamp" json:"timecode,omitempty"`
+	Sender    string    `firestore:"sender" json:"sender"`
+	Receiver  string    `firestore:"receiver" json:"receiver"`
+	Value     float32   `firestore:"value" json:"value"`
+	Message   string    `firestoe:"message,omitempty" json:"message"`
+	Kind      string    `json:"kind,omitempty"` // What moved the cash, transfer when left empty
+	LoanId    string    `json:"-"`              // The loan a loan transaction belongs to
+	LoanEvent string    `json:"-"`              // issue, repayment or transfer, for loan transactions
+	Minted    bool      `json:"-"`              // New cash, the sender's balance isn't touched
 }
 
 func (Env env) outerCashHandler(w http.ResponseWriter, r *http.Request) {
@@ -28,43 +32,58 @@ func (Env env) outerCashHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println("JSON Err", err)
 		return
 	}
+	sentThing.Kind = "transfer"
 	dbTx, err := Env.DBPool.Begin(r.Context())
 	defer dbTx.Rollback(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	var accountType string
-	err = dbTx.QueryRow(r.Context(), `SELECT account_type FROM accounts WHERE account_name = $1`, sentThing.Sender).Scan(&accountType)
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), sentThing.Sender, capSendCash)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		log.Println("DB 0 Err", err)
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		log.Println("Auth Err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if accountType == "nation" && sentThing.Sender != r.Header.Get("NationName") {
+	if !grant.canSpend(float64(sentThing.Value)) {
 		w.WriteHeader(http.StatusUnauthorized)
+		log.Println("Spending limit exceeded", grant.Actor, grant.Role)
 		return
 	}
-	if accountType == "region" {
-		var permLevel string
-		err = dbTx.QueryRow(r.Context(), `SELECT permission FROM nation_permissions WHERE region_name = $1 AND nation_name = $2`, sentThing.Sender, r.Header.Get("NationName")).Scan(&permLevel)
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("DB Error", err)
+	twoFactor, stepUpThreshold, err := Env.secondFactorEnabled(r.Context(), grant.Actor)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("TOTP Err", err)
+		return
+	}
+	if twoFactor && stepUpThreshold != nil && float64(sentThing.Value) > *stepUpThreshold {
+		if !Env.requireSecondFactor(w, r, grant.Actor, r.Header.Get("TotpCode"), "") {
+			log.Println("Step up code needed", grant.Actor)
 			return
 		}
-		if permLevel != "trader" && permLevel != "admin" {
-			w.WriteHeader(http.StatusUnauthorized)
+	}
+	actionId, err := proposeRegionAction(r.Context(), dbTx, sentThing.Sender, "cash_transfer", float64(sentThing.Value), sentThing, grant.Actor)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region action Err", err)
+		return
+	}
+	if actionId != "" {
+		err = dbTx.Commit(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		encodePendingAction(w, actionId)
+		return
 	}
 	if err = Env.handCashTransaction(sentThing, r.Context(), dbTx); err != nil {
 		if err == pgx.ErrNoRows {
@@ -86,16 +105,21 @@ func (Env env) outerCashHandler(w http.ResponseWriter, r *http.Request) {
 
 func (Env env) handCashTransaction(transaction *transactionFormat, ctx context.Context, dbTx pgx.Tx) error {
 	transaction.Timecode = time.Now()
+	if transaction.Kind == "" {
+		transaction.Kind = "transfer"
+	}
 	var err error
-	err = dbTx.QueryRow(ctx, `UPDATE accounts SET cash_in_hand = cash_in_hand - $1 WHERE account_name = $2`, transaction.Value, transaction.Sender).Scan()
-	if err != pgx.ErrNoRows && err != nil {
-		return err
+	if !transaction.Minted {
+		err = dbTx.QueryRow(ctx, `UPDATE accounts SET cash_in_hand = cash_in_hand - $1 WHERE account_name = $2`, transaction.Value, transaction.Sender).Scan()
+		if err != pgx.ErrNoRows && err != nil {
+			return err
+		}
 	}
 	err = dbTx.QueryRow(ctx, `UPDATE accounts SET cash_in_hand = cash_in_hand + $1 WHERE account_name = $2`, transaction.Value, transaction.Receiver).Scan()
 	if err != pgx.ErrNoRows && err != nil {
 		return err
 	}
-	err = dbTx.QueryRow(ctx, `INSERT INTO cash_transactions (timecode, sender, receiver, transaction_value, transaction_message) VALUES ($1,$2,$3,$4,$5)`, transaction.Timecode.Format(`2006-01-02 15:04:05 MST`), transaction.Sender, transaction.Receiver, transaction.Value, transaction.Message).Scan()
+	err = dbTx.QueryRow(ctx, `INSERT INTO cash_transactions (timecode, sender, receiver, transaction_value, transaction_message, transaction_kind, loan_id, loan_event, minted) VALUES ($1,$2,$3,$4,$5,$6,NULLIF($7, '')::BIGINT,NULLIF($8, '')::loanEvent,$9)`, transaction.Timecode.Format(`2006-01-02 15:04:05 MST`), transaction.Sender, transaction.Receiver, transaction.Value, transaction.Message, transaction.Kind, transaction.LoanId, transaction.LoanEvent, transaction.Minted).Scan()
 	if err != pgx.ErrNoRows && err != nil {
 		return err
 	}
@@ -109,7 +133,7 @@ func (Env env) getUserCashTransactions(ctx context.Context, user string) ([]tran
 		return nil, err
 	}
 	defer dbConn.Release()
-	cashRows, err := dbConn.Query(ctx, `SELECT timecode, sender, receiver, transaction_value, transaction_message FROM cash_transactions WHERE sender = $1 OR receiver = $1 ORDER BY timecode DESC LIMIT 25;`, user)
+	cashRows, err := dbConn.Query(ctx, `SELECT timecode, sender, receiver, transaction_value, transaction_message, transaction_kind::TEXT FROM cash_transactions WHERE sender = $1 OR receiver = $1 ORDER BY timecode DESC LIMIT 25;`, user)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
@@ -118,7 +142,7 @@ func (Env env) getUserCashTransactions(ctx context.Context, user string) ([]tran
 	}
 	for cashRows.Next() {
 		curTransact := transactionFormat{}
-		err := cashRows.Scan(&curTransact.Timecode, &curTransact.Sender, &curTransact.Receiver, &curTransact.Value, &curTransact.Message)
+		err := cashRows.Scan(&curTransact.Timecode, &curTransact.Sender, &curTransact.Receiver, &curTransact.Value, &curTransact.Message, &curTransact.Kind)
 		if err != nil {
 			return nil, err
 		}
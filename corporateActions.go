@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type dividendFormat struct {
+	DividendId string    `json:"dividendId,omitempty"`
+	Ticker     string    `json:"ticker"`
+	PerShare   float64   `json:"perShare"`
+	DeclaredAt time.Time `json:"declaredAt,omitempty"`
+	DeclaredBy string    `json:"declaredBy,omitempty"`
+	RecordDate time.Time `json:"recordDate"` // Holdings at this time are entitled, trades after it don't count
+	PayDate    time.Time `json:"payDate"`    // Cash leaves the region at the first dividend run after this time
+	Recorded   bool      `json:"recorded"`
+	Paid       bool      `json:"paid"`
+	Cancelled  bool      `json:"cancelled"`
+	// Dividend runs in a row the region couldn't pay, it's cancelled after dividendCancelAfter
+	MissedPayments int `json:"missedPayments"`
+}
+
+type splitFormat struct {
+	SplitId     string    `json:"splitId,omitempty"`
+	Ticker      string    `json:"ticker"`
+	SplitFrom   int       `json:"splitFrom"` // SplitFrom old shares become SplitTo new shares, so 1:2 doubles holdings
+	SplitTo     int       `json:"splitTo"`
+	EffectiveAt time.Time `json:"effectiveAt,omitempty"`
+	DeclaredBy  string    `json:"declaredBy,omitempty"`
+}
+
+var errInvalidAction = errors.New("invalid corporate action")
+
+var errDividendUnfunded = errors.New("region can't cover the dividend")
+
+// dividendCancelAfter is how many dividend runs in a row a region can fail to fund a
+// dividend before it's cancelled
+const dividendCancelAfter = 3
+
+func (Env env) declareDividend(w http.ResponseWriter, r *http.Request) {
+	log.Println("Dividend Declaration")
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	var theDividend dividendFormat
+	err := decoder.Decode(&theDividend)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("JSON Err", err)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareDividend tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	region, _, err := Env.authorizeTicker(r.Context(), dbTx, r.Header.Get("NationName"), theDividend.Ticker, capCorporateActions)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareDividend perm err", err)
+		return
+	}
+	theDividend.DeclaredBy = r.Header.Get("NationName")
+	_, err = defaultDividendDates(theDividend, time.Now().UTC())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	actionId, err := proposeDividend(r.Context(), dbTx, region, theDividend, theDividend.DeclaredBy)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareDividend action err", err)
+		return
+	}
+	if actionId != "" {
+		err = dbTx.Commit(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		encodePendingAction(w, actionId)
+		return
+	}
+	theDividend.DividendId, err = recordDividend(r.Context(), dbTx, theDividend)
+	if err != nil {
+		if err == errInvalidAction {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareDividend insert err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareDividend commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder.Encode(struct {
+		DividendId string `json:"dividendId"`
+	}{
+		DividendId: theDividend.DividendId,
+	})
+}
+
+// defaultDividendDates records holders and pays on declaration unless told otherwise
+func defaultDividendDates(theDividend dividendFormat, declaredAt time.Time) (dividendFormat, error) {
+	theDividend.DeclaredAt = declaredAt
+	if theDividend.RecordDate.IsZero() {
+		theDividend.RecordDate = theDividend.DeclaredAt
+	}
+	if theDividend.PayDate.IsZero() {
+		theDividend.PayDate = theDividend.RecordDate
+	}
+	// Holders can't be recorded retroactively, that would let a declarer pick an old register
+	if theDividend.PerShare <= 0 || theDividend.RecordDate.Before(theDividend.DeclaredAt) || theDividend.PayDate.Before(theDividend.RecordDate) {
+		return theDividend, errInvalidAction
+	}
+	return theDividend, nil
+}
+
+// dropPassedDividendDates is for dividends declared once a vote or the region's admins
+// approve them, which can be after the dates first asked for. Holders are then recorded,
+// or paid, as of the approval.
+func dropPassedDividendDates(theDividend dividendFormat, approvedAt time.Time) dividendFormat {
+	if theDividend.RecordDate.Before(approvedAt) {
+		theDividend.RecordDate = time.Time{}
+	}
+	if theDividend.PayDate.Before(approvedAt) {
+		theDividend.PayDate = time.Time{}
+	}
+	return theDividend
+}
+
+// proposeDividend holds a dividend back for the region's admins to sign off, valued at
+// what it would pay out on the shares held outside the region's treasury
+func proposeDividend(ctx context.Context, dbTx pgx.Tx, region string, theDividend dividendFormat, proposer string) (string, error) {
+	var entitledShares float64
+	err := dbTx.QueryRow(ctx, `SELECT COALESCE(SUM(share_quant), 0) FROM stock_holdings WHERE ticker = $1 AND account_name != $2`, theDividend.Ticker, region).Scan(&entitledShares)
+	if err != nil {
+		return "", err
+	}
+	return proposeRegionAction(ctx, dbTx, region, "dividend", theDividend.PerShare*entitledShares, theDividend, proposer)
+}
+
+func recordDividend(ctx context.Context, dbTx pgx.Tx, theDividend dividendFormat) (string, error) {
+	theDividend, err := defaultDividendDates(theDividend, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	var theId string
+	err = dbTx.QueryRow(ctx, `INSERT INTO dividends (ticker, per_share, declared_at, declared_by, record_date, pay_date) VALUES ($1, $2, $3, $4, $5, $6) RETURNING dividend_id`, theDividend.Ticker, theDividend.PerShare, theDividend.DeclaredAt, theDividend.DeclaredBy, theDividend.RecordDate.UTC(), theDividend.PayDate.UTC()).Scan(&theId)
+	return theId, err
+}
+
+// Snapshots holders of dividends that have passed their record date, then pays
+// any that have passed their pay date. Both steps are idempotent so a missed run
+// is caught up by the next. Holdings that changed since the record date have been
+// snapshotted already, by the stock_holdings_dividend_record trigger.
+func (Env env) processDividends(ctx context.Context) error {
+	log.Println("Processing Dividends")
+	runTime := time.Now().UTC()
+	dueRows, err := Env.DBPool.Query(ctx, `SELECT dividend_id FROM dividends WHERE paid = FALSE AND cancelled = FALSE AND record_date <= $1 ORDER BY record_date ASC`, runTime)
+	if err != nil {
+		log.Println("Dividend job err", err)
+		return err
+	}
+	dueDividends, err := pgx.CollectRows(dueRows, pgx.RowTo[string])
+	if err != nil {
+		log.Println("Dividend job err", err)
+		return err
+	}
+	for _, dividendId := range dueDividends {
+		err = Env.settleDividend(ctx, dividendId, runTime)
+		if err == errDividendUnfunded {
+			err = Env.recordMissedDividend(ctx, dividendId)
+		}
+		if err != nil {
+			log.Println("Dividend", dividendId, "settlement err", err)
+		}
+	}
+	return nil
+}
+
+func (Env env) recordMissedDividend(ctx context.Context, dividendId string) error {
+	var cancelled bool
+	err := Env.DBPool.QueryRow(ctx, `UPDATE dividends SET missed_payments = missed_payments + 1, cancelled = missed_payments + 1 >= $1 WHERE dividend_id = $2 RETURNING cancelled`, dividendCancelAfter, dividendId).Scan(&cancelled)
+	if err != nil {
+		return err
+	}
+	log.Println("Dividend", dividendId, "missed a payment, cancelled:", cancelled)
+	return nil
+}
+
+func (Env env) settleDividend(ctx context.Context, dividendId string, runTime time.Time) error {
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback(ctx)
+	theDividend := dividendFormat{DividendId: dividendId}
+	var region string
+	err = dbTx.QueryRow(ctx, `SELECT dividends.ticker, region, per_share, pay_date, recorded FROM dividends, stocks WHERE dividends.ticker = stocks.ticker AND dividend_id = $1 AND paid = FALSE AND cancelled = FALSE FOR UPDATE OF dividends`, dividendId).Scan(&theDividend.Ticker, &region, &theDividend.PerShare, &theDividend.PayDate, &theDividend.Recorded)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if !theDividend.Recorded {
+		// The issuing region's own treasury shares aren't entitled
+		err = dbTx.QueryRow(ctx, `INSERT INTO dividend_entitlements (dividend_id, account_name, share_quant) SELECT $1, account_name, share_quant FROM stock_holdings WHERE ticker = $2 AND account_name != $3 AND share_quant > 0`, dividendId, theDividend.Ticker, region).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		err = dbTx.QueryRow(ctx, `UPDATE dividends SET recorded = TRUE WHERE dividend_id = $1`, dividendId).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+	}
+	if theDividend.PayDate.After(runTime) {
+		return dbTx.Commit(ctx)
+	}
+	entitleRows, err := dbTx.Query(ctx, `SELECT account_name, share_quant FROM dividend_entitlements WHERE dividend_id = $1`, dividendId)
+	if err != nil {
+		return err
+	}
+	entitlements := map[string]int{}
+	for entitleRows.Next() {
+		var holder string
+		var quantity int
+		err = entitleRows.Scan(&holder, &quantity)
+		if err != nil {
+			entitleRows.Close()
+			return err
+		}
+		entitlements[holder] = quantity
+	}
+	entitleRows.Close()
+	if entitleRows.Err() != nil {
+		return entitleRows.Err()
+	}
+	var owed, regionCash float64
+	for _, quantity := range entitlements {
+		owed += theDividend.PerShare * float64(quantity)
+	}
+	err = dbTx.QueryRow(ctx, `SELECT cash_in_hand FROM accounts WHERE account_name = $1 FOR UPDATE`, region).Scan(&regionCash)
+	if err != nil {
+		return err
+	}
+	if regionCash < owed {
+		return errDividendUnfunded
+	}
+	for holder, quantity := range entitlements {
+		err = Env.handCashTransaction(&transactionFormat{
+			Sender:   region,
+			Receiver: holder,
+			Value:    float32(theDividend.PerShare * float64(quantity)),
+			Message:  theDividend.Ticker + ` Dividend #` + dividendId,
+			Kind:     "dividend",
+		}, ctx, dbTx)
+		if err != nil {
+			return err
+		}
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE dividends SET paid = TRUE WHERE dividend_id = $1`, dividendId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return dbTx.Commit(ctx)
+}
+
+// cancelDividend calls off a dividend that hasn't been paid yet
+func (Env env) cancelDividend(w http.ResponseWriter, r *http.Request) {
+	dividendId := r.PathValue("id")
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelDividend tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	var theDividend dividendFormat
+	err = dbTx.QueryRow(r.Context(), `SELECT ticker, paid, cancelled FROM dividends WHERE dividend_id = $1 FOR UPDATE`, dividendId).Scan(&theDividend.Ticker, &theDividend.Paid, &theDividend.Cancelled)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelDividend get err", err)
+		return
+	}
+	_, _, err = Env.authorizeTicker(r.Context(), dbTx, r.Header.Get("NationName"), theDividend.Ticker, capCorporateActions)
+	if err != nil {
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelDividend perm err", err)
+		return
+	}
+	if theDividend.Paid || theDividend.Cancelled {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `UPDATE dividends SET cancelled = TRUE WHERE dividend_id = $1`, dividendId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelDividend update err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelDividend commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (Env env) declareSplit(w http.ResponseWriter, r *http.Request) {
+	log.Println("Split Declaration")
+	decoder := json.NewDecoder(r.Body)
+	var theSplit splitFormat
+	err := decoder.Decode(&theSplit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("JSON Err", err)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareSplit tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	_, _, err = Env.authorizeTicker(r.Context(), dbTx, r.Header.Get("NationName"), theSplit.Ticker, capCorporateActions)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareSplit perm err", err)
+		return
+	}
+	theSplit.DeclaredBy = r.Header.Get("NationName")
+	err = Env.applySplit(r.Context(), dbTx, theSplit)
+	if err != nil {
+		if err == errInvalidAction {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareSplit apply err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("declareSplit commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Rescales every quantity and price for a ticker by SplitTo/SplitFrom. Holdings
+// that don't divide evenly on a reverse split are rounded down and the fractional
+// share is paid out by the region as cash in lieu at the post-split price.
+func (Env env) applySplit(ctx context.Context, dbTx pgx.Tx, theSplit splitFormat) error {
+	if theSplit.SplitFrom < 1 || theSplit.SplitTo < 1 || theSplit.SplitFrom == theSplit.SplitTo {
+		return errInvalidAction
+	}
+	var region string
+	var oldPrice float64
+	err := dbTx.QueryRow(ctx, `SELECT region, share_price FROM stocks WHERE ticker = $1 FOR UPDATE`, theSplit.Ticker).Scan(&region, &oldPrice)
+	if err != nil {
+		return err
+	}
+	newPrice := oldPrice * float64(theSplit.SplitFrom) / float64(theSplit.SplitTo)
+	fractionRows, err := dbTx.Query(ctx, `SELECT account_name, (share_quant::bigint * $2) % $3 FROM stock_holdings WHERE ticker = $1 AND account_name != $4 AND (share_quant::bigint * $2) % $3 > 0`, theSplit.Ticker, theSplit.SplitTo, theSplit.SplitFrom, region)
+	if err != nil {
+		return err
+	}
+	fractions := map[string]int{}
+	for fractionRows.Next() {
+		var holder string
+		var remainder int
+		err = fractionRows.Scan(&holder, &remainder)
+		if err != nil {
+			fractionRows.Close()
+			return err
+		}
+		fractions[holder] = remainder
+	}
+	fractionRows.Close()
+	if fractionRows.Err() != nil {
+		return fractionRows.Err()
+	}
+	splitBatch := pgx.Batch{}
+	// Everyone's stake is unchanged, so keep the split out of the register's large changes
+	splitBatch.Queue(`SELECT set_config('nwc.skip_holder_changes', 'on', true)`)
+	splitBatch.Queue(`UPDATE stock_holdings SET share_quant = (share_quant::bigint * $2) / $3, avg_price = avg_price * $3 / $2 WHERE ticker = $1`, theSplit.Ticker, theSplit.SplitTo, theSplit.SplitFrom)
+	splitBatch.Queue(`UPDATE share_lots SET quantity = (quantity::bigint * $2) / $3, remaining = (remaining::bigint * $2) / $3, unit_cost = unit_cost * $3 / $2 WHERE ticker = $1`, theSplit.Ticker, theSplit.SplitTo, theSplit.SplitFrom)
+	splitBatch.Queue(`UPDATE open_orders SET quant = (quant::bigint * $2) / $3, order_price = order_price * $3 / $2 WHERE ticker = $1`, theSplit.Ticker, theSplit.SplitTo, theSplit.SplitFrom)
+	splitBatch.Queue(`DELETE FROM open_orders WHERE ticker = $1 AND quant = 0`, theSplit.Ticker)
+	splitBatch.Queue(`UPDATE stock_prices SET log_market_price = log_market_price * $3 / $2 WHERE ticker = $1`, theSplit.Ticker, theSplit.SplitTo, theSplit.SplitFrom)
+	splitBatch.Queue(`UPDATE index_constituents SET price = price * $3 / $2 WHERE ticker = $1`, theSplit.Ticker, theSplit.SplitTo, theSplit.SplitFrom)
+	splitBatch.Queue(`UPDATE stocks SET total_share_volume = (SELECT COALESCE(SUM(share_quant), 0) FROM stock_holdings WHERE ticker = $1), share_price = $2 WHERE ticker = $1`, theSplit.Ticker, newPrice)
+	splitBatch.Queue(`SELECT set_config('nwc.skip_holder_changes', 'off', true)`)
+	splitBatch.Queue(`INSERT INTO stock_splits (ticker, split_from, split_to, effective_at, declared_by) VALUES ($1, $2, $3, $4, $5)`, theSplit.Ticker, theSplit.SplitFrom, theSplit.SplitTo, time.Now().UTC(), theSplit.DeclaredBy)
+	err = dbTx.SendBatch(ctx, &splitBatch).Close()
+	if err != nil {
+		return err
+	}
+	for holder, remainder := range fractions {
+		err = Env.handCashTransaction(&transactionFormat{
+			Sender:   region,
+			Receiver: holder,
+			Value:    float32(newPrice * float64(remainder) / float64(theSplit.SplitFrom)),
+			Message:  theSplit.Ticker + ` Split Cash In Lieu`,
+			Kind:     "split",
+		}, ctx, dbTx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (Env env) getCorporateActions(w http.ResponseWriter, r *http.Request) {
+	ticker := r.PathValue("ticker")
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	returnObj := struct {
+		Ticker    string           `json:"ticker"`
+		Dividends []dividendFormat `json:"dividends"`
+		Splits    []splitFormat    `json:"splits"`
+	}{
+		Ticker: ticker,
+	}
+	dividendRows, err := Env.DBPool.Query(r.Context(), `SELECT dividend_id, per_share, declared_at, declared_by, record_date, pay_date, recorded, paid, cancelled, missed_payments FROM dividends WHERE ticker = $1 ORDER BY declared_at DESC`, ticker)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("corporateActions dividend err", err)
+		return
+	}
+	defer dividendRows.Close()
+	for dividendRows.Next() {
+		thisDividend := dividendFormat{Ticker: ticker}
+		err = dividendRows.Scan(&thisDividend.DividendId, &thisDividend.PerShare, &thisDividend.DeclaredAt, &thisDividend.DeclaredBy, &thisDividend.RecordDate, &thisDividend.PayDate, &thisDividend.Recorded, &thisDividend.Paid, &thisDividend.Cancelled, &thisDividend.MissedPayments)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("corporateActions dividend scan err", err)
+			return
+		}
+		returnObj.Dividends = append(returnObj.Dividends, thisDividend)
+	}
+	dividendRows.Close()
+	splitRows, err := Env.DBPool.Query(r.Context(), `SELECT split_id, split_from, split_to, effective_at, declared_by FROM stock_splits WHERE ticker = $1 ORDER BY effective_at DESC`, ticker)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("corporateActions split err", err)
+		return
+	}
+	defer splitRows.Close()
+	for splitRows.Next() {
+		thisSplit := splitFormat{Ticker: ticker}
+		err = splitRows.Scan(&thisSplit.SplitId, &thisSplit.SplitFrom, &thisSplit.SplitTo, &thisSplit.EffectiveAt, &thisSplit.DeclaredBy)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("corporateActions split scan err", err)
+			return
+		}
+		returnObj.Splits = append(returnObj.Splits, thisSplit)
+	}
+	encoder.Encode(returnObj)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every acquisition of shares is kept as a lot, so cost basis can be given both FIFO and
+// as the running average in stock_holdings.avg_price. Holdings from before lots were kept
+// have no lots, and fall back to the average price for FIFO.
+
+// weightedAvgPrice finishes an upsert into stock_holdings, folding the new shares' price
+// into the holding's average
+const weightedAvgPrice = `avg_price = (stock_holdings.share_quant * COALESCE(stock_holdings.avg_price, 0) + EXCLUDED.share_quant * EXCLUDED.avg_price) / NULLIF(stock_holdings.share_quant + EXCLUDED.share_quant, 0)`
+
+// addShareLot records account getting quantity shares at unitCost each
+func addShareLot(ctx context.Context, dbTx pgx.Tx, ticker string, account string, quantity int, unitCost float64) error {
+	if quantity <= 0 {
+		return nil
+	}
+	err := dbTx.QueryRow(ctx, `INSERT INTO share_lots (ticker, account_name, acquired_at, quantity, remaining, unit_cost) VALUES ($1, $2, $3, $4, $4, $5)`, ticker, account, time.Now().UTC(), quantity, unitCost).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+type lotUse struct {
+	lotId      string
+	acquiredAt time.Time
+	used       int
+	unitCost   float64
+}
+
+// takeShareLots takes up to quantity shares out of account's oldest lots first, returning
+// what was taken and how many shares the lots didn't cover
+func takeShareLots(ctx context.Context, dbTx pgx.Tx, ticker string, account string, quantity int) ([]lotUse, int, error) {
+	lotRows, err := dbTx.Query(ctx, `SELECT lot_id, acquired_at, remaining, unit_cost FROM share_lots WHERE ticker = $1 AND account_name = $2 AND remaining > 0 ORDER BY acquired_at, lot_id FOR UPDATE`, ticker, account)
+	if err != nil {
+		return nil, 0, err
+	}
+	var uses []lotUse
+	outstanding := quantity
+	for lotRows.Next() && outstanding > 0 {
+		var use lotUse
+		var remaining int
+		err = lotRows.Scan(&use.lotId, &use.acquiredAt, &remaining, &use.unitCost)
+		if err != nil {
+			lotRows.Close()
+			return nil, 0, err
+		}
+		use.used = min(remaining, outstanding)
+		uses = append(uses, use)
+		outstanding -= use.used
+	}
+	lotRows.Close()
+	if lotRows.Err() != nil {
+		return nil, 0, lotRows.Err()
+	}
+	for _, use := range uses {
+		err = dbTx.QueryRow(ctx, `UPDATE share_lots SET remaining = remaining - $1 WHERE lot_id = $2`, use.used, use.lotId).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return nil, 0, err
+		}
+	}
+	return uses, outstanding, nil
+}
+
+// consumeShareLots takes quantity shares out of account's oldest lots first, returning what
+// they cost. Anything the lots don't cover is costed at avgPrice.
+func consumeShareLots(ctx context.Context, dbTx pgx.Tx, ticker string, account string, quantity int, avgPrice float64) (float64, error) {
+	uses, outstanding, err := takeShareLots(ctx, dbTx, ticker, account, quantity)
+	if err != nil {
+		return 0, err
+	}
+	var fifoCost float64
+	for _, use := range uses {
+		fifoCost += float64(use.used) * use.unitCost
+	}
+	return fifoCost + float64(outstanding)*avgPrice, nil
+}
+
+// carryShareLots moves quantity shares' worth of lots from sender to receiver, keeping
+// their cost and age, for transfers where no money changes hands. Anything sender's lots
+// don't cover goes over at avgPrice. Returns the total cost carried over.
+func carryShareLots(ctx context.Context, dbTx pgx.Tx, ticker string, sender string, receiver string, quantity int, avgPrice float64) (float64, error) {
+	uses, outstanding, err := takeShareLots(ctx, dbTx, ticker, sender, quantity)
+	if err != nil {
+		return 0, err
+	}
+	var carriedCost float64
+	for _, use := range uses {
+		err = dbTx.QueryRow(ctx, `INSERT INTO share_lots (ticker, account_name, acquired_at, quantity, remaining, unit_cost) VALUES ($1, $2, $3, $4, $4, $5)`, ticker, receiver, use.acquiredAt, use.used, use.unitCost).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return 0, err
+		}
+		carriedCost += float64(use.used) * use.unitCost
+	}
+	err = addShareLot(ctx, dbTx, ticker, receiver, outstanding, avgPrice)
+	if err != nil {
+		return 0, err
+	}
+	return carriedCost + float64(outstanding)*avgPrice, nil
+}
+
+// disposeShares consumes account's lots for a sale or transfer out at unitProceeds each,
+// recording the realised P&L under both cost methods. Call before the holding is reduced.
+func disposeShares(ctx context.Context, dbTx pgx.Tx, ticker string, account string, quantity int, unitProceeds float64) error {
+	var avgPrice float64
+	err := dbTx.QueryRow(ctx, `SELECT COALESCE(avg_price, 0) FROM stock_holdings WHERE ticker = $1 AND account_name = $2`, ticker, account).Scan(&avgPrice)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	fifoCost, err := consumeShareLots(ctx, dbTx, ticker, account, quantity, avgPrice)
+	if err != nil {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `INSERT INTO share_disposals (ticker, account_name, disposed_at, quantity, proceeds, fifo_cost, average_cost) VALUES ($1, $2, $3, $4, $5, $6, $7)`, ticker, account, time.Now().UTC(), quantity, unitProceeds*float64(quantity), fifoCost, avgPrice*float64(quantity)).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ require (
 	github.com/go-co-op/gocron/v2 v2.14.0
 	github.com/gosimple/slug v1.15.0
 	github.com/jackc/pgx/v5 v5.7.2
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/nwconifer-technical/nwc_trade_private v1.0.2
 	golang.org/x/crypto v0.31.0
 )
@@ -4,47 +4,212 @@ CREATE TYPE perm as ENUM ('admin', 'trader', 'citizen');
 
 CREATE TYPE direction as ENUM ('buy', 'sell');
 CREATE TYPE priceType as ENUM ('market', 'limit');
+CREATE TYPE issuanceKind as ENUM ('offering', 'buyback');
+CREATE TYPE issuanceStatus as ENUM ('pending', 'executed', 'rejected');
+CREATE TYPE ipoAllocation as ENUM ('prorata', 'auction');
+CREATE TYPE membershipKind as ENUM ('join', 'invite');
+CREATE TYPE membershipStatus as ENUM ('pending', 'approved', 'denied', 'cancelled');
+CREATE TYPE accountPrivacy as ENUM ('public', 'region', 'private');
+CREATE TYPE regionActionKind as ENUM ('cash_transfer', 'loan_issue', 'share_offering', 'share_buyback', 'dividend', 'bond_purchase');
+ALTER TYPE regionActionKind ADD VALUE IF NOT EXISTS 'share_buyback';
+ALTER TYPE regionActionKind ADD VALUE IF NOT EXISTS 'dividend';
+ALTER TYPE regionActionKind ADD VALUE IF NOT EXISTS 'bond_purchase';
+CREATE TYPE cashTransactionKind as ENUM ('transfer', 'trade', 'loan', 'dividend', 'split', 'buyback', 'ipo', 'bond');
+CREATE TYPE loanEvent as ENUM ('issue', 'repayment', 'transfer');
+CREATE TYPE bondStatus as ENUM ('current', 'arrears', 'defaulted');
+CREATE TYPE proposalKind as ENUM ('dividend', 'issuance', 'buyback', 'split', 'text');
+CREATE TYPE proposalStatus as ENUM ('open', 'passed', 'failed', 'cancelled');
+CREATE TYPE voteChoice as ENUM ('for', 'against', 'abstain');
+CREATE TYPE indexWeighting as ENUM ('cap', 'equal');
 
 CREATE TABLE IF NOT EXISTS accounts (
     account_name TEXT UNIQUE NOT NULL PRIMARY KEY,
     account_pass_hash TEXT,
     account_type accountType NOT NULL DEFAULT 'nation',
     cash_in_hand NUMERIC(100,2) NOT NULL DEFAULT 0.0 CHECK(cash_in_hand >= 0.0),
-    cash_in_escrow NUMERIC(100,2) NOT NULL DEFAULT 0.0 CHECK(cash_in_escrow >= 0.0)
+    cash_in_escrow NUMERIC(100,2) NOT NULL DEFAULT 0.0 CHECK(cash_in_escrow >= 0.0),
+    frozen BOOLEAN NOT NULL DEFAULT FALSE, -- Set by platform admins, blocks everything but viewing
+    privacy accountPrivacy NOT NULL DEFAULT 'public', -- Who can see balances and transactions on the public endpoints
+    session_version INT NOT NULL DEFAULT 0 -- Part of the AuthKey, moved on by password changes and resets to sign out every session
+);
+
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS frozen BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS privacy accountPrivacy NOT NULL DEFAULT 'public';
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS session_version INT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS region_roles (
+    region_name TEXT NOT NULL REFERENCES accounts(account_name),
+    role_name TEXT NOT NULL CHECK(role_name NOT IN ('admin', 'trader', 'citizen', 'owner')),
+    capabilities TEXT[] NOT NULL DEFAULT '{}', -- view, send_cash, trade, lend, write_off, mint_shares, corporate_actions, manage_members
+    spending_limit NUMERIC(100,2) CHECK(spending_limit >= 0.0), -- Per payment or order, NULL for no limit
+    PRIMARY KEY(region_name, role_name)
 );
 
 CREATE TABLE IF NOT EXISTS nation_permissions (
     region_name TEXT NOT NULL REFERENCES accounts(account_name),
     nation_name TEXT NOT NULL REFERENCES accounts(account_name),
     permission perm NOT NULL,
+    custom_role TEXT, -- Replaces the capabilities of permission when set, unless permission is admin
     PRIMARY KEY(region_name, nation_name),
+    FOREIGN KEY(region_name, custom_role) REFERENCES region_roles(region_name, role_name),
     CONSTRAINT separateThings CHECK(region_name != nation_name)
 );
 
+ALTER TABLE nation_permissions ADD COLUMN IF NOT EXISTS custom_role TEXT;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'nation_permissions_region_name_custom_role_fkey') THEN
+        ALTER TABLE nation_permissions ADD CONSTRAINT nation_permissions_region_name_custom_role_fkey FOREIGN KEY(region_name, custom_role) REFERENCES region_roles(region_name, role_name);
+    END IF;
+END;
+$$;
+
+CREATE TABLE IF NOT EXISTS region_governance (
+    region_name TEXT UNIQUE NOT NULL PRIMARY KEY REFERENCES accounts(account_name),
+    region_owner TEXT REFERENCES accounts(account_name), -- Always one of the region's admins
+    required_approvals INT NOT NULL DEFAULT 1 CHECK(required_approvals >= 1), -- N of the region's M admins
+    multisig_threshold NUMERIC(100,2) NOT NULL DEFAULT 0.0 CHECK(multisig_threshold >= 0.0), -- Actions at or above this value need required_approvals
+    sync_officers BOOLEAN NOT NULL DEFAULT FALSE -- Residency sync keeps admins in line with the NS founder, delegate and officers
+);
+
+ALTER TABLE region_governance ADD COLUMN IF NOT EXISTS sync_officers BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Regions from before owners were recorded go to their first admin alphabetically, to be handed on from there
+INSERT INTO region_governance (region_name, region_owner)
+    SELECT account_name, (SELECT nation_name FROM nation_permissions WHERE nation_permissions.region_name = accounts.account_name AND permission = 'admin' ORDER BY nation_name LIMIT 1)
+    FROM accounts WHERE account_type = 'region'
+    ON CONFLICT (region_name) DO UPDATE SET region_owner = EXCLUDED.region_owner WHERE region_governance.region_owner IS NULL;
+
+CREATE TABLE IF NOT EXISTS region_actions (
+    action_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    region_name TEXT NOT NULL REFERENCES accounts(account_name),
+    kind regionActionKind NOT NULL,
+    payload JSONB NOT NULL,
+    action_value NUMERIC(100,2) NOT NULL,
+    action_status issuanceStatus NOT NULL DEFAULT 'pending',
+    proposed_by TEXT NOT NULL,
+    proposed_at TIMESTAMP NOT NULL,
+    decided_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS region_action_approvals (
+    action_id BIGINT NOT NULL REFERENCES region_actions(action_id),
+    admin_name TEXT NOT NULL REFERENCES accounts(account_name),
+    approved_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(action_id, admin_name)
+);
+
+CREATE TABLE IF NOT EXISTS membership_requests (
+    request_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    region_name TEXT NOT NULL REFERENCES accounts(account_name),
+    nation_name TEXT NOT NULL REFERENCES accounts(account_name),
+    kind membershipKind NOT NULL, -- join requests come from the nation, invites from the region
+    request_status membershipStatus NOT NULL DEFAULT 'pending',
+    requested_by TEXT NOT NULL,
+    requested_at TIMESTAMP NOT NULL,
+    decided_by TEXT,
+    decided_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS one_pending_request ON membership_requests (region_name, nation_name) WHERE request_status = 'pending';
+
+CREATE TABLE IF NOT EXISTS membership_history (
+    region_name TEXT NOT NULL REFERENCES accounts(account_name),
+    nation_name TEXT NOT NULL REFERENCES accounts(account_name),
+    joined_at TIMESTAMP NOT NULL,
+    left_at TIMESTAMP, -- NULL while still a member
+    left_reason TEXT
+);
+
+CREATE TABLE IF NOT EXISTS residency_discrepancies (
+    discrepancy_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    detected_at TIMESTAMP NOT NULL,
+    nation_name TEXT NOT NULL REFERENCES accounts(account_name),
+    region_name TEXT NOT NULL REFERENCES accounts(account_name),
+    kind TEXT NOT NULL, -- moved, ceased_to_exist, became_officer, no_longer_officer
+    ns_region TEXT, -- Where NS says the nation actually is
+    resolution TEXT NOT NULL, -- migrated, awaiting_approval, flagged, promoted or demoted
+    resolved_at TIMESTAMP -- Flagged discrepancies close once NS and the server agree again
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS one_open_discrepancy ON residency_discrepancies (nation_name, region_name, kind) WHERE resolved_at IS NULL;
+
 CREATE TABLE IF NOT EXISTS cash_transactions (
     transaction_id bigint UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
     timecode TIMESTAMP NOT NULL,
     sender TEXT NOT NULL REFERENCES accounts(account_name),
     receiver TEXT NOT NULL REFERENCES accounts(account_name),
     transaction_value NUMERIC(100,2) NOT NULL CHECK(transaction_value >= 0.0),
-    transaction_message TEXT NOT NULL
+    transaction_message TEXT NOT NULL,
+    transaction_kind cashTransactionKind NOT NULL DEFAULT 'transfer',
+    message_search tsvector GENERATED ALWAYS AS (to_tsvector('english', transaction_message)) STORED,
+    loan_id BIGINT, -- Not a foreign key, the ledger outlives repaid loans
+    loan_event loanEvent, -- Set alongside loan_id on loan cash transactions
+    minted BOOLEAN NOT NULL DEFAULT FALSE -- New cash like the signup credit, the sender's balance never paid it
 );
 
+ALTER TABLE cash_transactions ADD COLUMN IF NOT EXISTS transaction_kind cashTransactionKind NOT NULL DEFAULT 'transfer';
+ALTER TABLE cash_transactions ADD COLUMN IF NOT EXISTS message_search tsvector GENERATED ALWAYS AS (to_tsvector('english', transaction_message)) STORED;
+
+-- Transactions from before transaction_kind was recorded all came in as transfers, the
+-- messages trades and loans were written with tell them apart
+UPDATE cash_transactions SET transaction_kind = 'trade'
+    WHERE transaction_kind = 'transfer' AND EXISTS (SELECT 1 FROM stocks WHERE cash_transactions.transaction_message = stocks.ticker || ' Trade');
+UPDATE cash_transactions SET transaction_kind = 'loan'
+    WHERE transaction_kind = 'transfer' AND transaction_message ~ '^Loan (Issue|Repayment) - ID [0-9]+$';
+ALTER TABLE cash_transactions ADD COLUMN IF NOT EXISTS loan_id BIGINT;
+ALTER TABLE cash_transactions ADD COLUMN IF NOT EXISTS loan_event loanEvent;
+ALTER TABLE cash_transactions ADD COLUMN IF NOT EXISTS minted BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Loan transactions from before loan_id was recorded only had it in their message. Runs
+-- after the transaction_kind backfill, so loans from before kinds existed are covered too.
+UPDATE cash_transactions SET
+    loan_id = substring(transaction_message from ' - ID ([0-9]+)$')::BIGINT,
+    loan_event = CASE WHEN transaction_message LIKE '%Transfer - ID %' THEN 'transfer' WHEN transaction_message LIKE '%Repayment - ID %' THEN 'repayment' ELSE 'issue' END::loanEvent
+    WHERE transaction_kind = 'loan' AND loan_id IS NULL AND transaction_message ~ '^(Membership )?Loan (Issue|Repayment|Transfer) - ID [0-9]+$';
+
+CREATE INDEX IF NOT EXISTS cash_transactions_sender ON cash_transactions (sender, timecode DESC, transaction_id DESC);
+CREATE INDEX IF NOT EXISTS cash_transactions_receiver ON cash_transactions (receiver, timecode DESC, transaction_id DESC);
+CREATE INDEX IF NOT EXISTS cash_transactions_search ON cash_transactions USING GIN (message_search);
+
 CREATE TABLE IF NOT EXISTS loans (
     loan_id bigint UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
     lendee TEXT NOT NULL REFERENCES accounts(account_name),
     lender TEXT NOT NULL REFERENCES accounts(account_name),
     lent_value NUMERIC(100,2) NOT NULL CHECK(lent_value >= 0.0),
-    rate NUMERIC(100,2) NOT NULL,
-    current_value NUMERIC NOT NULL
+    rate NUMERIC(100,2) NOT NULL, -- Annual percentage rate, accrued Actual/365
+    current_value NUMERIC NOT NULL,
+    last_accrued TIMESTAMP NOT NULL DEFAULT (NOW() AT TIME ZONE 'utc'),
+    membership_loan BOOLEAN NOT NULL DEFAULT FALSE -- The loan a region gives nations when they join it
 );
 
+-- Databases from before a column was added only get it from these, as the CREATE TABLE above is skipped
+ALTER TABLE loans ADD COLUMN IF NOT EXISTS last_accrued TIMESTAMP NOT NULL DEFAULT (NOW() AT TIME ZONE 'utc');
+ALTER TABLE loans ADD COLUMN IF NOT EXISTS membership_loan BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS loan_accruals (
+    accrual_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    loan_id BIGINT NOT NULL, -- Not a foreign key, the ledger outlives repaid loans
+    lendee TEXT NOT NULL REFERENCES accounts(account_name),
+    lender TEXT NOT NULL REFERENCES accounts(account_name),
+    period_start TIMESTAMP NOT NULL,
+    period_end TIMESTAMP NOT NULL,
+    accrual_days INT NOT NULL CHECK(accrual_days > 0),
+    opening_value NUMERIC NOT NULL,
+    interest NUMERIC NOT NULL,
+    closing_value NUMERIC NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS loan_accruals_loan ON loan_accruals (loan_id, period_end);
+
 CREATE TABLE IF NOT EXISTS stocks (
     ticker TEXT UNIQUE NOT NULL PRIMARY KEY,
     region TEXT REFERENCES accounts(account_name),
     market_cap NUMERIC(100,2) NOT NULL DEFAULT 0.0 CHECK(market_cap >= 0.0),
     total_share_volume INT NOT NULL DEFAULT 0,
     share_price NUMERIC(100,2),
+    trading_open BOOLEAN NOT NULL DEFAULT TRUE, -- False until the ticker's IPO has closed
+    halted BOOLEAN NOT NULL DEFAULT FALSE, -- Set by platform admins to suspend trading
     share_stat1 NUMERIC(100,2), -- Most nations - 255
     share_stat2 NUMERIC(100,2), -- Economic Output - 76
     share_stat3 NUMERIC(100,2), -- Average Income - 74
@@ -52,6 +217,9 @@ CREATE TABLE IF NOT EXISTS stocks (
     share_stat5 NUMERIC(100,2)  -- Pro-Market - 48
 );
 
+ALTER TABLE stocks ADD COLUMN IF NOT EXISTS trading_open BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE stocks ADD COLUMN IF NOT EXISTS halted BOOLEAN NOT NULL DEFAULT FALSE;
+
 CREATE TABLE IF NOT EXISTS stock_prices (
     price_log_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
     timecode TIMESTAMP NOT NULL,
@@ -67,6 +235,44 @@ CREATE TABLE IF NOT EXISTS stock_holdings (
     PRIMARY KEY(ticker, account_name)
 );
 
+CREATE TABLE IF NOT EXISTS share_lots (
+    lot_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    acquired_at TIMESTAMP NOT NULL,
+    quantity INT NOT NULL CHECK(quantity >= 0),
+    remaining INT NOT NULL CHECK(remaining >= 0 AND remaining <= quantity),
+    unit_cost NUMERIC NOT NULL CHECK(unit_cost >= 0.0)
+);
+
+CREATE INDEX IF NOT EXISTS share_lots_open ON share_lots (account_name, ticker, acquired_at) WHERE remaining > 0;
+
+CREATE TABLE IF NOT EXISTS share_disposals (
+    disposal_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    disposed_at TIMESTAMP NOT NULL,
+    quantity INT NOT NULL CHECK(quantity > 0),
+    proceeds NUMERIC NOT NULL,
+    fifo_cost NUMERIC NOT NULL,
+    average_cost NUMERIC NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS share_disposals_account ON share_disposals (account_name, ticker);
+
+CREATE TABLE IF NOT EXISTS trade_executions (
+    execution_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    timecode TIMESTAMP NOT NULL,
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    buyer TEXT NOT NULL REFERENCES accounts(account_name),
+    seller TEXT NOT NULL REFERENCES accounts(account_name),
+    quantity INT NOT NULL CHECK(quantity > 0),
+    price NUMERIC(100,2) NOT NULL CHECK(price >= 0.0)
+);
+
+CREATE INDEX IF NOT EXISTS trade_executions_buyer ON trade_executions (buyer, timecode);
+CREATE INDEX IF NOT EXISTS trade_executions_seller ON trade_executions (seller, timecode);
+
 CREATE TABLE IF NOT EXISTS open_orders (
     trade_id bigint UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
     ticker TEXT NOT NULL REFERENCES stocks(ticker),
@@ -78,4 +284,351 @@ CREATE TABLE IF NOT EXISTS open_orders (
     order_price NUMERIC(100,2) CHECK(order_price >= 0.0)
 );
 
+CREATE TABLE IF NOT EXISTS bond_series (
+    series_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    region TEXT NOT NULL REFERENCES accounts(account_name),
+    face_value NUMERIC(100,2) NOT NULL CHECK(face_value > 0.0),
+    coupon_rate NUMERIC(100,2) NOT NULL CHECK(coupon_rate >= 0.0), -- Annual percentage of face value
+    coupon_interval_days INT NOT NULL CHECK(coupon_interval_days > 0),
+    issued_at TIMESTAMP NOT NULL,
+    next_coupon TIMESTAMP NOT NULL,
+    maturity TIMESTAMP NOT NULL,
+    quantity_issued INT NOT NULL CHECK(quantity_issued > 0),
+    quantity_sold INT NOT NULL DEFAULT 0 CHECK(quantity_sold >= 0 AND quantity_sold <= quantity_issued),
+    matured BOOLEAN NOT NULL DEFAULT FALSE,
+    bond_status bondStatus NOT NULL DEFAULT 'current', -- arrears after a missed payment, defaulted once too many are missed
+    missed_payments INT NOT NULL DEFAULT 0 -- Runs of the coupon job in a row the region couldn't pay
+);
+
+ALTER TABLE bond_series ADD COLUMN IF NOT EXISTS bond_status bondStatus NOT NULL DEFAULT 'current';
+ALTER TABLE bond_series ADD COLUMN IF NOT EXISTS missed_payments INT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS bond_holdings (
+    series_id BIGINT NOT NULL REFERENCES bond_series(series_id),
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    quantity INT NOT NULL CHECK(quantity >= 0),
+    PRIMARY KEY(series_id, account_name)
+);
+
+CREATE TABLE IF NOT EXISTS dividends (
+    dividend_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    per_share NUMERIC(100,2) NOT NULL CHECK(per_share > 0.0),
+    declared_at TIMESTAMP NOT NULL,
+    declared_by TEXT NOT NULL REFERENCES accounts(account_name),
+    record_date TIMESTAMP NOT NULL,
+    pay_date TIMESTAMP NOT NULL CHECK(pay_date >= record_date),
+    recorded BOOLEAN NOT NULL DEFAULT FALSE,
+    paid BOOLEAN NOT NULL DEFAULT FALSE,
+    cancelled BOOLEAN NOT NULL DEFAULT FALSE, -- By the region, or once the region misses too many payment runs
+    missed_payments INT NOT NULL DEFAULT 0 -- Runs of the dividend job in a row the region couldn't pay
+);
+
+ALTER TABLE dividends ADD COLUMN IF NOT EXISTS cancelled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE dividends ADD COLUMN IF NOT EXISTS missed_payments INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS dividends_unrecorded ON dividends (ticker) WHERE NOT recorded;
+
+CREATE TABLE IF NOT EXISTS dividend_entitlements (
+    dividend_id BIGINT NOT NULL REFERENCES dividends(dividend_id),
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    share_quant INT NOT NULL CHECK(share_quant > 0),
+    PRIMARY KEY(dividend_id, account_name)
+);
+
+-- Snapshots holders of any dividend past its record date before a holding in its ticker
+-- changes, so trades after the record date never count, however late the dividend job runs.
+-- The issuing region's own treasury shares aren't entitled.
+CREATE OR REPLACE FUNCTION record_due_dividends() RETURNS trigger AS $$
+DECLARE
+    changed_ticker TEXT;
+    due RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed_ticker := OLD.ticker;
+    ELSE
+        changed_ticker := NEW.ticker;
+    END IF;
+    FOR due IN SELECT dividend_id, region FROM dividends, stocks WHERE dividends.ticker = stocks.ticker AND dividends.ticker = changed_ticker AND NOT recorded AND NOT cancelled AND record_date <= NOW() AT TIME ZONE 'utc' FOR UPDATE OF dividends LOOP
+        INSERT INTO dividend_entitlements (dividend_id, account_name, share_quant) SELECT due.dividend_id, account_name, share_quant FROM stock_holdings WHERE ticker = changed_ticker AND account_name IS DISTINCT FROM due.region AND share_quant > 0;
+        UPDATE dividends SET recorded = TRUE WHERE dividend_id = due.dividend_id;
+    END LOOP;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER stock_holdings_dividend_record BEFORE INSERT OR UPDATE OF share_quant OR DELETE ON stock_holdings
+    FOR EACH ROW EXECUTE FUNCTION record_due_dividends();
+
+CREATE TABLE IF NOT EXISTS stock_splits (
+    split_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    split_from INT NOT NULL CHECK(split_from > 0), -- split_from old shares become split_to new shares
+    split_to INT NOT NULL CHECK(split_to > 0),
+    effective_at TIMESTAMP NOT NULL,
+    declared_by TEXT NOT NULL REFERENCES accounts(account_name)
+);
+
+CREATE TABLE IF NOT EXISTS share_issuances (
+    issuance_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    kind issuanceKind NOT NULL,
+    quantity INT NOT NULL CHECK(quantity > 0),
+    filled_quantity INT NOT NULL DEFAULT 0 CHECK(filled_quantity >= 0),
+    price NUMERIC(100,2), -- The quote the issuance executed against
+    issuance_status issuanceStatus NOT NULL DEFAULT 'pending',
+    requested_by TEXT NOT NULL REFERENCES accounts(account_name),
+    requested_at TIMESTAMP NOT NULL,
+    decided_by TEXT REFERENCES accounts(account_name),
+    decided_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS share_issuances_ticker ON share_issuances (ticker, requested_at);
+
+CREATE TABLE IF NOT EXISTS ipos (
+    ipo_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ticker TEXT UNIQUE NOT NULL REFERENCES stocks(ticker),
+    total_shares INT NOT NULL CHECK(total_shares > 0),
+    shares_offered INT NOT NULL CHECK(shares_offered > 0 AND shares_offered <= total_shares),
+    allocation ipoAllocation NOT NULL,
+    offer_price NUMERIC(100,2) NOT NULL CHECK(offer_price > 0.0), -- Fixed price for pro-rata, reserve price for auctions
+    opens_at TIMESTAMP NOT NULL,
+    closes_at TIMESTAMP NOT NULL,
+    closed BOOLEAN NOT NULL DEFAULT FALSE,
+    clearing_price NUMERIC(100,2),
+    shares_allocated INT
+);
+
+CREATE TABLE IF NOT EXISTS ipo_bids (
+    bid_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ipo_id BIGINT NOT NULL REFERENCES ipos(ipo_id),
+    bidder TEXT NOT NULL REFERENCES accounts(account_name),
+    quantity INT NOT NULL CHECK(quantity > 0),
+    bid_price NUMERIC(100,2) NOT NULL CHECK(bid_price > 0.0),
+    escrowed NUMERIC(100,2) NOT NULL CHECK(escrowed >= 0.0),
+    placed_at TIMESTAMP NOT NULL,
+    allocated INT
+);
+
+CREATE TABLE IF NOT EXISTS account_value_snapshots (
+    snapshot_date DATE NOT NULL,
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    cash NUMERIC NOT NULL,
+    escrow NUMERIC NOT NULL,
+    shares_value NUMERIC NOT NULL,
+    bonds_value NUMERIC NOT NULL,
+    debt NUMERIC NOT NULL,
+    net_worth NUMERIC NOT NULL, -- Cash in hand and holdings less debt, escrow is left out like everywhere else
+    PRIMARY KEY(account_name, snapshot_date)
+);
+
+CREATE TABLE IF NOT EXISTS leaderboard_snapshots (
+    snapshot_date DATE NOT NULL,
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    region_name TEXT REFERENCES accounts(account_name),
+    cash NUMERIC NOT NULL,
+    portfolio NUMERIC NOT NULL,
+    debt NUMERIC NOT NULL,
+    net_worth NUMERIC NOT NULL,
+    pnl NUMERIC NOT NULL,
+    net_worth_rank INT NOT NULL,
+    region_rank INT, -- Rank by net worth among the same region's nations
+    PRIMARY KEY(snapshot_date, account_name)
+);
+
+CREATE INDEX IF NOT EXISTS leaderboard_snapshots_account ON leaderboard_snapshots (account_name, snapshot_date);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    attempt_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    attempted_at TIMESTAMP NOT NULL,
+    nation_name TEXT NOT NULL, -- Not a foreign key, guesses at nations that don't exist are tracked too
+    ip_address TEXT NOT NULL,
+    succeeded BOOLEAN NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_nation ON login_attempts (nation_name, attempted_at);
+
+CREATE TABLE IF NOT EXISTS login_throttle (
+    throttle_key TEXT UNIQUE NOT NULL PRIMARY KEY, -- nation:<name>, nation:<name>|ip:<address> or ip:<address>
+    failures INT NOT NULL DEFAULT 0,
+    last_failure TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    key_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    key_hash TEXT UNIQUE NOT NULL, -- SHA-256 of the key, which is only shown once
+    key_prefix TEXT NOT NULL, -- Enough of the key to tell them apart
+    label TEXT NOT NULL DEFAULT '',
+    scopes TEXT[] NOT NULL, -- read, trade, send_cash
+    cash_limit NUMERIC(100,2) CHECK(cash_limit >= 0.0), -- Per payment or order, NULL for no limit
+    ip_allowlist TEXT[] NOT NULL DEFAULT '{}', -- Addresses or CIDR ranges, empty for anywhere
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip TEXT,
+    revoked_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS account_totp (
+    account_name TEXT UNIQUE NOT NULL PRIMARY KEY REFERENCES accounts(account_name),
+    totp_secret TEXT NOT NULL, -- Base32, as shown to authenticator apps
+    enabled BOOLEAN NOT NULL DEFAULT FALSE, -- Set once the first code has been confirmed
+    enrolled_at TIMESTAMP NOT NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0, -- Each code only works once
+    step_up_threshold NUMERIC(100,2) CHECK(step_up_threshold >= 0.0) -- Cash transfers above this need a code, NULL for never
+);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP,
+    PRIMARY KEY(account_name, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS platform_admins (
+    nation_name TEXT UNIQUE NOT NULL PRIMARY KEY REFERENCES accounts(account_name),
+    granted_at TIMESTAMP NOT NULL,
+    granted_by TEXT -- NULL for admins bootstrapped straight into the database
+);
+
+CREATE TABLE IF NOT EXISTS admin_audit_log (
+    audit_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    timecode TIMESTAMP NOT NULL,
+    admin_name TEXT NOT NULL,
+    admin_action TEXT NOT NULL,
+    target TEXT NOT NULL,
+    reason TEXT NOT NULL CHECK(reason != ''),
+    details JSONB
+);
+
+CREATE OR REPLACE FUNCTION admin_audit_log_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'admin_audit_log is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER admin_audit_log_no_changes BEFORE UPDATE OR DELETE OR TRUNCATE ON admin_audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION admin_audit_log_immutable();
+
+CREATE TABLE IF NOT EXISTS holder_changes (
+    change_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    changed_at TIMESTAMP NOT NULL,
+    old_quantity INT NOT NULL,
+    new_quantity INT NOT NULL,
+    total_shares INT NOT NULL -- The ticker's shares outstanding at the time
+);
+
+CREATE INDEX IF NOT EXISTS holder_changes_ticker ON holder_changes (ticker, changed_at);
+
+-- Logs a holding moving by at least 1% of the ticker, or crossing 5, 10, 25 or 50%.
+-- Splits set nwc.skip_holder_changes, as they move every holding without changing anyone's stake.
+CREATE OR REPLACE FUNCTION record_holder_change() RETURNS trigger AS $$
+DECLARE
+    old_quant INT := 0;
+    total INT;
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        old_quant := OLD.share_quant;
+    END IF;
+    IF NEW.share_quant = old_quant OR current_setting('nwc.skip_holder_changes', true) = 'on' THEN
+        RETURN NEW;
+    END IF;
+    SELECT total_share_volume INTO total FROM stocks WHERE ticker = NEW.ticker;
+    IF total IS NULL OR total <= 0 THEN
+        RETURN NEW;
+    END IF;
+    IF abs(NEW.share_quant - old_quant)::bigint * 100 >= total OR EXISTS (
+        SELECT 1 FROM unnest(ARRAY[5, 10, 25, 50]) AS boundary WHERE (old_quant::bigint * 100 >= boundary * total) != (NEW.share_quant::bigint * 100 >= boundary * total)
+    ) THEN
+        INSERT INTO holder_changes (ticker, account_name, changed_at, old_quantity, new_quantity, total_shares) VALUES (NEW.ticker, NEW.account_name, NOW() AT TIME ZONE 'utc', old_quant, NEW.share_quant, total);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER stock_holdings_large_changes AFTER INSERT OR UPDATE OF share_quant ON stock_holdings
+    FOR EACH ROW EXECUTE FUNCTION record_holder_change();
+
+CREATE TABLE IF NOT EXISTS shareholder_proposals (
+    proposal_id BIGINT UNIQUE NOT NULL PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    kind proposalKind NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    payload JSONB NOT NULL, -- The corporate action carried out if the proposal passes
+    proposed_by TEXT NOT NULL REFERENCES accounts(account_name),
+    opened_at TIMESTAMP NOT NULL,
+    closes_at TIMESTAMP NOT NULL,
+    quorum_percent NUMERIC NOT NULL CHECK(quorum_percent > 0 AND quorum_percent <= 100),
+    threshold_percent NUMERIC NOT NULL CHECK(threshold_percent >= 50 AND threshold_percent < 100),
+    proposal_status proposalStatus NOT NULL DEFAULT 'open',
+    eligible_shares INT NOT NULL DEFAULT 0, -- Shares entitled to vote, the issuing region's own excluded
+    decided_at TIMESTAMP,
+    outcome TEXT,
+    execution_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS shareholder_proposals_ticker ON shareholder_proposals (ticker, opened_at);
+CREATE INDEX IF NOT EXISTS shareholder_proposals_open ON shareholder_proposals (closes_at) WHERE proposal_status = 'open';
+
+-- Holdings as the proposal opened, so shares bought afterwards can't swing the vote
+CREATE TABLE IF NOT EXISTS proposal_entitlements (
+    proposal_id BIGINT NOT NULL REFERENCES shareholder_proposals(proposal_id),
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    shares INT NOT NULL CHECK(shares > 0),
+    PRIMARY KEY(proposal_id, account_name)
+);
+
+CREATE TABLE IF NOT EXISTS proposal_votes (
+    proposal_id BIGINT NOT NULL REFERENCES shareholder_proposals(proposal_id),
+    account_name TEXT NOT NULL REFERENCES accounts(account_name),
+    choice voteChoice NOT NULL,
+    weight INT NOT NULL CHECK(weight > 0),
+    voted_at TIMESTAMP NOT NULL,
+    voted_by TEXT NOT NULL REFERENCES accounts(account_name),
+    PRIMARY KEY(proposal_id, account_name),
+    FOREIGN KEY(proposal_id, account_name) REFERENCES proposal_entitlements(proposal_id, account_name)
+);
+
+CREATE TABLE IF NOT EXISTS market_indices (
+    index_id TEXT UNIQUE NOT NULL PRIMARY KEY,
+    index_name TEXT NOT NULL,
+    weighting indexWeighting NOT NULL,
+    max_constituents INT CHECK(max_constituents > 0), -- The largest stocks by market cap, every listed stock if NULL
+    base_value NUMERIC NOT NULL DEFAULT 1000 CHECK(base_value > 0),
+    current_value NUMERIC,
+    updated_at TIMESTAMP
+);
+
+-- What each index held as of its last calculation, the base for the next one
+CREATE TABLE IF NOT EXISTS index_constituents (
+    index_id TEXT NOT NULL REFERENCES market_indices(index_id),
+    ticker TEXT NOT NULL REFERENCES stocks(ticker),
+    price NUMERIC NOT NULL,
+    weight NUMERIC NOT NULL,
+    PRIMARY KEY(index_id, ticker)
+);
+
+CREATE TABLE IF NOT EXISTS index_values (
+    index_id TEXT NOT NULL REFERENCES market_indices(index_id),
+    timecode TIMESTAMP NOT NULL,
+    index_value NUMERIC NOT NULL,
+    constituent_count INT NOT NULL,
+    total_market_cap NUMERIC NOT NULL,
+    PRIMARY KEY(index_id, timecode)
+);
+
+INSERT INTO market_indices (index_id, index_name, weighting, max_constituents) VALUES
+    ('all-cap', 'All Regions Cap-Weighted', 'cap', NULL),
+    ('all-equal', 'All Regions Equal-Weighted', 'equal', NULL),
+    ('top-10', 'Top 10 Cap-Weighted', 'cap', 10)
+    ON CONFLICT (index_id) DO NOTHING;
+
 INSERT INTO accounts (account_name, account_type, cash_in_hand) VALUES ('New West Conifer', 'region', 1000000);
\ No newline at end of file
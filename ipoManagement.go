@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// New regions list 1,000,000 shares. Unless told otherwise a quarter of them go
+// to the IPO and the region keeps the rest, and auctions won't clear below 80%
+// of the NationStates derived reference price.
+const (
+	ipoTotalShares       = 1000000
+	ipoDefaultOffered    = 250000
+	ipoDefaultDays       = 7
+	ipoAuctionReserveMul = 0.8
+)
+
+type ipoFormat struct {
+	IpoId           string    `json:"ipoId"`
+	Ticker          string    `json:"ticker"`
+	Region          string    `json:"region"`
+	TotalShares     int       `json:"totalShares"`
+	SharesOffered   int       `json:"sharesOffered"`
+	Allocation      string    `json:"allocation"` // prorata or auction
+	OfferPrice      float64   `json:"offerPrice"` // The fixed price for prorata, the reserve for auctions
+	OpensAt         time.Time `json:"opensAt"`
+	ClosesAt        time.Time `json:"closesAt"`
+	Closed          bool      `json:"closed"`
+	ClearingPrice   *float64  `json:"clearingPrice,omitempty"`
+	SharesAllocated *int      `json:"sharesAllocated,omitempty"`
+	TotalDemand     int       `json:"totalDemand"`
+}
+
+type ipoBid struct {
+	BidId     string    `json:"bidId"`
+	Bidder    string    `json:"bidder"`
+	Quantity  int       `json:"quantity"`
+	Price     float64   `json:"price"`
+	Escrowed  float64   `json:"-"`
+	PlacedAt  time.Time `json:"placedAt"`
+	Allocated *int      `json:"allocated,omitempty"`
+}
+
+func openIpo(ctx context.Context, dbTx pgx.Tx, ticker string, referencePrice float64, sharesOffered int, days int, allocation string) error {
+	if sharesOffered < 1 || sharesOffered > ipoTotalShares || days < 1 || referencePrice <= 0 {
+		return errInvalidAction
+	}
+	offerPrice := referencePrice
+	if allocation == "auction" {
+		offerPrice = referencePrice * ipoAuctionReserveMul
+	} else if allocation != "prorata" {
+		return errInvalidAction
+	}
+	opensAt := time.Now().UTC()
+	err := dbTx.QueryRow(ctx, `INSERT INTO ipos (ticker, total_shares, shares_offered, allocation, offer_price, opens_at, closes_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`, ticker, ipoTotalShares, sharesOffered, allocation, offerPrice, opensAt, opensAt.AddDate(0, 0, days)).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+func (Env env) getIpos(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	var theIpos []ipoFormat
+	ipoRows, err := Env.DBPool.Query(r.Context(), `SELECT ipo_id, ipos.ticker, region, total_shares, shares_offered, allocation, offer_price, opens_at, closes_at, closed, clearing_price, shares_allocated, (SELECT COALESCE(SUM(quantity), 0) FROM ipo_bids WHERE ipo_bids.ipo_id = ipos.ipo_id) FROM ipos, stocks WHERE ipos.ticker = stocks.ticker ORDER BY closed ASC, closes_at DESC`)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("getIpos err", err)
+		return
+	}
+	defer ipoRows.Close()
+	for ipoRows.Next() {
+		var thisIpo ipoFormat
+		err = ipoRows.Scan(&thisIpo.IpoId, &thisIpo.Ticker, &thisIpo.Region, &thisIpo.TotalShares, &thisIpo.SharesOffered, &thisIpo.Allocation, &thisIpo.OfferPrice, &thisIpo.OpensAt, &thisIpo.ClosesAt, &thisIpo.Closed, &thisIpo.ClearingPrice, &thisIpo.SharesAllocated, &thisIpo.TotalDemand)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("getIpos scan err", err)
+			return
+		}
+		theIpos = append(theIpos, thisIpo)
+	}
+	encoder.Encode(struct {
+		Ipos []ipoFormat `json:"ipos"`
+	}{
+		Ipos: theIpos,
+	})
+}
+
+func (Env env) placeIpoBid(w http.ResponseWriter, r *http.Request) {
+	log.Println("IPO Bid")
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	var sentData struct {
+		Ticker   string
+		Bidder   string
+		Quantity int
+		Price    float64
+	}
+	err := decoder.Decode(&sentData)
+	if err != nil || sentData.Quantity < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("ipoBid tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), sentData.Bidder, capTrade)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("ipoBid auth err", err)
+		return
+	}
+	var theIpo ipoFormat
+	err = dbTx.QueryRow(r.Context(), `SELECT ipo_id, region, allocation, offer_price, closes_at, closed FROM ipos, stocks WHERE ipos.ticker = stocks.ticker AND ipos.ticker = $1`, sentData.Ticker).Scan(&theIpo.IpoId, &theIpo.Region, &theIpo.Allocation, &theIpo.OfferPrice, &theIpo.ClosesAt, &theIpo.Closed)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("ipoBid ipo err", err)
+		return
+	}
+	if theIpo.Closed || !time.Now().UTC().Before(theIpo.ClosesAt) || theIpo.Region == sentData.Bidder {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if theIpo.Allocation == "prorata" {
+		sentData.Price = theIpo.OfferPrice
+	} else if sentData.Price < theIpo.OfferPrice {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	escrowValue := sentData.Price * float64(sentData.Quantity)
+	if !grant.canSpend(escrowValue) {
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Println("Spending limit exceeded", grant.Actor, grant.Role)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `UPDATE accounts SET cash_in_hand = cash_in_hand - $1, cash_in_escrow = cash_in_escrow + $1 WHERE account_name = $2`, escrowValue, sentData.Bidder).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		log.Println("ipoBid escrow err", err)
+		return
+	}
+	var bidId string
+	err = dbTx.QueryRow(r.Context(), `INSERT INTO ipo_bids (ipo_id, bidder, quantity, bid_price, escrowed, placed_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING bid_id`, theIpo.IpoId, sentData.Bidder, sentData.Quantity, sentData.Price, escrowValue, time.Now().UTC()).Scan(&bidId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("ipoBid insert err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("ipoBid commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder.Encode(struct {
+		BidId string `json:"bidId"`
+	}{
+		BidId: bidId,
+	})
+}
+
+func (Env env) cancelIpoBid(w http.ResponseWriter, r *http.Request) {
+	bidId := r.PathValue("bidId")
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelBid tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	var bidder string
+	var escrowed float64
+	var closed bool
+	err = dbTx.QueryRow(r.Context(), `SELECT bidder, escrowed, closed FROM ipo_bids, ipos WHERE ipo_bids.ipo_id = ipos.ipo_id AND bid_id = $1 FOR UPDATE`, bidId).Scan(&bidder, &escrowed, &closed)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelBid get err", err)
+		return
+	}
+	_, err = Env.authorize(r.Context(), r.Header.Get("NationName"), bidder, capTrade)
+	if err != nil {
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelBid auth err", err)
+		return
+	}
+	if closed {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `UPDATE accounts SET cash_in_hand = cash_in_hand + $1, cash_in_escrow = cash_in_escrow - $1 WHERE account_name = $2`, escrowed, bidder).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelBid escrow err", err)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `DELETE FROM ipo_bids WHERE bid_id = $1`, bidId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelBid delete err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelBid commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Works out how many shares each bid receives and the single price they all pay.
+// Pro-rata scales every bid down evenly when oversubscribed. Auctions fill from
+// the highest bid down and clear at the price of the last bid needed, with bids
+// at that price sharing what's left pro-rata.
+func allocateIpo(bids []ipoBid, sharesOffered int, allocation string, offerPrice float64) (float64, map[string]int) {
+	allocs := map[string]int{}
+	totalDemand := 0
+	for _, bid := range bids {
+		totalDemand += bid.Quantity
+	}
+	if allocation == "prorata" || totalDemand == 0 {
+		for _, bid := range bids {
+			if totalDemand <= sharesOffered {
+				allocs[bid.BidId] = bid.Quantity
+			} else {
+				allocs[bid.BidId] = int(int64(bid.Quantity) * int64(sharesOffered) / int64(totalDemand))
+			}
+		}
+		return offerPrice, allocs
+	}
+	sorted := make([]ipoBid, len(bids))
+	copy(sorted, bids)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Price > sorted[j].Price
+	})
+	remaining := sharesOffered
+	clearingPrice := sorted[len(sorted)-1].Price
+	for i := 0; i < len(sorted) && remaining > 0; {
+		levelPrice := sorted[i].Price
+		levelDemand := 0
+		j := i
+		for ; j < len(sorted) && sorted[j].Price == levelPrice; j++ {
+			levelDemand += sorted[j].Quantity
+		}
+		clearingPrice = levelPrice
+		for _, bid := range sorted[i:j] {
+			if levelDemand <= remaining {
+				allocs[bid.BidId] = bid.Quantity
+			} else {
+				allocs[bid.BidId] = int(int64(bid.Quantity) * int64(remaining) / int64(levelDemand))
+			}
+		}
+		if levelDemand <= remaining {
+			remaining -= levelDemand
+		} else {
+			remaining = 0
+		}
+		i = j
+	}
+	return clearingPrice, allocs
+}
+
+func (Env env) closeDueIpos(ctx context.Context) error {
+	dueRows, err := Env.DBPool.Query(ctx, `SELECT ipo_id FROM ipos WHERE closed = FALSE AND closes_at <= $1`, time.Now().UTC())
+	if err != nil {
+		log.Println("IPO close job err", err)
+		return err
+	}
+	dueIpos, err := pgx.CollectRows(dueRows, pgx.RowTo[string])
+	if err != nil {
+		log.Println("IPO close job err", err)
+		return err
+	}
+	for _, ipoId := range dueIpos {
+		err = Env.closeIpo(ctx, ipoId)
+		if err != nil {
+			log.Println("IPO", ipoId, "close err", err)
+		}
+	}
+	return nil
+}
+
+// Allocates and settles an IPO, then opens its ticker for secondary trading
+func (Env env) closeIpo(ctx context.Context, ipoId string) error {
+	log.Println("Closing IPO", ipoId)
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback(ctx)
+	theIpo := ipoFormat{IpoId: ipoId}
+	err = dbTx.QueryRow(ctx, `SELECT ipos.ticker, region, total_shares, shares_offered, allocation, offer_price FROM ipos, stocks WHERE ipos.ticker = stocks.ticker AND ipo_id = $1 AND closed = FALSE FOR UPDATE OF ipos`, ipoId).Scan(&theIpo.Ticker, &theIpo.Region, &theIpo.TotalShares, &theIpo.SharesOffered, &theIpo.Allocation, &theIpo.OfferPrice)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	bidRows, err := dbTx.Query(ctx, `SELECT bid_id, bidder, quantity, bid_price, escrowed, placed_at FROM ipo_bids WHERE ipo_id = $1 ORDER BY placed_at ASC`, ipoId)
+	if err != nil {
+		return err
+	}
+	var theBids []ipoBid
+	for bidRows.Next() {
+		var thisBid ipoBid
+		err = bidRows.Scan(&thisBid.BidId, &thisBid.Bidder, &thisBid.Quantity, &thisBid.Price, &thisBid.Escrowed, &thisBid.PlacedAt)
+		if err != nil {
+			bidRows.Close()
+			return err
+		}
+		theBids = append(theBids, thisBid)
+	}
+	bidRows.Close()
+	if bidRows.Err() != nil {
+		return bidRows.Err()
+	}
+	clearingPrice, allocs := allocateIpo(theBids, theIpo.SharesOffered, theIpo.Allocation, theIpo.OfferPrice)
+	sharesAllocated := 0
+	for _, bid := range theBids {
+		allocated := allocs[bid.BidId]
+		err = dbTx.QueryRow(ctx, `UPDATE accounts SET cash_in_hand = cash_in_hand + $1, cash_in_escrow = cash_in_escrow - $1 WHERE account_name = $2`, bid.Escrowed, bid.Bidder).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		err = dbTx.QueryRow(ctx, `UPDATE ipo_bids SET allocated = $1 WHERE bid_id = $2`, allocated, bid.BidId).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		if allocated == 0 {
+			continue
+		}
+		err = Env.handCashTransaction(&transactionFormat{
+			Sender:   bid.Bidder,
+			Receiver: theIpo.Region,
+			Value:    float32(clearingPrice * float64(allocated)),
+			Message:  theIpo.Ticker + ` IPO Allocation`,
+			Kind:     "ipo",
+		}, ctx, dbTx)
+		if err != nil {
+			return err
+		}
+		err = dbTx.QueryRow(ctx, `INSERT INTO stock_holdings (ticker, account_name, share_quant, avg_price) VALUES ($1, $2, $3, $4) ON CONFLICT (ticker, account_name) DO UPDATE SET share_quant = stock_holdings.share_quant + EXCLUDED.share_quant, `+weightedAvgPrice, theIpo.Ticker, bid.Bidder, allocated, clearingPrice).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		err = addShareLot(ctx, dbTx, theIpo.Ticker, bid.Bidder, allocated, clearingPrice)
+		if err != nil {
+			return err
+		}
+		sharesAllocated += allocated
+	}
+	err = dbTx.QueryRow(ctx, `INSERT INTO stock_holdings (ticker, account_name, share_quant, avg_price) VALUES ($1, $2, $3, 0) ON CONFLICT (ticker, account_name) DO UPDATE SET share_quant = stock_holdings.share_quant + EXCLUDED.share_quant`, theIpo.Ticker, theIpo.Region, theIpo.TotalShares-sharesAllocated).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	err = addShareLot(ctx, dbTx, theIpo.Ticker, theIpo.Region, theIpo.TotalShares-sharesAllocated, 0)
+	if err != nil {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE stocks SET total_share_volume = $1, share_price = $2, market_cap = $3, trading_open = TRUE WHERE ticker = $4`, theIpo.TotalShares, clearingPrice, clearingPrice*float64(theIpo.TotalShares), theIpo.Ticker).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE ipos SET closed = TRUE, clearing_price = $1, shares_allocated = $2 WHERE ipo_id = $3`, clearingPrice, sharesAllocated, ipoId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return dbTx.Commit(ctx)
+}
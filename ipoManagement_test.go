@@ -0,0 +1,112 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestAllocateIpo(t *testing.T) {
+	cases := []struct {
+		name       string
+		bids       []ipoBid
+		offered    int
+		allocation string
+		wantPrice  float64
+		want       map[string]int
+	}{
+		{
+			name:       "no bids",
+			offered:    100,
+			allocation: "auction",
+			wantPrice:  10,
+			want:       map[string]int{},
+		},
+		{
+			name:       "prorata undersubscribed fills everyone",
+			bids:       []ipoBid{{BidId: "a", Quantity: 30}, {BidId: "b", Quantity: 20}},
+			offered:    100,
+			allocation: "prorata",
+			wantPrice:  10,
+			want:       map[string]int{"a": 30, "b": 20},
+		},
+		{
+			name:       "prorata oversubscribed scales evenly",
+			bids:       []ipoBid{{BidId: "a", Quantity: 70}, {BidId: "b", Quantity: 30}},
+			offered:    50,
+			allocation: "prorata",
+			wantPrice:  10,
+			want:       map[string]int{"a": 35, "b": 15},
+		},
+		{
+			name:       "prorata rounds down and never overallocates",
+			bids:       []ipoBid{{BidId: "a", Quantity: 100}, {BidId: "b", Quantity: 100}, {BidId: "c", Quantity: 100}},
+			offered:    100,
+			allocation: "prorata",
+			wantPrice:  10,
+			want:       map[string]int{"a": 33, "b": 33, "c": 33},
+		},
+		{
+			name:       "auction undersubscribed clears at the lowest bid",
+			bids:       []ipoBid{{BidId: "a", Quantity: 10, Price: 12}, {BidId: "b", Quantity: 10, Price: 8}},
+			offered:    100,
+			allocation: "auction",
+			wantPrice:  8,
+			want:       map[string]int{"a": 10, "b": 10},
+		},
+		{
+			name: "auction clears at the marginal bid",
+			bids: []ipoBid{
+				{BidId: "d", Quantity: 50, Price: 9},
+				{BidId: "a", Quantity: 60, Price: 12},
+				{BidId: "c", Quantity: 40, Price: 10},
+				{BidId: "b", Quantity: 30, Price: 11},
+			},
+			offered:    100,
+			allocation: "auction",
+			wantPrice:  10,
+			want:       map[string]int{"a": 60, "b": 30, "c": 10},
+		},
+		{
+			name: "auction ties at the marginal price share pro-rata",
+			bids: []ipoBid{
+				{BidId: "a", Quantity: 50, Price: 12},
+				{BidId: "b", Quantity: 60, Price: 10},
+				{BidId: "c", Quantity: 40, Price: 10},
+			},
+			offered:    100,
+			allocation: "auction",
+			wantPrice:  10,
+			want:       map[string]int{"a": 50, "b": 30, "c": 20},
+		},
+		{
+			name: "auction ties round down",
+			bids: []ipoBid{
+				{BidId: "a", Quantity: 3, Price: 5},
+				{BidId: "b", Quantity: 3, Price: 5},
+				{BidId: "c", Quantity: 3, Price: 5},
+			},
+			offered:    7,
+			allocation: "auction",
+			wantPrice:  5,
+			want:       map[string]int{"a": 2, "b": 2, "c": 2},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotPrice, got := allocateIpo(tc.bids, tc.offered, tc.allocation, 10)
+			if gotPrice != tc.wantPrice {
+				t.Errorf("allocateIpo() price = %v, want %v", gotPrice, tc.wantPrice)
+			}
+			if !maps.Equal(got, tc.want) {
+				t.Errorf("allocateIpo() allocations = %v, want %v", got, tc.want)
+			}
+			allocated := 0
+			for _, quantity := range got {
+				allocated += quantity
+			}
+			if allocated > tc.offered {
+				t.Errorf("allocateIpo() allocated %v of %v shares offered", allocated, tc.offered)
+			}
+		})
+	}
+}
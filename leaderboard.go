@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultLeaderboardPage = 25
+	maxLeaderboardPage     = 100
+)
+
+// accountValuesSQL values every account in one pass, the same way buildNetWorth does for one.
+// P&L is at average cost, realised from disposals plus unrealised on the shares still held.
+const accountValuesSQL = `WITH shares AS (
+		SELECT account_name, SUM(share_quant * COALESCE(share_price, 0)) AS share_value, SUM(share_quant * (COALESCE(share_price, 0) - COALESCE(avg_price, 0))) AS unrealised FROM stock_holdings JOIN stocks USING (ticker) GROUP BY account_name
+	), realised AS (
+		SELECT account_name, SUM(proceeds - average_cost) AS realised FROM share_disposals GROUP BY account_name
+	), bonds AS (
+		SELECT account_name, SUM(quantity * face_value) AS bond_value FROM bond_holdings JOIN bond_series USING (series_id) WHERE bond_status != 'defaulted' GROUP BY account_name
+	), bond_debt AS (
+		-- A defaulted series is worth nothing to its holders, but the issuer still owes it until it matures.
+		SELECT region AS account_name, SUM(quantity_sold * face_value) AS bond_debt FROM bond_series WHERE matured = FALSE GROUP BY region
+	), loan_debt AS (
+		SELECT lendee AS account_name, SUM(current_value) AS loan_debt FROM loans GROUP BY lendee
+	), memberships AS (
+		SELECT DISTINCT ON (nation_name) nation_name AS account_name, region_name FROM nation_permissions ORDER BY nation_name, region_name
+	)
+	SELECT account_name, account_type, privacy, region_name, cash, escrow, share_value, bond_value, portfolio, debt, cash + portfolio - debt AS net_worth, pnl FROM (
+		SELECT account_name, account_type, privacy, region_name, cash_in_hand AS cash, cash_in_escrow AS escrow, COALESCE(share_value, 0) AS share_value, COALESCE(bond_value, 0) AS bond_value, COALESCE(share_value, 0) + COALESCE(bond_value, 0) AS portfolio, COALESCE(loan_debt, 0) + COALESCE(bond_debt, 0) AS debt, COALESCE(unrealised, 0) + COALESCE(realised, 0) AS pnl
+		FROM accounts LEFT JOIN shares USING (account_name) LEFT JOIN realised USING (account_name) LEFT JOIN bonds USING (account_name) LEFT JOIN bond_debt USING (account_name) LEFT JOIN loan_debt USING (account_name) LEFT JOIN memberships USING (account_name)
+	) valued`
+
+// netWorthSQL is what goes on the leaderboard, the public nations
+const netWorthSQL = `SELECT account_name, region_name, cash, portfolio, debt, net_worth, pnl FROM (` + accountValuesSQL + `) account_values WHERE account_type = 'nation' AND privacy = 'public'`
+
+// What the leaderboard can be sorted by, to the column it sorts on
+var leaderboardSorts = map[string]string{
+	"net_worth": "net_worth",
+	"cash":      "cash",
+	"portfolio": "portfolio",
+	"pnl":       "pnl",
+}
+
+type leaderboardEntry struct {
+	Rank      int     `json:"rank"`
+	Nation    string  `json:"nation"`
+	Region    *string `json:"region"`
+	Cash      float64 `json:"cash"`
+	Portfolio float64 `json:"portfolio"`
+	Debt      float64 `json:"debt"`
+	NetWorth  float64 `json:"netWorth"`
+	PnL       float64 `json:"pnl"`
+}
+
+// queryLeaderboard ranks nations live, or as they were on snapshotDate when it's set
+func (Env env) queryLeaderboard(ctx context.Context, sortBy string, region string, snapshotDate *time.Time, limit int, offset int) ([]leaderboardEntry, int, error) {
+	source := `(` + netWorthSQL + `) worth`
+	args := []any{region, limit, offset}
+	if snapshotDate != nil {
+		source = `(SELECT account_name, region_name, cash, portfolio, debt, net_worth, pnl FROM leaderboard_snapshots WHERE snapshot_date = $4) worth`
+		args = append(args, *snapshotDate)
+	}
+	sortColumn := leaderboardSorts[sortBy]
+	rankRows, err := Env.DBPool.Query(ctx, `SELECT RANK() OVER (ORDER BY `+sortColumn+` DESC), account_name, region_name, cash, portfolio, debt, net_worth, pnl, COUNT(*) OVER () FROM `+source+` WHERE ($1 = '' OR region_name = $1) ORDER BY `+sortColumn+` DESC, account_name LIMIT $2 OFFSET $3`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rankRows.Close()
+	entries := []leaderboardEntry{}
+	total := 0
+	for rankRows.Next() {
+		var curEntry leaderboardEntry
+		err = rankRows.Scan(&curEntry.Rank, &curEntry.Nation, &curEntry.Region, &curEntry.Cash, &curEntry.Portfolio, &curEntry.Debt, &curEntry.NetWorth, &curEntry.PnL, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, curEntry)
+	}
+	return entries, total, rankRows.Err()
+}
+
+// getLeaderboard takes sort, region, limit, offset and date, a day to read the snapshot of.
+// Only nations with public privacy are listed.
+func (Env env) getLeaderboard(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	sortBy := params.Get("sort")
+	if sortBy == "" {
+		sortBy = "net_worth"
+	}
+	if leaderboardSorts[sortBy] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var err error
+	limit, offset := defaultLeaderboardPage, 0
+	if params.Has("limit") {
+		limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > maxLeaderboardPage {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if params.Has("offset") {
+		offset, err = strconv.Atoi(params.Get("offset"))
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	var snapshotDate *time.Time
+	if params.Has("date") {
+		parsed, err := time.Parse(time.DateOnly, params.Get("date"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		snapshotDate = &parsed
+	}
+	entries, total, err := Env.queryLeaderboard(r.Context(), sortBy, params.Get("region"), snapshotDate, limit, offset)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Leaderboard Err", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sort    string             `json:"sort"`
+		Date    *time.Time         `json:"date,omitempty"`
+		Total   int                `json:"total"`
+		Entries []leaderboardEntry `json:"entries"`
+	}{sortBy, snapshotDate, total, entries})
+}
+
+// getRankHistory gives a nation's daily snapshots, newest first, up to a year back
+func (Env env) getRankHistory(w http.ResponseWriter, r *http.Request) {
+	nation := r.PathValue("name")
+	if !Env.checkDetailsVisible(w, r, nation) {
+		return
+	}
+	historyRows, err := Env.DBPool.Query(r.Context(), `SELECT snapshot_date, net_worth_rank, region_rank, net_worth, pnl FROM leaderboard_snapshots WHERE account_name = $1 ORDER BY snapshot_date DESC LIMIT 366`, nation)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Rank history Err", err)
+		return
+	}
+	defer historyRows.Close()
+	type rankSnapshot struct {
+		Date       time.Time `json:"date"`
+		Rank       int       `json:"rank"`
+		RegionRank *int      `json:"regionRank,omitempty"`
+		NetWorth   float64   `json:"netWorth"`
+		PnL        float64   `json:"pnl"`
+	}
+	history := []rankSnapshot{}
+	for historyRows.Next() {
+		var curSnapshot rankSnapshot
+		err = historyRows.Scan(&curSnapshot.Date, &curSnapshot.Rank, &curSnapshot.RegionRank, &curSnapshot.NetWorth, &curSnapshot.PnL)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Rank history scan Err", err)
+			return
+		}
+		history = append(history, curSnapshot)
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+// snapshotLeaderboard records the day's rankings, run once a day by the scheduler
+func (Env env) snapshotLeaderboard(ctx context.Context) {
+	err := Env.DBPool.QueryRow(ctx, `INSERT INTO leaderboard_snapshots (snapshot_date, account_name, region_name, cash, portfolio, debt, net_worth, pnl, net_worth_rank, region_rank)
+		SELECT $1, account_name, region_name, cash, portfolio, debt, net_worth, pnl, RANK() OVER (ORDER BY net_worth DESC), CASE WHEN region_name IS NULL THEN NULL ELSE RANK() OVER (PARTITION BY region_name ORDER BY net_worth DESC) END
+		FROM (`+netWorthSQL+`) worth
+		ON CONFLICT (snapshot_date, account_name) DO NOTHING`, time.Now().UTC().Format(time.DateOnly)).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println("Leaderboard snapshot Err", err)
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"math"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -16,7 +17,7 @@ type loanFormat struct {
 	Lender       string  `json:"lender"`                 // The person issuing the loan
 	Lendee       string  `json:"lendee"`                 // The person receiving the loan
 	LentValue    float32 `json:"lentValue"`              // The value lent out
-	LoanRate     float32 `json:"loanRate"`               // The loan interest rate
+	LoanRate     float32 `json:"loanRate"`               // The annual loan interest rate, as a percentage
 	CurrentValue float32 `json:"currentValue,omitempty"` // The current value of the loan, basically LentValue + interest - repayments
 }
 
@@ -32,12 +33,46 @@ func (Env env) manualLoanIssue(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	theLoan.CurrentValue = theLoan.LentValue
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), theLoan.Lender, capLend)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	if !grant.canSpend(float64(theLoan.LentValue)) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("Spending limit exceeded", grant.Actor, grant.Role)
+		return
+	}
 	dbTx, err := Env.DBPool.Begin(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer dbTx.Rollback(r.Context())
+	actionId, err := proposeRegionAction(r.Context(), dbTx, theLoan.Lender, "loan_issue", float64(theLoan.LentValue), theLoan, grant.Actor)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region action Err", err)
+		return
+	}
+	if actionId != "" {
+		err = dbTx.Commit(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		encodePendingAction(w, actionId)
+		return
+	}
 	theLoan.LoanId, err = Env.loanIssue(r.Context(), &theLoan, dbTx)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -67,10 +102,13 @@ func (Env env) loanIssue(ctx context.Context, theLoan *loanFormat, dbTx pgx.Tx)
 	}
 	cashMessage := `Loan Issue - ID ` + theId
 	err = Env.handCashTransaction(&transactionFormat{
-		Sender:   theLoan.Lender,
-		Receiver: theLoan.Lendee,
-		Value:    theLoan.LentValue,
-		Message:  cashMessage,
+		Sender:    theLoan.Lender,
+		Receiver:  theLoan.Lendee,
+		Value:     theLoan.LentValue,
+		Message:   cashMessage,
+		Kind:      "loan",
+		LoanId:    theId,
+		LoanEvent: "issue",
 	}, ctx, dbTx)
 	return theId, err
 }
@@ -91,59 +129,17 @@ func (Env env) getLoan(w http.ResponseWriter, r *http.Request) {
 		log.Println("Get loan Err", err)
 		return
 	}
-	var possibleRegions []string
-	var sameThing bool
-	bothAccts, err := Env.DBPool.Query(r.Context(), `SELECT account_name, account_type FROM accounts WHERE account_name = $1 OR account_name = $2`, theLoan.Lendee, theLoan.Lender)
-	if err != nil && err != pgx.ErrNoRows {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer bothAccts.Close()
-	for bothAccts.Next() {
-		if bothAccts.Err() != nil {
-			log.Println("getLoan perms err", err)
-			continue
-		}
-		var thisAccountName, thisAccountType string
-		err = bothAccts.Scan(&thisAccountName, &thisAccountType)
-		if err != nil {
-			log.Println("Some err", err)
-			continue
-		}
-		if thisAccountName == reqNat {
-			sameThing = true
-			break
-		}
-		if thisAccountType == "region" {
-			possibleRegions = append(possibleRegions, thisAccountName)
-		}
+	_, err = Env.authorize(r.Context(), reqNat, theLoan.Lendee, capView)
+	if err == errUnauthorized {
+		_, err = Env.authorize(r.Context(), reqNat, theLoan.Lender, capView)
 	}
-	var livePerms bool = false
-	if !sameThing {
-		if len(possibleRegions) > 0 {
-			for _, region := range possibleRegions {
-				var perm string
-				err := Env.DBPool.QueryRow(r.Context(), `SELECT permission FROM nation_permissions WHERE nation_name = $1 AND region_name = $2`, reqNat, region).Scan(&perm)
-				if err != nil {
-					if err == pgx.ErrNoRows {
-						continue
-					}
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Println("getLoan perm err", err)
-					return
-				}
-				if perm != "citizen" {
-					livePerms = true
-					break
-				}
-			}
-		} else {
+	if err != nil {
+		if err == errUnauthorized || err == pgx.ErrNoRows {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-	}
-	if (theLoan.Lendee != reqNat && theLoan.Lender != reqNat) && !livePerms {
-		w.WriteHeader(http.StatusForbidden)
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("getLoan auth err", err)
 		return
 	}
 	loanTransacts, err := Env.DBPool.Query(r.Context(), `SELECT timecode, sender, receiver ,transaction_value, transaction_message FROM cash_transactions WHERE transaction_message LIKE $1 ORDER BY timecode DESC`, ("%ID " + loanId))
@@ -162,12 +158,20 @@ func (Env env) getLoan(w http.ResponseWriter, r *http.Request) {
 		}
 		theTransacts = append(theTransacts, curTransact)
 	}
+	theAccruals, err := getLoanAccruals(r.Context(), Env.DBPool, loanId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("getLoan accruals err", err)
+		return
+	}
 	encoder.Encode(struct {
 		TheLoan       loanFormat
 		LoanTransacts []transactionFormat
+		LoanAccruals  []accrualFormat
 	}{
 		TheLoan:       theLoan,
 		LoanTransacts: theTransacts,
+		LoanAccruals:  theAccruals,
 	})
 }
 
@@ -249,38 +253,24 @@ func (Env env) payLoan(w http.ResponseWriter, r *http.Request) {
 		log.Println("payLoan getloan Err", err)
 		return
 	}
-	var accType string
-	err = dbConn.QueryRow(r.Context(), `SELECT account_type FROM accounts WHERE account_name = $1`, theLoan.Lendee).Scan(&accType)
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), theLoan.Lendee, capSendCash)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		log.Println("payLoan perm err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if strings.EqualFold(accType, "region") {
-		var perm string
-		err = dbConn.QueryRow(r.Context(), `SELECT permission FROM nation_permissions WHERE nation_name = $1 AND region_name = $2;`, r.Header.Get("NationName"), theLoan.Lendee).Scan(&perm)
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
-			log.Println("payLoan perm err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if perm == "citizen" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-	} else {
-		if theLoan.Lendee != r.Header.Get("NationName") {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+	if !grant.canSpend(float64(min(sentData.RepayAmount, theLoan.CurrentValue))) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("Spending limit exceeded", grant.Actor, grant.Role)
+		return
 	}
 	dbTx, err := dbConn.Begin(r.Context())
 	if err != nil {
@@ -306,7 +296,7 @@ func (Env env) payLoan(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	cashMessage := `Loan Repayment - ID ` + sentData.LoanId
-	err = Env.handCashTransaction(&transactionFormat{Sender: theLoan.Lendee, Receiver: theLoan.Lender, Value: sentData.RepayAmount, Message: cashMessage}, r.Context(), dbTx)
+	err = Env.handCashTransaction(&transactionFormat{Sender: theLoan.Lendee, Receiver: theLoan.Lender, Value: sentData.RepayAmount, Message: cashMessage, Kind: "loan", LoanId: sentData.LoanId, LoanEvent: "repayment"}, r.Context(), dbTx)
 	if err != nil {
 		log.Println("loanRepay cashTransact err", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -341,41 +331,16 @@ func (Env env) writeOffLoan(w http.ResponseWriter, r *http.Request) {
 		log.Println("writeOff Query Err", err)
 		return
 	}
-	log.Println(lender)
-	var accType string
-	err = dbConn.QueryRow(r.Context(), `SELECT account_type FROM accounts WHERE account_name = $1`, lender).Scan(&accType)
+	_, err = Env.authorize(r.Context(), r.Header.Get("NationName"), lender, capWriteOff)
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("writeOff Query Err", err)
+		log.Println("writeOff Auth Err", err)
 		return
 	}
-	if accType == "region" {
-		var natPerm string
-		err = dbConn.QueryRow(r.Context(), `SELECT permission FROM nation_permissions WHERE nation_name = $1 AND region_name = $2`, r.Header.Get("NationName"), lender).Scan(&natPerm)
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("writeOff Query Err", err)
-			return
-		}
-		log.Println(natPerm)
-		if natPerm == "citizen" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-	} else {
-		if lender != r.Header.Get("NationName") {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-	}
 	err = dbConn.QueryRow(r.Context(), `DELETE FROM loans WHERE loan_id = $1`, loanId).Scan()
 	if err != nil && err != pgx.ErrNoRows {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -385,15 +350,36 @@ func (Env env) writeOffLoan(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// Loan rates are annual percentages, accrued on an Actual/365 Fixed basis and
+// compounded daily. Only whole elapsed days are accrued, so a rerun on the same
+// day is a no-op and a missed run is caught up by the next one.
+const dayCountBasis = 365
+
+type accrualFormat struct {
+	LoanId       string    `json:"loanId"`
+	PeriodStart  time.Time `json:"periodStart"`
+	PeriodEnd    time.Time `json:"periodEnd"`
+	AccrualDays  int       `json:"accrualDays"`
+	OpeningValue float64   `json:"openingValue"`
+	Interest     float64   `json:"interest"`
+	ClosingValue float64   `json:"closingValue"`
+}
+
+func accrueInterest(openingValue float64, annualRate float64, days int) float64 {
+	dailyRate := (annualRate / 100) / dayCountBasis
+	return openingValue * (math.Pow(1+dailyRate, float64(days)) - 1)
+}
+
 func (Env env) updateLoanValues(ctx context.Context) error {
 	log.Println("Updating Loan Values")
-	dbConn, err := Env.DBPool.Acquire(ctx)
+	accrualTime := time.Now().UTC()
+	dbTx, err := Env.DBPool.Begin(ctx)
 	if err != nil {
 		log.Println("Loan Update job err", err)
 		return err
 	}
-	defer dbConn.Release()
-	theLoans, err := dbConn.Query(ctx, `SELECT loan_id, rate, current_value FROM loans`)
+	defer dbTx.Rollback(ctx)
+	theLoans, err := dbTx.Query(ctx, `SELECT loan_id, lendee, lender, rate, current_value, last_accrued FROM loans WHERE last_accrued <= $1 FOR UPDATE`, accrualTime.Add(-24*time.Hour))
 	if err != nil {
 		log.Println("Loan update job err", err)
 		return err
@@ -401,24 +387,57 @@ func (Env env) updateLoanValues(ctx context.Context) error {
 	defer theLoans.Close()
 	loanBatch := pgx.Batch{}
 	for theLoans.Next() {
-		var loanId int
-		var loanRate, curVal float32
-		err := theLoans.Scan(&loanId, &loanRate, &curVal)
+		var lendee, lender string
+		var accrual accrualFormat
+		var loanRate float64
+		err := theLoans.Scan(&accrual.LoanId, &lendee, &lender, &loanRate, &accrual.OpeningValue, &accrual.PeriodStart)
 		if err != nil {
 			log.Println("Loan update err", err)
 			return err
 		}
-		newVal := curVal * (1 + (loanRate / 100))
-		loanBatch.Queue(`UPDATE loans SET current_value = $1 WHERE loan_id = $2`, newVal, loanId)
+		accrual.AccrualDays = int(accrualTime.Sub(accrual.PeriodStart) / (24 * time.Hour))
+		if accrual.AccrualDays < 1 {
+			continue
+		}
+		accrual.PeriodEnd = accrual.PeriodStart.Add(time.Duration(accrual.AccrualDays) * 24 * time.Hour)
+		accrual.Interest = accrueInterest(accrual.OpeningValue, loanRate, accrual.AccrualDays)
+		accrual.ClosingValue = accrual.OpeningValue + accrual.Interest
+		loanBatch.Queue(`UPDATE loans SET current_value = $1, last_accrued = $2 WHERE loan_id = $3`, accrual.ClosingValue, accrual.PeriodEnd, accrual.LoanId)
+		loanBatch.Queue(`INSERT INTO loan_accruals (loan_id, lendee, lender, period_start, period_end, accrual_days, opening_value, interest, closing_value) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, accrual.LoanId, lendee, lender, accrual.PeriodStart, accrual.PeriodEnd, accrual.AccrualDays, accrual.OpeningValue, accrual.Interest, accrual.ClosingValue)
 	}
 	if err = theLoans.Err(); err != nil {
 		log.Println("Loan updating err", err)
 		return err
 	}
-	err = dbConn.SendBatch(ctx, &loanBatch).Close()
+	theLoans.Close()
+	err = dbTx.SendBatch(ctx, &loanBatch).Close()
 	if err != nil {
 		log.Println("Loan update job err", err)
 		return err
 	}
+	err = dbTx.Commit(ctx)
+	if err != nil {
+		log.Println("Loan update commit err", err)
+		return err
+	}
+	log.Println("Loan accruals written", loanBatch.Len()/2)
 	return nil
 }
+
+func getLoanAccruals(ctx context.Context, dbPool *pgxpool.Pool, loanId string) ([]accrualFormat, error) {
+	accrualRows, err := dbPool.Query(ctx, `SELECT period_start, period_end, accrual_days, opening_value, interest, closing_value FROM loan_accruals WHERE loan_id = $1 ORDER BY period_end DESC`, loanId)
+	if err != nil {
+		return nil, err
+	}
+	defer accrualRows.Close()
+	var accruals []accrualFormat
+	for accrualRows.Next() {
+		thisAccrual := accrualFormat{LoanId: loanId}
+		err := accrualRows.Scan(&thisAccrual.PeriodStart, &thisAccrual.PeriodEnd, &thisAccrual.AccrualDays, &thisAccrual.OpeningValue, &thisAccrual.Interest, &thisAccrual.ClosingValue)
+		if err != nil {
+			return nil, err
+		}
+		accruals = append(accruals, thisAccrual)
+	}
+	return accruals, accrualRows.Err()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAccrueInterest(t *testing.T) {
+	cases := []struct {
+		name  string
+		value float64
+		rate  float64
+		days  int
+		want  float64
+	}{
+		{"no days", 1000, 5, 0, 0},
+		{"no rate", 1000, 0, 30, 0},
+		{"one day", 1000, 3.65, 1, 0.1},
+		{"a month", 1000, 5, 30, 4.117762369655553},
+		{"a year compounds past the simple rate", 1000, 3.65, 365, 37.17241130254778},
+		{"leap year counts 366 days over 365", 1000, 10, 366, 105.4585640221548},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := accrueInterest(tc.value, tc.rate, tc.days)
+			if math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("accrueInterest(%v, %v, %v) = %v, want %v", tc.value, tc.rate, tc.days, got, tc.want)
+			}
+		})
+	}
+}
+
+// A missed run caught up in one go has to land where daily runs would have
+func TestAccrueInterestCatchUp(t *testing.T) {
+	value, rate := 2500.0, 7.5
+	daily := value
+	for range 10 {
+		daily += accrueInterest(daily, rate, 1)
+	}
+	caughtUp := value + accrueInterest(value, rate, 10)
+	if math.Abs(daily-caughtUp) > 1e-9 {
+		t.Errorf("ten daily accruals = %v, one ten day accrual = %v", daily, caughtUp)
+	}
+}
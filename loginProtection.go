@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed logins lock the nation at the address they came from, or the address as a whole,
+// out for a period that doubles with each failure past the threshold. Addresses get more
+// leeway as several nations can share one. Failures older than the window are forgotten.
+//
+// Every failure counts towards the nation's total, and addresses that have never logged in
+// as the nation are locked out on that total, so spreading guesses over addresses doesn't
+// help. Addresses the nation has logged in from before only go by their own failures, so
+// guesses from elsewhere can't lock the owner out.
+const (
+	nationLockoutThreshold = 5
+	ipLockoutThreshold     = 20
+	lockoutBase            = time.Minute
+	lockoutMax             = 24 * time.Hour
+	failureWindow          = 24 * time.Hour
+)
+
+type loginAttemptFormat struct {
+	AttemptedAt time.Time `json:"attemptedAt"`
+	IpAddress   string    `json:"ipAddress"`
+	Succeeded   bool      `json:"succeeded"`
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// burnBcrypt spends as long as a real password check would, so response times
+// don't give away which nations exist
+func (Env env) burnBcrypt(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not anyone's password"), Env.HashCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func lockoutFor(failures int, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	lockout := lockoutBase
+	for i := threshold; i < failures && lockout < lockoutMax; i++ {
+		lockout *= 2
+	}
+	return min(lockout, lockoutMax)
+}
+
+func nationThrottleKey(nation string) string {
+	return "nation:" + nation
+}
+
+// pairThrottleKey is where lockouts of the nation are kept, always against one address
+func pairThrottleKey(nation string, ip string) string {
+	return nationThrottleKey(nation) + "|ip:" + ip
+}
+
+// loginLockedUntil is when the later of the nation's lockout at the address and the
+// address's own lockout ends, zero if neither is locked out. Addresses the nation has
+// never logged in from are also held to the nation's total, before their first guess.
+func (Env env) loginLockedUntil(ctx context.Context, nation string, ip string) (time.Time, error) {
+	now := time.Now().UTC()
+	var lockedUntil *time.Time
+	err := Env.DBPool.QueryRow(ctx, `SELECT MAX(locked_until) FROM login_throttle WHERE throttle_key = ANY($1) AND locked_until > $2`, []string{pairThrottleKey(nation, ip), "ip:" + ip}, now).Scan(&lockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	until := time.Time{}
+	if lockedUntil != nil {
+		until = *lockedUntil
+	}
+	var knownAddress bool
+	err = Env.DBPool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM login_attempts WHERE nation_name = $1 AND ip_address = $2 AND succeeded)`, nation, ip).Scan(&knownAddress)
+	if err != nil || knownAddress {
+		return until, err
+	}
+	var failures int
+	var lastFailure time.Time
+	err = Env.DBPool.QueryRow(ctx, `SELECT failures, last_failure FROM login_throttle WHERE throttle_key = $1 AND last_failure >= $2`, nationThrottleKey(nation), now.Add(-failureWindow)).Scan(&failures, &lastFailure)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return until, nil
+		}
+		return time.Time{}, err
+	}
+	if nationUntil := lastFailure.Add(lockoutFor(failures, nationLockoutThreshold)); nationUntil.After(now) && nationUntil.After(until) {
+		until = nationUntil
+	}
+	return until, nil
+}
+
+func (Env env) recordLoginAttempt(ctx context.Context, nation string, ip string, succeeded bool) error {
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback(ctx)
+	now := time.Now().UTC()
+	err = dbTx.QueryRow(ctx, `INSERT INTO login_attempts (attempted_at, nation_name, ip_address, succeeded) VALUES ($1, $2, $3, $4)`, now, nation, ip, succeeded).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	if succeeded {
+		// The address keeps its count, one good login shouldn't wipe out guesses at other nations.
+		// Other addresses stay locked out of the nation, they may well be the ones guessing.
+		err = dbTx.QueryRow(ctx, `DELETE FROM login_throttle WHERE throttle_key = ANY($1)`, []string{nationThrottleKey(nation), pairThrottleKey(nation, ip)}).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		return dbTx.Commit(ctx)
+	}
+	var knownAddress bool
+	err = dbTx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM login_attempts WHERE nation_name = $1 AND ip_address = $2 AND succeeded)`, nation, ip).Scan(&knownAddress)
+	if err != nil {
+		return err
+	}
+	failures := map[string]int{}
+	for _, key := range []string{nationThrottleKey(nation), pairThrottleKey(nation, ip), "ip:" + ip} {
+		var keyFailures int
+		err = dbTx.QueryRow(ctx, `INSERT INTO login_throttle (throttle_key, failures, last_failure) VALUES ($1, 1, $2) ON CONFLICT (throttle_key) DO UPDATE SET failures = CASE WHEN login_throttle.last_failure < $3 THEN 1 ELSE login_throttle.failures + 1 END, last_failure = EXCLUDED.last_failure RETURNING failures`, key, now, now.Add(-failureWindow)).Scan(&keyFailures)
+		if err != nil {
+			return err
+		}
+		failures[key] = keyFailures
+	}
+	pairFailures := failures[pairThrottleKey(nation, ip)]
+	if !knownAddress {
+		pairFailures = max(pairFailures, failures[nationThrottleKey(nation)])
+	}
+	lockouts := map[string]time.Duration{
+		pairThrottleKey(nation, ip): lockoutFor(pairFailures, nationLockoutThreshold),
+		"ip:" + ip:                  lockoutFor(failures["ip:"+ip], ipLockoutThreshold),
+	}
+	for key, lockout := range lockouts {
+		if lockout > 0 {
+			err = dbTx.QueryRow(ctx, `UPDATE login_throttle SET locked_until = $1 WHERE throttle_key = $2`, now.Add(lockout), key).Scan()
+			if err != nil && err != pgx.ErrNoRows {
+				return err
+			}
+		}
+	}
+	return dbTx.Commit(ctx)
+}
+
+func writeLockedOut(w http.ResponseWriter, lockedUntil time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(lockedUntil).Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// recentLogins is the requesting nation's last login attempts, failed ones included
+func (Env env) recentLogins(w http.ResponseWriter, r *http.Request) {
+	attemptRows, err := Env.DBPool.Query(r.Context(), `SELECT attempted_at, ip_address, succeeded FROM login_attempts WHERE nation_name = $1 ORDER BY attempted_at DESC LIMIT 50`, r.Header.Get("NationName"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Login attempts Err", err)
+		return
+	}
+	theAttempts, err := pgx.CollectRows(attemptRows, pgx.RowToStructByPos[loginAttemptFormat])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Login attempts scan Err", err)
+		return
+	}
+	if theAttempts == nil {
+		theAttempts = []loginAttemptFormat{}
+	}
+	json.NewEncoder(w).Encode(theAttempts)
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
@@ -16,18 +17,31 @@ import (
 
 var HashCost,
 	DbString,
-	ExtraKeyString string
+	ExtraKeyString,
+	TrustedProxies string // Comma separated addresses or CIDR ranges of proxies in front of the server
 
 type env struct {
 	DBPool    *pgxpool.Pool
 	HashCost  int
 	KeyString string
+	NSClient  nsClient
+	// IndexUpdates asks indexUpdater for a recalculation, see requestIndexUpdate
+	IndexUpdates chan struct{}
+	// TrustedProxies are the proxies whose X-Forwarded-For clientIP believes, none by default
+	TrustedProxies []string
 }
 
 func main() {
 	primCtx := context.Background()
 	var primaryEnv env = env{
-		KeyString: ExtraKeyString,
+		KeyString:    ExtraKeyString,
+		NSClient:     newLiveNSClient(),
+		IndexUpdates: make(chan struct{}, 1),
+	}
+	for _, proxy := range strings.Split(TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			primaryEnv.TrustedProxies = append(primaryEnv.TrustedProxies, proxy)
+		}
 	}
 	var err error
 	primaryEnv.HashCost, _ = strconv.Atoi(HashCost)
@@ -46,6 +60,8 @@ func main() {
 	testConn.Release()
 	defer primaryEnv.DBPool.Close()
 
+	go primaryEnv.indexUpdater(primCtx)
+
 	cronSched, err := gocron.NewScheduler()
 	if err != nil {
 		log.Fatal(err)
@@ -58,10 +74,38 @@ func main() {
 		gocron.CronJob(`5 0 * * *`, false),
 		gocron.NewTask(primaryEnv.updateLoanValues, primCtx),
 	)
+	cronSched.NewJob(
+		gocron.CronJob(`10 0 * * *`, false),
+		gocron.NewTask(primaryEnv.payBondCoupons, primCtx),
+	)
+	cronSched.NewJob(
+		gocron.CronJob(`12 0 * * *`, false),
+		gocron.NewTask(primaryEnv.processDividends, primCtx),
+	)
+	cronSched.NewJob(
+		gocron.CronJob(`*/15 * * * *`, false),
+		gocron.NewTask(primaryEnv.closeDueIpos, primCtx),
+	)
+	cronSched.NewJob(
+		gocron.CronJob(`*/15 * * * *`, false),
+		gocron.NewTask(primaryEnv.closeDueProposals, primCtx),
+	)
 	cronSched.NewJob(
 		gocron.CronJob(`15 0 * * *`, false),
 		gocron.NewTask(primaryEnv.runRealign, primCtx),
 	)
+	cronSched.NewJob(
+		gocron.CronJob(`45 0 * * *`, false),
+		gocron.NewTask(primaryEnv.syncResidency, primCtx),
+	)
+	cronSched.NewJob(
+		gocron.CronJob(`50 23 * * *`, false),
+		gocron.NewTask(primaryEnv.snapshotAccountValues, primCtx),
+	)
+	cronSched.NewJob(
+		gocron.CronJob(`55 23 * * *`, false),
+		gocron.NewTask(primaryEnv.snapshotLeaderboard, primCtx),
+	)
 	theMux := http.NewServeMux()
 	theMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello!"))
@@ -73,15 +117,53 @@ func main() {
 	})
 	theMux.HandleFunc("POST /signup/nation", primaryEnv.signupFunc)
 	theMux.HandleFunc("POST /signup/region", func(w http.ResponseWriter, r *http.Request) {
-		primaryEnv.securedWrapper(w, r, primaryEnv.registerRegion)
+		primaryEnv.sessionWrapper(w, r, primaryEnv.registerRegion)
 	})
 	theMux.HandleFunc("POST /verify/nation", primaryEnv.userVerification)
+	theMux.HandleFunc("POST /account/password", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.changePassword)
+	})
+	theMux.HandleFunc("POST /account/password/reset", primaryEnv.resetPassword)
+	theMux.HandleFunc("GET /account/keys", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.listApiKeys)
+	})
+	theMux.HandleFunc("POST /account/keys", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.createApiKey)
+	})
+	theMux.HandleFunc("DELETE /account/keys/{keyId}", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.revokeApiKey)
+	})
+	theMux.HandleFunc("POST /account/2fa/enroll", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.enrollTotp)
+	})
+	theMux.HandleFunc("POST /account/2fa/confirm", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.confirmTotp)
+	})
+	theMux.HandleFunc("POST /account/2fa/disable", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.disableTotp)
+	})
+	theMux.HandleFunc("POST /account/2fa/threshold", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.setStepUpThreshold)
+	})
+	theMux.HandleFunc("POST /account/privacy", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.setPrivacy)
+	})
+	theMux.HandleFunc("GET /account/{name}/history", primaryEnv.getAccountHistory)
+	theMux.HandleFunc("GET /account/{name}/statement", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.accountStatement)
+	})
+	theMux.HandleFunc("GET /account/logins", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.recentLogins)
+	})
 	theMux.HandleFunc("POST /nation/permission", func(w http.ResponseWriter, r *http.Request) {
-		primaryEnv.securedWrapper(w, r, primaryEnv.updatePerm)
+		primaryEnv.sessionWrapper(w, r, primaryEnv.updatePerm)
 	})
 	theMux.HandleFunc("POST /cash/transaction", func(w http.ResponseWriter, r *http.Request) {
 		primaryEnv.securedWrapper(w, r, primaryEnv.outerCashHandler)
 	})
+	theMux.HandleFunc("GET /cash/transactions", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.getCashTransactions)
+	})
 	theMux.HandleFunc("GET /cash/details/{natName}", primaryEnv.nationCashDetails)
 	theMux.HandleFunc("GET /cash/quick/{natName}", primaryEnv.nationCashQuick)
 	theMux.HandleFunc("GET /loans", func(w http.ResponseWriter, r *http.Request) {
@@ -99,29 +181,77 @@ func main() {
 	theMux.HandleFunc("DELETE /loan/{loanId}", func(w http.ResponseWriter, r *http.Request) {
 		primaryEnv.securedWrapper(w, r, primaryEnv.writeOffLoan)
 	})
+	theMux.HandleFunc("GET /bonds", primaryEnv.listBonds)
+	theMux.HandleFunc("POST /bonds/issue", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.issueBonds)
+	})
+	theMux.HandleFunc("POST /bonds/buy", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.buyBonds)
+	})
 	theMux.HandleFunc("GET /nation/{natName}", primaryEnv.nationInfo)
 	theMux.HandleFunc("GET /region/{region}", func(w http.ResponseWriter, r *http.Request) {
 		primaryEnv.securedWrapper(w, r, primaryEnv.regionInfo)
 	})
+	theMux.HandleFunc("GET /region/{region}/roles", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.listRoles)
+	})
+	theMux.HandleFunc("POST /region/{region}/roles", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.upsertRole)
+	})
+	theMux.HandleFunc("DELETE /region/{region}/roles/{role}", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.deleteRole)
+	})
+	theMux.HandleFunc("POST /region/{region}/join", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.requestMembership("join"))
+	})
+	theMux.HandleFunc("POST /region/{region}/invite", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.requestMembership("invite"))
+	})
+	theMux.HandleFunc("GET /region/{region}/membership", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.regionMembershipRequests)
+	})
+	theMux.HandleFunc("POST /membership/{id}/{decision}", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.decideMembership)
+	})
+	theMux.HandleFunc("GET /membership", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.nationMembership)
+	})
+	theMux.HandleFunc("POST /membership/leave", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.leaveRegion)
+	})
+	theMux.HandleFunc("GET /region/{region}/governance", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.getRegionGovernance)
+	})
+	theMux.HandleFunc("POST /region/{region}/governance", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.updateRegionGovernance)
+	})
+	theMux.HandleFunc("POST /region/{region}/owner", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.transferOwnership)
+	})
+	theMux.HandleFunc("GET /region/{region}/actions", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.getRegionActions)
+	})
+	theMux.HandleFunc("POST /region/{region}/actions/{id}/{decision}", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.sessionWrapper(w, r, primaryEnv.decideRegionAction)
+	})
+	theMux.HandleFunc("GET /region/{region}/analytics", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.getRegionAnalytics)
+	})
+	theMux.HandleFunc("GET /region/{region}/residency", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.regionResidency)
+	})
+	theMux.HandleFunc("GET /admin/residency", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.openDiscrepancies)
+	})
 	theMux.HandleFunc("GET /list/nations", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
 		headEncoder := json.NewEncoder(w)
-		dbConn, err := primaryEnv.DBPool.Acquire(r.Context())
+		topNations, _, err := primaryEnv.queryLeaderboard(r.Context(), "net_worth", "", nil, 25, 0)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Leaderboard Err", err)
 			return
 		}
-		defer dbConn.Release()
-		dbRows, err := dbConn.Query(r.Context(), `SELECT account_name, cash_in_hand FROM accounts WHERE account_type = 'nation' LIMIT 25;`)
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		defer dbRows.Close()
 		type NatNet struct {
 			Name       string
 			CashInHand float32
@@ -130,24 +260,13 @@ func main() {
 		objToRet := struct {
 			Nations []NatNet
 		}{}
-		for dbRows.Next() {
-			var currNat NatNet
-			err = dbRows.Scan(&currNat.Name, &currNat.CashInHand)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			objToRet.Nations = append(objToRet.Nations, currNat)
-		}
-		for i := 0; i < len(objToRet.Nations); i++ {
-			objToRet.Nations[i].NetWorth, err = buildNetWorth(r.Context(), dbConn, objToRet.Nations[i].Name, objToRet.Nations[i].CashInHand)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		for _, theNation := range topNations {
+			objToRet.Nations = append(objToRet.Nations, NatNet{Name: theNation.Nation, CashInHand: float32(theNation.Cash), NetWorth: float32(theNation.NetWorth)})
 		}
 		headEncoder.Encode(objToRet)
 	})
+	theMux.HandleFunc("GET /leaderboard", primaryEnv.getLeaderboard)
+	theMux.HandleFunc("GET /leaderboard/{name}/history", primaryEnv.getRankHistory)
 	theMux.HandleFunc("GET /shares/quote/{ticker}", primaryEnv.marketQuote)
 	theMux.HandleFunc("POST /shares/transfer", func(w http.ResponseWriter, r *http.Request) {
 		primaryEnv.securedWrapper(w, r, primaryEnv.manualShareTransfer)
@@ -173,10 +292,38 @@ func main() {
 	theMux.HandleFunc("POST /shares/create", func(w http.ResponseWriter, r *http.Request) {
 		primaryEnv.securedWrapper(w, r, primaryEnv.manualCreateShares)
 	})
+	theMux.HandleFunc("POST /shares/issuance", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.requestIssuance)
+	})
+	theMux.HandleFunc("POST /shares/issuance/{id}/{decision}", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.decideIssuance)
+	})
+	theMux.HandleFunc("GET /shares/issuance/{ticker}", primaryEnv.getIssuanceHistory)
 	theMux.HandleFunc("DELETE /shares/trade/{id}", func(w http.ResponseWriter, r *http.Request) {
 		primaryEnv.securedWrapper(w, r, func(w http.ResponseWriter, r *http.Request) {
 			tradeId := r.PathValue("id")
-			err := primaryEnv.DBPool.QueryRow(r.Context(), `DELETE FROM open_orders WHERE trade_id = $1`, tradeId).Scan()
+			var trader string
+			err := primaryEnv.DBPool.QueryRow(r.Context(), `SELECT trader FROM open_orders WHERE trade_id = $1`, tradeId).Scan(&trader)
+			if err != nil {
+				if err == pgx.ErrNoRows {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println("Delete Trade Err", err)
+				return
+			}
+			_, err = primaryEnv.authorize(r.Context(), r.Header.Get("NationName"), trader, capTrade)
+			if err != nil {
+				if err == errUnauthorized {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println("Delete Trade Err", err)
+				return
+			}
+			err = primaryEnv.DBPool.QueryRow(r.Context(), `DELETE FROM open_orders WHERE trade_id = $1`, tradeId).Scan()
 			if err != nil && err != pgx.ErrNoRows {
 				w.WriteHeader(http.StatusInternalServerError)
 				log.Println("Delete Trade Err", err)
@@ -185,8 +332,69 @@ func main() {
 		})
 
 	})
+	theMux.HandleFunc("POST /shares/dividend", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.declareDividend)
+	})
+	theMux.HandleFunc("POST /shares/dividend/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.cancelDividend)
+	})
+	theMux.HandleFunc("POST /shares/split", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.declareSplit)
+	})
+	theMux.HandleFunc("GET /shares/actions/{ticker}", primaryEnv.getCorporateActions)
+	theMux.HandleFunc("POST /shares/proposals", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.openProposal)
+	})
+	theMux.HandleFunc("GET /shares/proposals/{ticker}", primaryEnv.getProposals)
+	theMux.HandleFunc("GET /shares/proposal/{id}", primaryEnv.getProposal)
+	theMux.HandleFunc("POST /shares/proposal/{id}/vote", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.castVote)
+	})
+	theMux.HandleFunc("POST /shares/proposal/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.cancelProposal)
+	})
+	theMux.HandleFunc("GET /ipo", primaryEnv.getIpos)
+	theMux.HandleFunc("POST /ipo/bid", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.placeIpoBid)
+	})
+	theMux.HandleFunc("DELETE /ipo/bid/{bidId}", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.securedWrapper(w, r, primaryEnv.cancelIpoBid)
+	})
+	theMux.HandleFunc("POST /admin/accounts/{name}/freeze", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminSetFrozen(true))
+	})
+	theMux.HandleFunc("POST /admin/accounts/{name}/unfreeze", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminSetFrozen(false))
+	})
+	theMux.HandleFunc("POST /admin/accounts/{name}/adjust", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminAdjustBalance)
+	})
+	theMux.HandleFunc("DELETE /admin/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminCancelOrder)
+	})
+	theMux.HandleFunc("POST /admin/tickers/{ticker}/halt", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminSetHalted(true))
+	})
+	theMux.HandleFunc("POST /admin/tickers/{ticker}/resume", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminSetHalted(false))
+	})
+	theMux.HandleFunc("POST /admin/realign", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminForceRealign)
+	})
+	theMux.HandleFunc("GET /admin/audit", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.getAdminAudit)
+	})
+	theMux.HandleFunc("POST /admin/admins", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminGrant)
+	})
+	theMux.HandleFunc("DELETE /admin/admins/{name}", func(w http.ResponseWriter, r *http.Request) {
+		primaryEnv.adminWrapper(w, r, primaryEnv.adminRevoke)
+	})
 	theMux.HandleFunc("GET /shares/quote", primaryEnv.getAllStocks)
 	theMux.HandleFunc("GET /shares/book/{ticker}", primaryEnv.returnAssetBook)
+	theMux.HandleFunc("GET /shares/holders/{ticker}", primaryEnv.getShareholderRegister)
+	theMux.HandleFunc("GET /indices", primaryEnv.getIndices)
+	theMux.HandleFunc("GET /indices/{id}/history", primaryEnv.getIndexHistory)
 	theMux.HandleFunc("GET /shares/portfolio", func(w http.ResponseWriter, r *http.Request) {
 		primaryEnv.securedWrapper(w, r, primaryEnv.accountPortfolio)
 	})
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Indices are chain-linked: each recalculation moves the level by the weighted price
+// change of the constituents chosen last time, then picks constituents and weights afresh
+// from current market caps. Listings, delistings and reweighting never move the level, and
+// splits rescale the stored constituent prices so they don't either.
+
+type indexConstituent struct {
+	Ticker string  `json:"ticker"`
+	Price  float64 `json:"price"`
+	Weight float64 `json:"weight"`
+}
+
+type marketIndex struct {
+	IndexId         string             `json:"indexId"`
+	Name            string             `json:"name"`
+	Weighting       string             `json:"weighting"`                 // cap or equal
+	MaxConstituents *int               `json:"maxConstituents,omitempty"` // The largest stocks by market cap, every listed stock if empty
+	BaseValue       float64            `json:"baseValue"`
+	Value           *float64           `json:"value"`
+	UpdatedAt       *time.Time         `json:"updatedAt,omitempty"`
+	Constituents    []indexConstituent `json:"constituents"`
+}
+
+type indexPoint struct {
+	Timecode         time.Time `json:"timecode"`
+	Value            float64   `json:"value"`
+	ConstituentCount int       `json:"constituentCount"`
+	TotalMarketCap   float64   `json:"totalMarketCap"`
+}
+
+// indexUpdateDelay is how long indexUpdater waits after a fill, so a burst of fills costs
+// one recalculation rather than one each
+const indexUpdateDelay = 10 * time.Second
+
+// requestIndexUpdate queues a recalculation without waiting on it. The channel holds one
+// request, so fills while one is already queued don't add another.
+func (Env env) requestIndexUpdate() {
+	select {
+	case Env.IndexUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// indexUpdater runs queued recalculations until ctx is done
+func (Env env) indexUpdater(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-Env.IndexUpdates:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(indexUpdateDelay):
+		}
+		// Fills during the delay are covered by this recalculation
+		select {
+		case <-Env.IndexUpdates:
+		default:
+		}
+		Env.updateIndices(ctx)
+	}
+}
+
+// updateIndices recalculates every index from current prices. It's run with logPrices and,
+// through indexUpdater, after trades that filled, so a failure here can't undo the trade.
+func (Env env) updateIndices(ctx context.Context) error {
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		log.Println("Index Err", err)
+		return err
+	}
+	defer dbTx.Rollback(ctx)
+	indexRows, err := dbTx.Query(ctx, `SELECT index_id, weighting::TEXT, max_constituents, base_value, current_value FROM market_indices ORDER BY index_id FOR UPDATE`)
+	if err != nil {
+		log.Println("Index Err", err)
+		return err
+	}
+	indices, err := pgx.CollectRows(indexRows, func(row pgx.CollectableRow) (marketIndex, error) {
+		var theIndex marketIndex
+		err := row.Scan(&theIndex.IndexId, &theIndex.Weighting, &theIndex.MaxConstituents, &theIndex.BaseValue, &theIndex.Value)
+		return theIndex, err
+	})
+	if err != nil {
+		log.Println("Index Err", err)
+		return err
+	}
+	type listedStock struct {
+		ticker           string
+		price, marketCap float64
+	}
+	stockRows, err := dbTx.Query(ctx, `SELECT ticker, share_price, market_cap FROM stocks WHERE trading_open AND share_price > 0 ORDER BY market_cap DESC, ticker`)
+	if err != nil {
+		log.Println("Index Err", err)
+		return err
+	}
+	listed, err := pgx.CollectRows(stockRows, func(row pgx.CollectableRow) (listedStock, error) {
+		var curStock listedStock
+		err := row.Scan(&curStock.ticker, &curStock.price, &curStock.marketCap)
+		return curStock, err
+	})
+	if err != nil {
+		log.Println("Index Err", err)
+		return err
+	}
+	prices := map[string]float64{}
+	for _, curStock := range listed {
+		prices[curStock.ticker] = curStock.price
+	}
+	now := time.Now().UTC()
+	for _, theIndex := range indices {
+		constituentRows, err := dbTx.Query(ctx, `SELECT ticker, price, weight FROM index_constituents WHERE index_id = $1`, theIndex.IndexId)
+		if err != nil {
+			log.Println("Index", theIndex.IndexId, "Err", err)
+			return err
+		}
+		previous, err := pgx.CollectRows(constituentRows, pgx.RowToStructByPos[indexConstituent])
+		if err != nil {
+			log.Println("Index", theIndex.IndexId, "Err", err)
+			return err
+		}
+		value := theIndex.BaseValue
+		if theIndex.Value != nil {
+			value = *theIndex.Value
+		}
+		// Constituents that have since been delisted drop out, the rest carry their weight
+		var relative, weightKept float64
+		for _, constituent := range previous {
+			price, ok := prices[constituent.Ticker]
+			if !ok || constituent.Price <= 0 {
+				continue
+			}
+			relative += constituent.Weight * price / constituent.Price
+			weightKept += constituent.Weight
+		}
+		if weightKept > 0 {
+			value *= relative / weightKept
+		}
+		chosen := listed
+		if theIndex.MaxConstituents != nil && len(chosen) > *theIndex.MaxConstituents {
+			chosen = chosen[:*theIndex.MaxConstituents]
+		}
+		var totalMarketCap float64
+		for _, curStock := range chosen {
+			totalMarketCap += curStock.marketCap
+		}
+		indexBatch := pgx.Batch{}
+		indexBatch.Queue(`DELETE FROM index_constituents WHERE index_id = $1`, theIndex.IndexId)
+		for _, curStock := range chosen {
+			weight := 1 / float64(len(chosen))
+			if theIndex.Weighting == "cap" {
+				if totalMarketCap <= 0 {
+					continue
+				}
+				weight = curStock.marketCap / totalMarketCap
+			}
+			indexBatch.Queue(`INSERT INTO index_constituents (index_id, ticker, price, weight) VALUES ($1, $2, $3, $4)`, theIndex.IndexId, curStock.ticker, curStock.price, weight)
+		}
+		indexBatch.Queue(`UPDATE market_indices SET current_value = $1, updated_at = $2 WHERE index_id = $3`, value, now, theIndex.IndexId)
+		indexBatch.Queue(`INSERT INTO index_values (index_id, timecode, index_value, constituent_count, total_market_cap) VALUES ($1, $2, $3, $4, $5)`, theIndex.IndexId, now, value, len(chosen), totalMarketCap)
+		err = dbTx.SendBatch(ctx, &indexBatch).Close()
+		if err != nil {
+			log.Println("Index", theIndex.IndexId, "Err", err)
+			return err
+		}
+	}
+	err = dbTx.Commit(ctx)
+	if err != nil {
+		log.Println("Index Err", err)
+		return err
+	}
+	return nil
+}
+
+func (Env env) getIndices(w http.ResponseWriter, r *http.Request) {
+	indexRows, err := Env.DBPool.Query(r.Context(), `SELECT index_id, index_name, weighting::TEXT, max_constituents, base_value, current_value, updated_at FROM market_indices ORDER BY index_id`)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Indices Err", err)
+		return
+	}
+	indices, err := pgx.CollectRows(indexRows, func(row pgx.CollectableRow) (marketIndex, error) {
+		theIndex := marketIndex{Constituents: []indexConstituent{}}
+		err := row.Scan(&theIndex.IndexId, &theIndex.Name, &theIndex.Weighting, &theIndex.MaxConstituents, &theIndex.BaseValue, &theIndex.Value, &theIndex.UpdatedAt)
+		return theIndex, err
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Indices Err", err)
+		return
+	}
+	constituentRows, err := Env.DBPool.Query(r.Context(), `SELECT index_id, ticker, price, weight FROM index_constituents ORDER BY index_id, weight DESC, ticker`)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Indices Err", err)
+		return
+	}
+	defer constituentRows.Close()
+	for constituentRows.Next() {
+		var indexId string
+		var constituent indexConstituent
+		err = constituentRows.Scan(&indexId, &constituent.Ticker, &constituent.Price, &constituent.Weight)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Indices scan Err", err)
+			return
+		}
+		for i := range indices {
+			if indices[i].IndexId == indexId {
+				indices[i].Constituents = append(indices[i].Constituents, constituent)
+			}
+		}
+	}
+	if constituentRows.Err() != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Indices Err", constituentRows.Err())
+		return
+	}
+	json.NewEncoder(w).Encode(indices)
+}
+
+// getIndexHistory takes from and to times, defaulting to the last 30 days
+func (Env env) getIndexHistory(w http.ResponseWriter, r *http.Request) {
+	indexId := r.PathValue("id")
+	params := r.URL.Query()
+	to := time.Now().UTC()
+	var err error
+	if params.Has("to") {
+		to, err = parseHistoryTime(params.Get("to"), true)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if params.Has("from") {
+		from, err = parseHistoryTime(params.Get("from"), false)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	var name string
+	err = Env.DBPool.QueryRow(r.Context(), `SELECT index_name FROM market_indices WHERE index_id = $1`, indexId).Scan(&name)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Index history Err", err)
+		return
+	}
+	pointRows, err := Env.DBPool.Query(r.Context(), `SELECT timecode, index_value, constituent_count, total_market_cap FROM index_values WHERE index_id = $1 AND timecode >= $2 AND timecode < $3 ORDER BY timecode`, indexId, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Index history Err", err)
+		return
+	}
+	defer pointRows.Close()
+	returnObj := struct {
+		IndexId string       `json:"indexId"`
+		Name    string       `json:"name"`
+		History []indexPoint `json:"history"`
+	}{
+		IndexId: indexId,
+		Name:    name,
+		History: []indexPoint{},
+	}
+	for pointRows.Next() {
+		var curPoint indexPoint
+		err = pointRows.Scan(&curPoint.Timecode, &curPoint.Value, &curPoint.ConstituentCount, &curPoint.TotalMarketCap)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Index history scan Err", err)
+			return
+		}
+		returnObj.History = append(returnObj.History, curPoint)
+	}
+	if pointRows.Err() != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Index history Err", pointRows.Err())
+		return
+	}
+	json.NewEncoder(w).Encode(returnObj)
+}
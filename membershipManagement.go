@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	errNotRegion          = errors.New("no such region")
+	errAlreadyMember      = errors.New("nation is already a member of the region")
+	errLastAdmin          = errors.New("the region's last admin can't leave")
+	errMembershipLoanOpen = errors.New("the membership loan must be repaid before leaving")
+	errCantRefinance      = errors.New("the new region can't afford to take over the membership loan")
+)
+
+type membershipRequestFormat struct {
+	RequestId   string     `json:"requestId"`
+	Region      string     `json:"region"`
+	NationName  string     `json:"nationName"`
+	Kind        string     `json:"kind"`
+	Status      string     `json:"status"`
+	RequestedBy string     `json:"requestedBy"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	DecidedBy   *string    `json:"decidedBy,omitempty"`
+	DecidedAt   *time.Time `json:"decidedAt,omitempty"`
+}
+
+type membershipPeriodFormat struct {
+	Region     string     `json:"region"`
+	JoinedAt   time.Time  `json:"joinedAt"`
+	LeftAt     *time.Time `json:"leftAt,omitempty"`
+	LeftReason *string    `json:"leftReason,omitempty"`
+}
+
+func membershipErrorStatus(err error) int {
+	switch err {
+	case errNotRegion:
+		return http.StatusNotFound
+	case errAlreadyMember, errLastAdmin, errMembershipLoanOpen, errCantRefinance, errRegionOwner, errTooFewAdmins:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func checkIsRegion(ctx context.Context, dbTx pgx.Tx, region string) error {
+	var accountType string
+	err := dbTx.QueryRow(ctx, `SELECT account_type FROM accounts WHERE account_name = $1`, region).Scan(&accountType)
+	if err == pgx.ErrNoRows || (err == nil && accountType != "region") {
+		return errNotRegion
+	}
+	return err
+}
+
+// startMembership adds nation to region as a citizen and opens its history entry
+func startMembership(ctx context.Context, dbTx pgx.Tx, nation string, region string) error {
+	err := dbTx.QueryRow(ctx, `INSERT INTO nation_permissions (region_name, nation_name, permission) VALUES ($1, $2, 'citizen')`, region, nation).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `INSERT INTO membership_history (region_name, nation_name, joined_at) VALUES ($1, $2, $3)`, region, nation, time.Now()).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// endMembership removes nation from its current region, if it has one, returning the
+// region it left. The membership loan is left for the caller to deal with.
+func endMembership(ctx context.Context, dbTx pgx.Tx, nation string, reason string) (string, error) {
+	var region, permission string
+	err := dbTx.QueryRow(ctx, `SELECT region_name, permission::TEXT FROM nation_permissions WHERE nation_name = $1 FOR UPDATE`, nation).Scan(&region, &permission)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	if permission == "admin" {
+		err = checkAdminRemoval(ctx, dbTx, region, nation)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = dbTx.QueryRow(ctx, `DELETE FROM nation_permissions WHERE region_name = $1 AND nation_name = $2`, region, nation).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return "", err
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE membership_history SET left_at = $1, left_reason = $2 WHERE region_name = $3 AND nation_name = $4 AND left_at IS NULL`, time.Now(), reason, region, nation).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return "", err
+	}
+	return region, nil
+}
+
+// moveMembership makes nation a citizen of newRegion, leaving its current region.
+// An outstanding membership loan moves with the nation, the new region paying the
+// old one off and taking over as lender.
+func (Env env) moveMembership(ctx context.Context, dbTx pgx.Tx, nation string, newRegion string) error {
+	err := checkIsRegion(ctx, dbTx, newRegion)
+	if err != nil {
+		return err
+	}
+	var alreadyMember bool
+	err = dbTx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM nation_permissions WHERE region_name = $1 AND nation_name = $2)`, newRegion, nation).Scan(&alreadyMember)
+	if err != nil {
+		return err
+	}
+	if alreadyMember {
+		return errAlreadyMember
+	}
+	oldRegion, err := endMembership(ctx, dbTx, nation, "moved to "+newRegion)
+	if err != nil {
+		return err
+	}
+	// Settles any open report of the nation having moved on NS before the server caught up
+	err = dbTx.QueryRow(ctx, `UPDATE residency_discrepancies SET resolved_at = $1 WHERE nation_name = $2 AND region_name = $3 AND kind = 'moved' AND resolved_at IS NULL`, time.Now().UTC(), nation, oldRegion).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	if oldRegion != "" {
+		var loanId string
+		var outstanding float32
+		err = dbTx.QueryRow(ctx, `SELECT loan_id, current_value FROM loans WHERE lendee = $1 AND lender = $2 AND membership_loan FOR UPDATE`, nation, oldRegion).Scan(&loanId, &outstanding)
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			var newRegionCash float32
+			err = dbTx.QueryRow(ctx, `SELECT cash_in_hand FROM accounts WHERE account_name = $1 FOR UPDATE`, newRegion).Scan(&newRegionCash)
+			if err != nil {
+				return err
+			}
+			if newRegionCash < outstanding {
+				return errCantRefinance
+			}
+			err = Env.handCashTransaction(&transactionFormat{Sender: newRegion, Receiver: oldRegion, Value: outstanding, Message: "Membership Loan Transfer - ID " + loanId, Kind: "loan", LoanId: loanId, LoanEvent: "transfer"}, ctx, dbTx)
+			if err != nil {
+				return err
+			}
+			err = dbTx.QueryRow(ctx, `UPDATE loans SET lender = $1 WHERE loan_id = $2`, newRegion, loanId).Scan()
+			if err != nil && err != pgx.ErrNoRows {
+				return err
+			}
+		}
+	}
+	return startMembership(ctx, dbTx, nation, newRegion)
+}
+
+// leaveRegion leaves the nation without a region, which needs the membership loan repaid first
+func (Env env) leaveRegion(w http.ResponseWriter, r *http.Request) {
+	nation := r.Header.Get("NationName")
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	region, err := endMembership(r.Context(), dbTx, nation, "left")
+	if err != nil {
+		w.WriteHeader(membershipErrorStatus(err))
+		log.Println("Leave Err", err)
+		return
+	}
+	if region == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var loanOpen bool
+	err = dbTx.QueryRow(r.Context(), `SELECT EXISTS(SELECT 1 FROM loans WHERE lendee = $1 AND lender = $2 AND membership_loan)`, nation, region).Scan(&loanOpen)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Leave loan Err", err)
+		return
+	}
+	if loanOpen {
+		w.WriteHeader(membershipErrorStatus(errMembershipLoanOpen))
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// requestMembership covers both a nation asking to join and a region inviting a nation
+func (Env env) requestMembership(kind string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		region := r.PathValue("region")
+		requester := r.Header.Get("NationName")
+		nation := requester
+		if kind == "invite" {
+			var received struct {
+				NationName string
+			}
+			err := json.NewDecoder(r.Body).Decode(&received)
+			if err != nil || received.NationName == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			nation = received.NationName
+			_, err = Env.authorize(r.Context(), requester, region, capManageMembers)
+			if err != nil {
+				if err == pgx.ErrNoRows || err == errUnauthorized {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println("Auth Err", err)
+				return
+			}
+		}
+		dbTx, err := Env.DBPool.Begin(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer dbTx.Rollback(r.Context())
+		err = checkIsRegion(r.Context(), dbTx, region)
+		if err != nil {
+			w.WriteHeader(membershipErrorStatus(err))
+			return
+		}
+		var nationType string
+		var alreadyMember bool
+		err = dbTx.QueryRow(r.Context(), `SELECT account_type, EXISTS(SELECT 1 FROM nation_permissions WHERE region_name = $1 AND nation_name = $2) FROM accounts WHERE account_name = $2`, region, nation).Scan(&nationType, &alreadyMember)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Membership request Err", err)
+			return
+		}
+		if nationType != "nation" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if alreadyMember {
+			w.WriteHeader(membershipErrorStatus(errAlreadyMember))
+			return
+		}
+		var requestId string
+		err = dbTx.QueryRow(r.Context(), `INSERT INTO membership_requests (region_name, nation_name, kind, requested_by, requested_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING RETURNING request_id`, region, nation, kind, requester, time.Now()).Scan(&requestId)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				// There's already a pending request between the two
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Membership request Err", err)
+			return
+		}
+		err = dbTx.Commit(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			RequestId string `json:"requestId"`
+		}{requestId})
+	}
+}
+
+// decideMembership approves, denies or cancels a pending request. Join requests are
+// decided by the region's member managers, invites by the invited nation, and either
+// can be cancelled by whoever sent it.
+func (Env env) decideMembership(w http.ResponseWriter, r *http.Request) {
+	requestId := r.PathValue("id")
+	decision := r.PathValue("decision")
+	actor := r.Header.Get("NationName")
+	newStatus := map[string]string{"approve": "approved", "deny": "denied", "cancel": "cancelled"}[decision]
+	if newStatus == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	var theRequest membershipRequestFormat
+	err = dbTx.QueryRow(r.Context(), `SELECT region_name, nation_name, kind::TEXT, requested_by FROM membership_requests WHERE request_id = $1 AND request_status = 'pending' FOR UPDATE`, requestId).Scan(&theRequest.Region, &theRequest.NationName, &theRequest.Kind, &theRequest.RequestedBy)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Membership decide Err", err)
+		return
+	}
+	if decision == "cancel" {
+		if actor != theRequest.RequestedBy {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	} else if theRequest.Kind == "invite" {
+		if actor != theRequest.NationName {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	} else {
+		_, err = Env.authorize(r.Context(), actor, theRequest.Region, capManageMembers)
+		if err != nil {
+			if err == pgx.ErrNoRows || err == errUnauthorized {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Auth Err", err)
+			return
+		}
+	}
+	if newStatus == "approved" {
+		err = Env.moveMembership(r.Context(), dbTx, theRequest.NationName, theRequest.Region)
+		if err != nil {
+			w.WriteHeader(membershipErrorStatus(err))
+			log.Println("Membership move Err", err)
+			return
+		}
+	}
+	err = dbTx.QueryRow(r.Context(), `UPDATE membership_requests SET request_status = $1, decided_by = $2, decided_at = $3 WHERE request_id = $4`, newStatus, actor, time.Now(), requestId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Membership decide Err", err)
+		return
+	}
+	if newStatus == "approved" {
+		// Anything else still pending for the nation is moot now it's moved
+		err = dbTx.QueryRow(r.Context(), `UPDATE membership_requests SET request_status = 'cancelled', decided_by = $1, decided_at = $2 WHERE nation_name = $3 AND request_status = 'pending'`, actor, time.Now(), theRequest.NationName).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Membership decide Err", err)
+			return
+		}
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func scanMembershipRequests(rows pgx.Rows) ([]membershipRequestFormat, error) {
+	defer rows.Close()
+	theRequests := []membershipRequestFormat{}
+	for rows.Next() {
+		var thisRequest membershipRequestFormat
+		err := rows.Scan(&thisRequest.RequestId, &thisRequest.Region, &thisRequest.NationName, &thisRequest.Kind, &thisRequest.Status, &thisRequest.RequestedBy, &thisRequest.RequestedAt, &thisRequest.DecidedBy, &thisRequest.DecidedAt)
+		if err != nil {
+			return nil, err
+		}
+		theRequests = append(theRequests, thisRequest)
+	}
+	return theRequests, rows.Err()
+}
+
+const membershipRequestColumns = `request_id, region_name, nation_name, kind::TEXT, request_status::TEXT, requested_by, requested_at, decided_by, decided_at`
+
+// nationMembership is the requesting nation's own requests, invites and past regions
+func (Env env) nationMembership(w http.ResponseWriter, r *http.Request) {
+	nation := r.Header.Get("NationName")
+	encoder := json.NewEncoder(w)
+	requestRows, err := Env.DBPool.Query(r.Context(), `SELECT `+membershipRequestColumns+` FROM membership_requests WHERE nation_name = $1 ORDER BY requested_at DESC LIMIT 50`, nation)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Membership Err", err)
+		return
+	}
+	theRequests, err := scanMembershipRequests(requestRows)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Membership scan Err", err)
+		return
+	}
+	historyRows, err := Env.DBPool.Query(r.Context(), `SELECT region_name, joined_at, left_at, left_reason FROM membership_history WHERE nation_name = $1 ORDER BY joined_at DESC`, nation)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Membership history Err", err)
+		return
+	}
+	defer historyRows.Close()
+	theHistory := []membershipPeriodFormat{}
+	for historyRows.Next() {
+		var thisPeriod membershipPeriodFormat
+		err = historyRows.Scan(&thisPeriod.Region, &thisPeriod.JoinedAt, &thisPeriod.LeftAt, &thisPeriod.LeftReason)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Membership history scan Err", err)
+			return
+		}
+		theHistory = append(theHistory, thisPeriod)
+	}
+	encoder.Encode(struct {
+		NationName string                    `json:"nationName"`
+		Requests   []membershipRequestFormat `json:"requests"`
+		History    []membershipPeriodFormat  `json:"history"`
+	}{
+		NationName: nation,
+		Requests:   theRequests,
+		History:    theHistory,
+	})
+}
+
+// regionMembershipRequests lists the region's pending join requests and invites
+func (Env env) regionMembershipRequests(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	encoder := json.NewEncoder(w)
+	_, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capManageMembers)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	requestRows, err := Env.DBPool.Query(r.Context(), `SELECT `+membershipRequestColumns+` FROM membership_requests WHERE region_name = $1 AND request_status = 'pending' ORDER BY requested_at`, region)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Membership Err", err)
+		return
+	}
+	theRequests, err := scanMembershipRequests(requestRows)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Membership scan Err", err)
+		return
+	}
+	encoder.Encode(theRequests)
+}
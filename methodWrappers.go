@@ -1,13 +1,70 @@
 package main
 
 import (
+	"context"
+	"log"
 	"net/http"
+
+	"github.com/jackc/pgx/v5"
 )
 
+// securedWrapper lets through either a user's AuthKey or one of their API keys. API key
+// requests act as the key's owner, limited to the key's scopes by authorize.
 func (Env env) securedWrapper(w http.ResponseWriter, r *http.Request, handle func(http.ResponseWriter, *http.Request)) {
-	if !authKeyVerification(r.Header.Get("AuthKey"), r.Header.Get("NationName"), Env.KeyString) {
+	if apiKey := r.Header.Get("ApiKey"); apiKey != "" {
+		keyGrant, err := Env.verifyApiKey(r.Context(), apiKey, Env.clientIP(r))
+		if err != nil {
+			if err != errUnauthorized {
+				log.Println("API key Err", err)
+			}
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		r.Header.Set("NationName", keyGrant.Owner)
+		handle(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, keyGrant)))
+		return
+	}
+	Env.sessionWrapper(w, r, handle)
+}
+
+// sessionWrapper only accepts a user's own AuthKey, for routes API keys must never reach
+func (Env env) sessionWrapper(w http.ResponseWriter, r *http.Request, handle func(http.ResponseWriter, *http.Request)) {
+	if !Env.checkAuthKey(r) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 	handle(w, r)
 }
+
+// checkAuthKey checks the request's AuthKey against the nation's current session version,
+// which password changes and resets move on to sign out every existing session
+func (Env env) checkAuthKey(r *http.Request) bool {
+	nation := r.Header.Get("NationName")
+	var sessionVersion int
+	err := Env.DBPool.QueryRow(r.Context(), `SELECT session_version FROM accounts WHERE account_name = $1 AND account_type = 'nation'`, nation).Scan(&sessionVersion)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Println("Session check Err", err)
+		}
+		return false
+	}
+	return authKeyVerification(r.Header.Get("AuthKey"), nation, Env.KeyString, sessionVersion)
+}
+
+// adminWrapper only lets platform admins through, on top of the usual AuthKey check
+func (Env env) adminWrapper(w http.ResponseWriter, r *http.Request, handle func(http.ResponseWriter, *http.Request)) {
+	Env.sessionWrapper(w, r, func(w http.ResponseWriter, r *http.Request) {
+		var isAdmin bool
+		err := Env.DBPool.QueryRow(r.Context(), `SELECT EXISTS(SELECT 1 FROM platform_admins WHERE nation_name = $1)`, r.Header.Get("NationName")).Scan(&isAdmin)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Admin check err", err)
+			return
+		}
+		if !isAdmin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handle(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+)
+
+// nsClient is everything the server asks of NationStates about nations. It's an
+// interface so tests and local runs can swap in a fake instead of calling NS.
+type nsClient interface {
+	// VerifyNation checks a verification code the nation got from nationstates.net/page=verify
+	VerifyNation(ctx context.Context, nation string, checksum string) (bool, error)
+	// NationRegion is the region the nation currently resides in
+	NationRegion(ctx context.Context, nation string) (string, error)
+	// RegionNations lists the slugs of every nation residing in the region
+	RegionNations(ctx context.Context, region string) ([]string, error)
+	// RegionOfficers is the slugs of the region's founder, delegate and regional officers
+	RegionOfficers(ctx context.Context, region string) ([]string, error)
+}
+
+var (
+	errNSUnavailable = errors.New("NationStates API request failed")
+	errNSNotFound    = errors.New("nation or region doesn't exist on NationStates")
+)
+
+const nsApiUrl = `https://www.nationstates.net/cgi-bin/api.cgi`
+
+type liveNSClient struct {
+	httpClient *http.Client
+	userAgent  string
+}
+
+func newLiveNSClient() *liveNSClient {
+	return &liveNSClient{
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		userAgent:  "NWConifer Finance Application, by Gallaton",
+	}
+}
+
+// nsSlug is how NS normalises nation and region names, so names can be compared
+func nsSlug(name string) string {
+	return strings.ToLower(slug.Substitute(strings.TrimSpace(name), map[string]string{
+		" ": "_",
+	}))
+}
+
+func (client *liveNSClient) get(ctx context.Context, query url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nsApiUrl+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", client.userAgent)
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Join(errNSUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNSNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Join(errNSUnavailable, errors.New(resp.Status))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (client *liveNSClient) VerifyNation(ctx context.Context, nation string, checksum string) (bool, error) {
+	if checksum == "" {
+		return false, nil
+	}
+	body, err := client.get(ctx, url.Values{
+		"a":        {"verify"},
+		"nation":   {nsSlug(nation)},
+		"checksum": {checksum},
+	})
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(body)) == "1", nil
+}
+
+func (client *liveNSClient) NationRegion(ctx context.Context, nation string) (string, error) {
+	body, err := client.get(ctx, url.Values{
+		"nation": {nsSlug(nation)},
+		"q":      {"region"},
+	})
+	if err != nil {
+		return "", err
+	}
+	var output struct {
+		Region string `xml:"REGION"`
+	}
+	err = xml.Unmarshal(body, &output)
+	return output.Region, err
+}
+
+func (client *liveNSClient) RegionNations(ctx context.Context, region string) ([]string, error) {
+	body, err := client.get(ctx, url.Values{
+		"region": {nsSlug(region)},
+		"q":      {"nations"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var output struct {
+		Nations string `xml:"NATIONS"`
+	}
+	err = xml.Unmarshal(body, &output)
+	if err != nil || output.Nations == "" {
+		return nil, err
+	}
+	return strings.Split(output.Nations, ":"), nil
+}
+
+func (client *liveNSClient) RegionOfficers(ctx context.Context, region string) ([]string, error) {
+	body, err := client.get(ctx, url.Values{
+		"region": {nsSlug(region)},
+		"q":      {"founder delegate officers"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var output struct {
+		Founder  string   `xml:"FOUNDER"`
+		Delegate string   `xml:"DELEGATE"`
+		Officers []string `xml:"OFFICERS>OFFICER>NATION"`
+	}
+	err = xml.Unmarshal(body, &output)
+	if err != nil {
+		return nil, err
+	}
+	var theOfficers []string
+	// NS uses 0 for a region with no founder or delegate
+	for _, officer := range append([]string{output.Founder, output.Delegate}, output.Officers...) {
+		if officer != "" && officer != "0" {
+			theOfficers = append(theOfficers, nsSlug(officer))
+		}
+	}
+	return theOfficers, nil
+}
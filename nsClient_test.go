@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+)
+
+// fakeNSClient answers from fixed maps keyed by nation or region slug
+type fakeNSClient struct {
+	checksums map[string]string   // nation slug -> the code it verifies with
+	regions   map[string]string   // nation slug -> region it resides in
+	officers  map[string][]string // region slug -> officer slugs
+	err       error               // returned by every call when set
+}
+
+func (fake fakeNSClient) VerifyNation(ctx context.Context, nation string, checksum string) (bool, error) {
+	if fake.err != nil {
+		return false, fake.err
+	}
+	code, ok := fake.checksums[nsSlug(nation)]
+	if !ok {
+		return false, errNSNotFound
+	}
+	return code == checksum, nil
+}
+
+func (fake fakeNSClient) NationRegion(ctx context.Context, nation string) (string, error) {
+	if fake.err != nil {
+		return "", fake.err
+	}
+	region, ok := fake.regions[nsSlug(nation)]
+	if !ok {
+		return "", errNSNotFound
+	}
+	return region, nil
+}
+
+func (fake fakeNSClient) RegionNations(ctx context.Context, region string) ([]string, error) {
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	nations := []string{}
+	for nation, home := range fake.regions {
+		if nsSlug(home) == nsSlug(region) {
+			nations = append(nations, nation)
+		}
+	}
+	return nations, nil
+}
+
+func (fake fakeNSClient) RegionOfficers(ctx context.Context, region string) ([]string, error) {
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	return fake.officers[nsSlug(region)], nil
+}
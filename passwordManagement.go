@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+var errWeakPassword = errors.New("password is too short")
+
+// setPassword hashes password at the current HashCost and stores it for nation. Every
+// existing session and API key stops working with the old password, so a change or reset
+// after a compromise takes the account back. Returns the new session version.
+func (Env env) setPassword(ctx context.Context, nation string, password string) (int, error) {
+	if len(password) < minPasswordLength {
+		return 0, errWeakPassword
+	}
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), Env.HashCost)
+	if err != nil {
+		return 0, err
+	}
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer dbTx.Rollback(ctx)
+	var sessionVersion int
+	err = dbTx.QueryRow(ctx, `UPDATE accounts SET account_pass_hash = $1, session_version = session_version + 1 WHERE account_name = $2 AND account_type = 'nation' RETURNING session_version`, string(newHash), nation).Scan(&sessionVersion)
+	if err != nil {
+		return 0, err
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE api_keys SET revoked_at = $1 WHERE account_name = $2 AND revoked_at IS NULL`, time.Now().UTC(), nation).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return 0, err
+	}
+	return sessionVersion, dbTx.Commit(ctx)
+}
+
+// rehashIfStale upgrades a hash made with an older, lower HashCost. Only called
+// once the password has been checked, as it's the only time we have it.
+func (Env env) rehashIfStale(ctx context.Context, nation string, storedHash string, password string) {
+	cost, err := bcrypt.Cost([]byte(storedHash))
+	if err != nil || cost >= Env.HashCost {
+		return
+	}
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), Env.HashCost)
+	if err != nil {
+		log.Println("Rehash Err", err)
+		return
+	}
+	// Only replace the hash we checked against, in case it's changed in the meantime
+	err = Env.DBPool.QueryRow(ctx, `UPDATE accounts SET account_pass_hash = $1 WHERE account_name = $2 AND account_pass_hash = $3`, string(newHash), nation, storedHash).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println("Rehash Err", err)
+	}
+}
+
+func passwordErrorStatus(err error) int {
+	switch err {
+	case errWeakPassword:
+		return http.StatusBadRequest
+	case pgx.ErrNoRows:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func (Env env) changePassword(w http.ResponseWriter, r *http.Request) {
+	nation := r.Header.Get("NationName")
+	var received struct {
+		OldPassword string
+		NewPassword string
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Wrong old passwords count towards the login lockout, so a stolen AuthKey can't guess at it
+	ip := Env.clientIP(r)
+	lockedUntil, err := Env.loginLockedUntil(r.Context(), nation, ip)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Lockout Err", err)
+		return
+	}
+	if !lockedUntil.IsZero() {
+		writeLockedOut(w, lockedUntil)
+		return
+	}
+	var storedHash string
+	err = Env.DBPool.QueryRow(r.Context(), `SELECT account_pass_hash FROM accounts WHERE account_name = $1 AND account_type = 'nation'`, nation).Scan(&storedHash)
+	if err != nil {
+		w.WriteHeader(passwordErrorStatus(err))
+		return
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(received.OldPassword))
+	if err != nil {
+		if recordErr := Env.recordLoginAttempt(r.Context(), nation, ip, false); recordErr != nil {
+			log.Println("Login attempt Err", recordErr)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	sessionVersion, err := Env.setPassword(r.Context(), nation, received.NewPassword)
+	if err != nil {
+		w.WriteHeader(passwordErrorStatus(err))
+		log.Println("Password change Err", err)
+		return
+	}
+	// The AuthKey this request came with no longer works, so hand over its replacement
+	json.NewEncoder(w).Encode(struct {
+		AuthKey string `json:"AuthKey"`
+	}{authKeyFor(nation, Env.KeyString, sessionVersion)})
+}
+
+// resetPassword proves ownership the same way signup does, with a fresh verification
+// code from nationstates.net/page=verify, so there's no old password needed
+func (Env env) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var received struct {
+		NationName  string
+		Checksum    string
+		NewPassword string
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil || received.NationName == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	verified, err := Env.NSClient.VerifyNation(r.Context(), received.NationName, received.Checksum)
+	if err != nil && err != errNSNotFound {
+		w.WriteHeader(http.StatusBadGateway)
+		log.Println("NS Verify Err", err)
+		return
+	}
+	if err == errNSNotFound || !verified {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	_, err = Env.setPassword(r.Context(), received.NationName, received.NewPassword)
+	if err != nil {
+		w.WriteHeader(passwordErrorStatus(err))
+		log.Println("Password reset Err", err)
+		return
+	}
+	// Having proven ownership, they shouldn't stay locked out by someone else's guesses
+	err = Env.DBPool.QueryRow(r.Context(), `DELETE FROM login_throttle WHERE throttle_key = $1 OR starts_with(throttle_key, $2)`, nationThrottleKey(received.NationName), pairThrottleKey(received.NationName, "")).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println("Lockout clear Err", err)
+	}
+	log.Println("Password reset for", received.NationName)
+	w.WriteHeader(http.StatusOK)
+}
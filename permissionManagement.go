@@ -13,46 +13,285 @@ func (Env env) updatePerm(w http.ResponseWriter, r *http.Request) {
 	requingNat := r.Header.Get("NationName")
 	decoder := json.NewDecoder(r.Body)
 	var received struct {
+		Region        string
 		NationName    string
 		NewPermission string
+		Role          string // A custom region role, empty to fall back on NewPermission alone
 	}
 	err := decoder.Decode(&received)
-	if err != nil || (received.NewPermission != "citizen" && received.NewPermission != "trader") {
+	if err != nil || (received.NewPermission != "citizen" && received.NewPermission != "trader" && received.NewPermission != "admin") {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	dbConn, err := Env.DBPool.Acquire(r.Context())
+	dbTx, err := Env.DBPool.Begin(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer dbConn.Release()
-	var requingPerm, region, recingRegion, existingPerms string
-	err = dbConn.QueryRow(r.Context(), `SELECT permission, region_name FROM nation_permissions WHERE nation_name = $1`, requingNat).Scan(&requingPerm, &region)
+	defer dbTx.Rollback(r.Context())
+	if received.Region == "" {
+		err = dbTx.QueryRow(r.Context(), `SELECT region_name FROM nation_permissions WHERE nation_name = $1 LIMIT 1`, requingNat).Scan(&received.Region)
+		if err != nil && err != pgx.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	grant, err := Env.authorize(r.Context(), requingNat, received.Region, capManageMembers)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	if received.NewPermission == "admin" && grant.Role != "admin" {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("Only admins can make admins")
+		return
+	}
+	var existingPerms string
+	var existingRole *string
+	err = dbTx.QueryRow(r.Context(), `SELECT permission, custom_role FROM nation_permissions WHERE nation_name = $1 AND region_name = $2 FOR UPDATE`, received.NationName, received.Region).Scan(&existingPerms, &existingRole)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println("Incorrect Region")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The only change anyone may make to their own row is an admin stepping down
+	if requingNat == received.NationName && (grant.Role != "admin" || received.NewPermission == "admin") {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("Can't change own permission")
+		return
+	}
+	if grant.Role != "admin" {
+		// Non-admin member managers can't hand out more than they hold. The built in perm
+		// is checked even under a custom role, as the member falls back to it if the role goes.
+		if !grant.covers(builtinRoleCapabilities[received.NewPermission], nil) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println("Can't grant more than own capabilities")
+			return
+		}
+		if received.Role != "" {
+			var newLimit *float64
+			var roleCaps []string
+			err = dbTx.QueryRow(r.Context(), `SELECT capabilities, spending_limit FROM region_roles WHERE region_name = $1 AND role_name = $2`, received.Region, received.Role).Scan(&roleCaps, &newLimit)
+			if err != nil {
+				if err == pgx.ErrNoRows {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println("Role lookup err", err)
+				return
+			}
+			var newCaps []capability
+			for _, thisCap := range roleCaps {
+				newCaps = append(newCaps, capability(thisCap))
+			}
+			if !grant.covers(newCaps, newLimit) {
+				w.WriteHeader(http.StatusForbidden)
+				log.Println("Can't grant more than own capabilities")
+				return
+			}
+		}
+	}
+	if existingPerms == "admin" && received.NewPermission != "admin" {
+		// Admins can step down themselves, otherwise only the owner can remove them
+		theGov, err := getGovernance(r.Context(), dbTx, received.Region)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Governance Err", err)
+			return
+		}
+		if requingNat != received.NationName && !theGov.canGovern(grant) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println("Only the owner can remove an admin")
+			return
+		}
+		err = checkAdminRemoval(r.Context(), dbTx, received.Region, received.NationName)
+		if err != nil {
+			w.WriteHeader(membershipErrorStatus(err))
+			log.Println("Admin removal Err", err)
+			return
+		}
+	}
+	var newRole *string
+	if received.Role != "" {
+		newRole = &received.Role
+	}
+	if existingPerms == received.NewPermission && ((existingRole == nil && newRole == nil) || (existingRole != nil && newRole != nil && *existingRole == *newRole)) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `UPDATE nation_permissions SET permission = $1, custom_role = $2 WHERE nation_name = $3 AND region_name = $4`, received.NewPermission, newRole, received.NationName, received.Region).Scan()
 	if err != nil && err != pgx.ErrNoRows {
+		// Most likely a custom role that doesn't exist in this region
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Perm update err", err)
+		return
+	}
+	if received.NewPermission == "admin" {
+		err = recordOwnerIfNone(r.Context(), dbTx, received.Region, received.NationName)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Owner Err", err)
+			return
+		}
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type roleFormat struct {
+	RoleName      string       `json:"roleName"`
+	Capabilities  []capability `json:"capabilities"`
+	SpendingLimit *float64     `json:"spendingLimit,omitempty"`
+	Builtin       bool         `json:"builtin"`
+}
+
+func (Env env) listRoles(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	encoder := json.NewEncoder(w)
+	_, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
 		return
 	}
-	if requingPerm != "admin" {
+	var theRoles []roleFormat
+	for _, builtin := range []string{"admin", "trader", "citizen"} {
+		theRoles = append(theRoles, roleFormat{RoleName: builtin, Capabilities: builtinRoleCapabilities[builtin], Builtin: true})
+	}
+	roleRows, err := Env.DBPool.Query(r.Context(), `SELECT role_name, capabilities, spending_limit FROM region_roles WHERE region_name = $1 ORDER BY role_name`, region)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("listRoles err", err)
+		return
+	}
+	defer roleRows.Close()
+	for roleRows.Next() {
+		var thisRole roleFormat
+		var theCaps []string
+		err = roleRows.Scan(&thisRole.RoleName, &theCaps, &thisRole.SpendingLimit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("listRoles scan err", err)
+			return
+		}
+		for _, thisCap := range theCaps {
+			thisRole.Capabilities = append(thisRole.Capabilities, capability(thisCap))
+		}
+		theRoles = append(theRoles, thisRole)
+	}
+	encoder.Encode(struct {
+		Region string       `json:"region"`
+		Roles  []roleFormat `json:"roles"`
+	}{
+		Region: region,
+		Roles:  theRoles,
+	})
+}
+
+func (Env env) upsertRole(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	decoder := json.NewDecoder(r.Body)
+	var theRole roleFormat
+	err := decoder.Decode(&theRole)
+	if err != nil || theRole.RoleName == "" || builtinRoleCapabilities[theRole.RoleName] != nil || theRole.RoleName == "owner" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	theCaps := []string{}
+	for _, thisCap := range theRole.Capabilities {
+		if !validCapability(string(thisCap)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		theCaps = append(theCaps, string(thisCap))
+	}
+	if theRole.SpendingLimit != nil && *theRole.SpendingLimit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capManageMembers)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	// Non-admin member managers can't hand out more than they hold
+	if grant.Role != "admin" && !grant.covers(theRole.Capabilities, theRole.SpendingLimit) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
-	err = dbConn.QueryRow(r.Context(), `SELECT region_name, permission FROM nation_permissions WHERE nation_name = $1`, received.NationName).Scan(&recingRegion, &existingPerms)
+	err = Env.DBPool.QueryRow(r.Context(), `INSERT INTO region_roles (region_name, role_name, capabilities, spending_limit) VALUES ($1, $2, $3, $4) ON CONFLICT (region_name, role_name) DO UPDATE SET capabilities = EXCLUDED.capabilities, spending_limit = EXCLUDED.spending_limit`, region, theRole.RoleName, theCaps, theRole.SpendingLimit).Scan()
 	if err != nil && err != pgx.ErrNoRows {
 		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("upsertRole err", err)
 		return
 	}
-	if region != recingRegion || existingPerms == "admin" {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (Env env) deleteRole(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	roleName := r.PathValue("role")
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capManageMembers)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	// Members holding the role fall back to their built in perm, which may be more than
+	// the role allowed, so only admins can take a role away
+	if grant.Role != "admin" {
 		w.WriteHeader(http.StatusForbidden)
-		log.Println("Incorrect Region or update an admin")
+		log.Println("Only admins can delete roles")
 		return
 	}
-	if existingPerms == received.NewPermission {
-		w.WriteHeader(http.StatusOK)
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	// Members holding the role fall back to their built in perm level
+	err = dbTx.QueryRow(r.Context(), `UPDATE nation_permissions SET custom_role = NULL WHERE region_name = $1 AND custom_role = $2`, region, roleName).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("deleteRole members err", err)
 		return
 	}
-	err = dbConn.QueryRow(r.Context(), `UPDATE nation_permissions SET permission = $1 WHERE nation_name = $2`, received.NewPermission, received.NationName).Scan()
+	err = dbTx.QueryRow(r.Context(), `DELETE FROM region_roles WHERE region_name = $1 AND role_name = $2`, region, roleName).Scan()
 	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("deleteRole err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
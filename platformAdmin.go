@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type auditEntry struct {
+	AuditId  int64           `json:"auditId"`
+	Timecode time.Time       `json:"timecode"`
+	Admin    string          `json:"admin"`
+	Action   string          `json:"action"`
+	Target   string          `json:"target"`
+	Reason   string          `json:"reason"`
+	Details  json.RawMessage `json:"details,omitempty"`
+}
+
+// recordAdminAction writes to the audit log inside the same transaction as the action,
+// so an action can never land without its entry
+func recordAdminAction(ctx context.Context, dbTx pgx.Tx, admin string, action string, target string, reason string, details any) error {
+	var detailBytes []byte
+	if details != nil {
+		var err error
+		detailBytes, err = json.Marshal(details)
+		if err != nil {
+			return err
+		}
+	}
+	err := dbTx.QueryRow(ctx, `INSERT INTO admin_audit_log (timecode, admin_name, admin_action, target, reason, details) VALUES ($1, $2, $3, $4, $5, $6)`, time.Now(), admin, action, target, reason, detailBytes).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// decodeAdminReason reads a body of at least {"Reason": ""} into into, rejecting empty reasons
+func decodeAdminReason(r *http.Request, into any, reason *string) bool {
+	err := json.NewDecoder(r.Body).Decode(into)
+	return err == nil && *reason != ""
+}
+
+// runAdminAction wraps action in a transaction alongside its audit entry, returning whether it committed
+func (Env env) runAdminAction(w http.ResponseWriter, r *http.Request, action string, target string, reason string, details any, do func(dbTx pgx.Tx) (int, error)) bool {
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	defer dbTx.Rollback(r.Context())
+	status, err := do(dbTx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Admin", action, "Err", err)
+		return false
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return false
+	}
+	err = recordAdminAction(r.Context(), dbTx, r.Header.Get("NationName"), action, target, reason, details)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Admin audit Err", err)
+		return false
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// Updates exactly one row, 404 if there wasn't one to update
+func singleRowUpdate(ctx context.Context, dbTx pgx.Tx, sql string, args ...any) (int, error) {
+	tag, err := dbTx.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() == 0 {
+		return http.StatusNotFound, nil
+	}
+	return http.StatusOK, nil
+}
+
+func (Env env) adminSetFrozen(frozen bool) func(http.ResponseWriter, *http.Request) {
+	action := "unfreeze"
+	if frozen {
+		action = "freeze"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		account := r.PathValue("name")
+		var received struct {
+			Reason string
+		}
+		if !decodeAdminReason(r, &received, &received.Reason) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		Env.runAdminAction(w, r, action, account, received.Reason, nil, func(dbTx pgx.Tx) (int, error) {
+			return singleRowUpdate(r.Context(), dbTx, `UPDATE accounts SET frozen = $1 WHERE account_name = $2`, frozen, account)
+		})
+	}
+}
+
+func (Env env) adminAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	account := r.PathValue("name")
+	var received struct {
+		Amount float64 // Signed, negative to take cash away
+		Reason string
+	}
+	if !decodeAdminReason(r, &received, &received.Reason) || received.Amount == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	Env.runAdminAction(w, r, "adjust_balance", account, received.Reason, map[string]float64{"amount": received.Amount}, func(dbTx pgx.Tx) (int, error) {
+		// Checked first, as the balance CHECK would otherwise fail the update outright
+		var balance float64
+		err := dbTx.QueryRow(r.Context(), `SELECT cash_in_hand FROM accounts WHERE account_name = $1 FOR UPDATE`, account).Scan(&balance)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return http.StatusNotFound, nil
+			}
+			return 0, err
+		}
+		if balance+received.Amount < 0 {
+			return http.StatusConflict, nil
+		}
+		return singleRowUpdate(r.Context(), dbTx, `UPDATE accounts SET cash_in_hand = cash_in_hand + $1 WHERE account_name = $2`, received.Amount, account)
+	})
+}
+
+func (Env env) adminCancelOrder(w http.ResponseWriter, r *http.Request) {
+	tradeId := r.PathValue("id")
+	var received struct {
+		Reason string
+	}
+	if !decodeAdminReason(r, &received, &received.Reason) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var cancelled struct {
+		Trader    string   `json:"trader"`
+		Ticker    string   `json:"ticker"`
+		Quantity  int      `json:"quantity"`
+		Direction string   `json:"direction"`
+		Price     *float64 `json:"price,omitempty"`
+	}
+	Env.runAdminAction(w, r, "cancel_order", tradeId, received.Reason, &cancelled, func(dbTx pgx.Tx) (int, error) {
+		err := dbTx.QueryRow(r.Context(), `DELETE FROM open_orders WHERE trade_id = $1 RETURNING trader, ticker, quant, order_direction::TEXT, order_price`, tradeId).Scan(&cancelled.Trader, &cancelled.Ticker, &cancelled.Quantity, &cancelled.Direction, &cancelled.Price)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return http.StatusNotFound, nil
+			}
+			return 0, err
+		}
+		return http.StatusOK, nil
+	})
+}
+
+func (Env env) adminSetHalted(halted bool) func(http.ResponseWriter, *http.Request) {
+	action := "resume_ticker"
+	if halted {
+		action = "halt_ticker"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ticker := r.PathValue("ticker")
+		var received struct {
+			Reason string
+		}
+		if !decodeAdminReason(r, &received, &received.Reason) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		Env.runAdminAction(w, r, action, ticker, received.Reason, nil, func(dbTx pgx.Tx) (int, error) {
+			return singleRowUpdate(r.Context(), dbTx, `UPDATE stocks SET halted = $1 WHERE ticker = $2`, halted, ticker)
+		})
+	}
+}
+
+func (Env env) adminForceRealign(w http.ResponseWriter, r *http.Request) {
+	var received struct {
+		Reason string
+	}
+	if !decodeAdminReason(r, &received, &received.Reason) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logged := Env.runAdminAction(w, r, "force_realign", "*", received.Reason, nil, func(dbTx pgx.Tx) (int, error) {
+		return http.StatusOK, nil
+	})
+	if logged {
+		// Realign talks to NS for a while, so run it outside the request
+		go Env.runRealign(context.Background())
+	}
+}
+
+func (Env env) adminGrant(w http.ResponseWriter, r *http.Request) {
+	var received struct {
+		NationName string
+		Reason     string
+	}
+	if !decodeAdminReason(r, &received, &received.Reason) || received.NationName == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	Env.runAdminAction(w, r, "grant_admin", received.NationName, received.Reason, nil, func(dbTx pgx.Tx) (int, error) {
+		var accountType string
+		err := dbTx.QueryRow(r.Context(), `SELECT account_type FROM accounts WHERE account_name = $1`, received.NationName).Scan(&accountType)
+		if err != nil {
+			if err == pgx.ErrNoRows {
+				return http.StatusNotFound, nil
+			}
+			return 0, err
+		}
+		if accountType != "nation" {
+			return http.StatusBadRequest, nil
+		}
+		tag, err := dbTx.Exec(r.Context(), `INSERT INTO platform_admins (nation_name, granted_at, granted_by) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, received.NationName, time.Now(), r.Header.Get("NationName"))
+		if err != nil {
+			return 0, err
+		}
+		if tag.RowsAffected() == 0 {
+			return http.StatusConflict, nil
+		}
+		return http.StatusOK, nil
+	})
+}
+
+func (Env env) adminRevoke(w http.ResponseWriter, r *http.Request) {
+	target := r.PathValue("name")
+	var received struct {
+		Reason string
+	}
+	if !decodeAdminReason(r, &received, &received.Reason) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	Env.runAdminAction(w, r, "revoke_admin", target, received.Reason, nil, func(dbTx pgx.Tx) (int, error) {
+		var remaining int
+		err := dbTx.QueryRow(r.Context(), `SELECT count(*) FROM platform_admins`).Scan(&remaining)
+		if err != nil {
+			return 0, err
+		}
+		if remaining <= 1 {
+			// Never leave the platform without an admin
+			return http.StatusConflict, nil
+		}
+		return singleRowUpdate(r.Context(), dbTx, `DELETE FROM platform_admins WHERE nation_name = $1`, target)
+	})
+}
+
+func (Env env) getAdminAudit(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	auditRows, err := Env.DBPool.Query(r.Context(), `SELECT audit_id, timecode, admin_name, admin_action, target, reason, details FROM admin_audit_log ORDER BY audit_id DESC LIMIT 100`)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Audit log err", err)
+		return
+	}
+	defer auditRows.Close()
+	theLog := []auditEntry{}
+	for auditRows.Next() {
+		var thisEntry auditEntry
+		var details []byte
+		err = auditRows.Scan(&thisEntry.AuditId, &thisEntry.Timecode, &thisEntry.Admin, &thisEntry.Action, &thisEntry.Target, &thisEntry.Reason, &details)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Audit log scan err", err)
+			return
+		}
+		thisEntry.Details = details
+		theLog = append(theLog, thisEntry)
+	}
+	encoder.Encode(theLog)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// optionalViewer identifies who's asking on the public endpoints, which don't need
+// auth but show more to those who send it. Returns an empty viewer for anonymous
+// requests, and a context carrying the API key if one was used.
+func (Env env) optionalViewer(r *http.Request) (string, context.Context) {
+	if apiKey := r.Header.Get("ApiKey"); apiKey != "" {
+		keyGrant, err := Env.verifyApiKey(r.Context(), apiKey, Env.clientIP(r))
+		if err != nil {
+			return "", r.Context()
+		}
+		return keyGrant.Owner, context.WithValue(r.Context(), apiKeyCtxKey{}, keyGrant)
+	}
+	if Env.checkAuthKey(r) {
+		return r.Header.Get("NationName"), r.Context()
+	}
+	return "", r.Context()
+}
+
+// canSeeDetails applies account's privacy setting to viewer. The account itself and
+// its officials always see everything: members of a region account, and for a
+// nation, those who manage its region's members.
+func (Env env) canSeeDetails(ctx context.Context, viewer string, account string) (bool, error) {
+	var privacy, accountType string
+	var accountRegion *string
+	err := Env.DBPool.QueryRow(ctx, `SELECT privacy::TEXT, account_type::TEXT, (SELECT region_name FROM nation_permissions WHERE nation_name = $1 LIMIT 1) FROM accounts WHERE account_name = $1`, account).Scan(&privacy, &accountType, &accountRegion)
+	if err != nil {
+		return false, err
+	}
+	if privacy == "public" || viewer == account {
+		return true, nil
+	}
+	if viewer == "" {
+		return false, nil
+	}
+	official := account
+	officialCap := capView
+	if accountType == "nation" {
+		if accountRegion == nil {
+			return false, nil
+		}
+		official = *accountRegion
+		officialCap = capManageMembers
+	}
+	_, err = Env.authorize(ctx, viewer, official, officialCap)
+	if err == nil {
+		return true, nil
+	}
+	if err != errUnauthorized {
+		return false, err
+	}
+	if privacy == "private" || accountRegion == nil {
+		return false, nil
+	}
+	var sameRegion bool
+	err = Env.DBPool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM nation_permissions WHERE nation_name = $1 AND region_name = $2)`, viewer, *accountRegion).Scan(&sameRegion)
+	return sameRegion, err
+}
+
+// checkDetailsVisible writes the failure response itself when viewer can't see account
+func (Env env) checkDetailsVisible(w http.ResponseWriter, r *http.Request, account string) bool {
+	viewer, ctx := Env.optionalViewer(r)
+	visible, err := Env.canSeeDetails(ctx, viewer, account)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Privacy Err", err)
+		return false
+	}
+	if !visible {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (Env env) setPrivacy(w http.ResponseWriter, r *http.Request) {
+	var received struct {
+		Account string // A region to set it for, empty for the requesting nation
+		Privacy string
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil || (received.Privacy != "public" && received.Privacy != "region" && received.Privacy != "private") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if received.Account == "" {
+		received.Account = r.Header.Get("NationName")
+	}
+	_, err = Env.authorize(r.Context(), r.Header.Get("NationName"), received.Account, capManageMembers)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	err = Env.DBPool.QueryRow(r.Context(), `UPDATE accounts SET privacy = $1 WHERE account_name = $2`, received.Privacy, received.Account).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Privacy update Err", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultAnalyticsDays = 30
+	maxAnalyticsDays     = 365
+)
+
+type shareholderSlice struct {
+	Account  string  `json:"account,omitempty"` // Left out for holders whose privacy hides them
+	Private  bool    `json:"private,omitempty"`
+	Quantity int     `json:"quantity"`
+	Percent  float64 `json:"percent"`
+}
+
+type tickerOwnership struct {
+	Ticker       string             `json:"ticker"`
+	TotalShares  int                `json:"totalShares"`
+	Shareholders []shareholderSlice `json:"shareholders"`
+}
+
+type tradingVolume struct {
+	Ticker     string  `json:"ticker"`
+	Period     string  `json:"period"`
+	Executions int     `json:"executions"`
+	Shares     int     `json:"shares"`
+	Value      float64 `json:"value"`
+}
+
+type cashFlowDay struct {
+	Date    time.Time `json:"date"`
+	Kind    string    `json:"kind"`
+	Inflow  float64   `json:"inflow"`
+	Outflow float64   `json:"outflow"`
+}
+
+type regionAnalytics struct {
+	Region              string            `json:"region"`
+	MemberCount         int               `json:"memberCount"`
+	MembersByPermission map[string]int    `json:"membersByPermission"`
+	MemberNetWorth      float64           `json:"memberNetWorth"`
+	LoansOutstanding    int               `json:"loansOutstanding"`
+	LoanPrincipal       float64           `json:"loanPrincipal"`
+	LoanBalance         float64           `json:"loanBalance"`
+	AccruedInterest     float64           `json:"accruedInterest"` // Interest the region's loans have ever accrued
+	Ownership           []tickerOwnership `json:"ownership"`
+	TradingVolume       []tradingVolume   `json:"tradingVolume"`
+	CashFlows           []cashFlowDay     `json:"cashFlows"`
+}
+
+func regionMembership(ctx context.Context, dbTx pgx.Tx, analytics *regionAnalytics) error {
+	permRows, err := dbTx.Query(ctx, `SELECT permission::TEXT, COUNT(*) FROM nation_permissions WHERE region_name = $1 GROUP BY permission`, analytics.Region)
+	if err != nil {
+		return err
+	}
+	for permRows.Next() {
+		var permission string
+		var count int
+		err = permRows.Scan(&permission, &count)
+		if err != nil {
+			permRows.Close()
+			return err
+		}
+		analytics.MembersByPermission[permission] = count
+		analytics.MemberCount += count
+	}
+	permRows.Close()
+	if permRows.Err() != nil {
+		return permRows.Err()
+	}
+	return dbTx.QueryRow(ctx, `SELECT COALESCE(SUM(net_worth), 0) FROM (`+accountValuesSQL+`) account_values JOIN nation_permissions ON nation_permissions.nation_name = account_values.account_name WHERE nation_permissions.region_name = $1`, analytics.Region).Scan(&analytics.MemberNetWorth)
+}
+
+func regionLending(ctx context.Context, dbTx pgx.Tx, analytics *regionAnalytics) error {
+	err := dbTx.QueryRow(ctx, `SELECT COUNT(*), COALESCE(SUM(lent_value), 0), COALESCE(SUM(current_value), 0) FROM loans WHERE lender = $1 AND current_value > 0`, analytics.Region).Scan(&analytics.LoansOutstanding, &analytics.LoanPrincipal, &analytics.LoanBalance)
+	if err != nil {
+		return err
+	}
+	return dbTx.QueryRow(ctx, `SELECT COALESCE(SUM(interest), 0) FROM loan_accruals WHERE lender = $1`, analytics.Region).Scan(&analytics.AccruedInterest)
+}
+
+// regionOwnership names holders the same way the shareholder register does
+func regionOwnership(ctx context.Context, dbTx pgx.Tx, analytics *regionAnalytics, visibility *registerVisibility) error {
+	holderRows, err := dbTx.Query(ctx, `SELECT stocks.ticker, stocks.total_share_volume, stock_holdings.account_name, accounts.privacy::TEXT, stock_holdings.share_quant FROM stocks JOIN stock_holdings ON stock_holdings.ticker = stocks.ticker JOIN accounts ON accounts.account_name = stock_holdings.account_name WHERE stocks.region = $1 AND stock_holdings.share_quant > 0 ORDER BY stocks.ticker, stock_holdings.share_quant DESC`, analytics.Region)
+	if err != nil {
+		return err
+	}
+	type heldBy struct {
+		ticker, holder, privacy string
+		totalShares, quantity   int
+	}
+	var holdings []heldBy
+	for holderRows.Next() {
+		var curHolding heldBy
+		err = holderRows.Scan(&curHolding.ticker, &curHolding.totalShares, &curHolding.holder, &curHolding.privacy, &curHolding.quantity)
+		if err != nil {
+			holderRows.Close()
+			return err
+		}
+		holdings = append(holdings, curHolding)
+	}
+	holderRows.Close()
+	if holderRows.Err() != nil {
+		return holderRows.Err()
+	}
+	for _, curHolding := range holdings {
+		seen, err := visibility.visible(curHolding.holder, curHolding.privacy)
+		if err != nil {
+			return err
+		}
+		if len(analytics.Ownership) == 0 || analytics.Ownership[len(analytics.Ownership)-1].Ticker != curHolding.ticker {
+			analytics.Ownership = append(analytics.Ownership, tickerOwnership{Ticker: curHolding.ticker, TotalShares: curHolding.totalShares, Shareholders: []shareholderSlice{}})
+		}
+		curTicker := &analytics.Ownership[len(analytics.Ownership)-1]
+		holding := shareholderSlice{Quantity: curHolding.quantity, Private: !seen}
+		if seen {
+			holding.Account = curHolding.holder
+		}
+		if curHolding.totalShares > 0 {
+			holding.Percent = float64(curHolding.quantity) / float64(curHolding.totalShares) * 100
+		}
+		curTicker.Shareholders = append(curTicker.Shareholders, holding)
+	}
+	return nil
+}
+
+func regionTradingVolume(ctx context.Context, dbTx pgx.Tx, analytics *regionAnalytics) error {
+	now := time.Now()
+	periods := []struct {
+		name  string
+		since time.Time
+	}{{"1d", now.AddDate(0, 0, -1)}, {"7d", now.AddDate(0, 0, -7)}, {"30d", now.AddDate(0, 0, -30)}}
+	for _, period := range periods {
+		volumeRows, err := dbTx.Query(ctx, `SELECT stocks.ticker, COUNT(execution_id), COALESCE(SUM(quantity), 0), COALESCE(SUM(quantity * price), 0) FROM stocks LEFT JOIN trade_executions ON trade_executions.ticker = stocks.ticker AND trade_executions.timecode >= $2 WHERE stocks.region = $1 GROUP BY stocks.ticker ORDER BY stocks.ticker`, analytics.Region, period.since)
+		if err != nil {
+			return err
+		}
+		for volumeRows.Next() {
+			volume := tradingVolume{Period: period.name}
+			err = volumeRows.Scan(&volume.Ticker, &volume.Executions, &volume.Shares, &volume.Value)
+			if err != nil {
+				volumeRows.Close()
+				return err
+			}
+			analytics.TradingVolume = append(analytics.TradingVolume, volume)
+		}
+		volumeRows.Close()
+		if volumeRows.Err() != nil {
+			return volumeRows.Err()
+		}
+	}
+	return nil
+}
+
+func regionCashFlows(ctx context.Context, dbTx pgx.Tx, analytics *regionAnalytics, since time.Time) error {
+	flowRows, err := dbTx.Query(ctx, `SELECT date_trunc('day', timecode), transaction_kind::TEXT, COALESCE(SUM(transaction_value) FILTER (WHERE receiver = $1), 0), COALESCE(SUM(transaction_value) FILTER (WHERE sender = $1 AND NOT minted), 0) FROM cash_transactions WHERE (sender = $1 OR receiver = $1) AND timecode >= $2 GROUP BY 1, 2 ORDER BY 1, 2`, analytics.Region, since)
+	if err != nil {
+		return err
+	}
+	defer flowRows.Close()
+	for flowRows.Next() {
+		var flow cashFlowDay
+		err = flowRows.Scan(&flow.Date, &flow.Kind, &flow.Inflow, &flow.Outflow)
+		if err != nil {
+			return err
+		}
+		analytics.CashFlows = append(analytics.CashFlows, flow)
+	}
+	return flowRows.Err()
+}
+
+// getRegionAnalytics takes days, how far back the cash flows go. Open to the same nations as regionInfo.
+func (Env env) getRegionAnalytics(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	days := defaultAnalyticsDays
+	if r.URL.Query().Has("days") {
+		days, err = strconv.Atoi(r.URL.Query().Get("days"))
+		if err != nil || days < 1 || days > maxAnalyticsDays {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	dbTx, err := Env.DBPool.BeginTx(r.Context(), pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	err = checkIsRegion(r.Context(), dbTx, region)
+	if err != nil {
+		if err == errNotRegion || err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region check Err", err)
+		return
+	}
+	analytics := regionAnalytics{
+		Region:              region,
+		MembersByPermission: map[string]int{},
+		Ownership:           []tickerOwnership{},
+		TradingVolume:       []tradingVolume{},
+		CashFlows:           []cashFlowDay{},
+	}
+	visibility := registerVisibility{Env: Env, ctx: r.Context(), viewer: r.Header.Get("NationName"), seesAll: grant.can(capCorporateActions), accounts: map[string]bool{}}
+	err = regionOwnership(r.Context(), dbTx, &analytics, &visibility)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region analytics Err", err)
+		return
+	}
+	for _, section := range []func(context.Context, pgx.Tx, *regionAnalytics) error{regionMembership, regionLending, regionTradingVolume} {
+		err = section(r.Context(), dbTx, &analytics)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Region analytics Err", err)
+			return
+		}
+	}
+	err = regionCashFlows(r.Context(), dbTx, &analytics, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region analytics Err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(analytics)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"slices"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/nwconifer-technical/nwc_trade_private"
@@ -14,8 +15,11 @@ func (Env env) registerRegion(w http.ResponseWriter, r *http.Request) {
 	log.Println("Region Signup Request")
 	decoder := json.NewDecoder(r.Body)
 	var newRegion struct {
-		RegionName   string
-		RegionTicker string
+		RegionName    string
+		RegionTicker  string
+		IpoShares     int    // Shares offered in the IPO, the region keeps the rest
+		IpoDays       int    // How long the subscription window stays open
+		IpoAllocation string // prorata or auction
 	}
 	var err error
 	err = decoder.Decode(&newRegion)
@@ -24,6 +28,32 @@ func (Env env) registerRegion(w http.ResponseWriter, r *http.Request) {
 		log.Println("JSON Err", err)
 		return
 	}
+	if newRegion.IpoShares == 0 {
+		newRegion.IpoShares = ipoDefaultOffered
+	}
+	if newRegion.IpoDays == 0 {
+		newRegion.IpoDays = ipoDefaultDays
+	}
+	if newRegion.IpoAllocation == "" {
+		newRegion.IpoAllocation = "prorata"
+	}
+	// Only the region's founder, delegate or officers on NS can bring it on
+	registrant := r.Header.Get("NationName")
+	officers, err := Env.NSClient.RegionOfficers(r.Context(), newRegion.RegionName)
+	if err != nil {
+		if err == errNSNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		log.Println("NS Officers Err", err)
+		return
+	}
+	if !slices.Contains(officers, nsSlug(registrant)) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("Not an officer of", newRegion.RegionName, registrant)
+		return
+	}
 	ourConn, err := Env.DBPool.Begin(r.Context())
 	defer ourConn.Rollback(r.Context())
 	if err != nil {
@@ -37,21 +67,46 @@ func (Env env) registerRegion(w http.ResponseWriter, r *http.Request) {
 		log.Print("DB Err 2", err)
 		return
 	}
+	// Whoever registers the region runs it until they hand it over. Nations belong to one
+	// region at a time, so the registrant moves over from their current one.
+	err = Env.moveMembership(r.Context(), ourConn, registrant, newRegion.RegionName)
+	if err != nil {
+		w.WriteHeader(membershipErrorStatus(err))
+		log.Println("Region admin Err", err)
+		return
+	}
+	err = ourConn.QueryRow(r.Context(), `UPDATE nation_permissions SET permission = 'admin' WHERE region_name = $1 AND nation_name = $2`, newRegion.RegionName, registrant).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region admin Err", err)
+		return
+	}
+	err = recordOwnerIfNone(r.Context(), ourConn, newRegion.RegionName, registrant)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region owner Err", err)
+		return
+	}
 	regionMarketCap, someVals, err := nwc_trade_private.BuildMarketCap(newRegion.RegionName)
 	if err != nil {
 		log.Println("Market Cap Err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	err = ourConn.QueryRow(r.Context(), `INSERT INTO stocks (ticker, region, market_cap, total_share_volume, share_price, share_stat1, share_stat2, share_stat3, share_stat4, share_stat5) VALUES ($1, $2, $3, 0, 0, $4, $5, $6, $7, $8);`, newRegion.RegionTicker, newRegion.RegionName, regionMarketCap, someVals[255], someVals[76], someVals[74], someVals[66], someVals[48]).Scan()
+	referencePrice := float64(regionMarketCap) / ipoTotalShares
+	err = ourConn.QueryRow(r.Context(), `INSERT INTO stocks (ticker, region, market_cap, total_share_volume, share_price, trading_open, share_stat1, share_stat2, share_stat3, share_stat4, share_stat5) VALUES ($1, $2, $3, 0, $4, FALSE, $5, $6, $7, $8, $9);`, newRegion.RegionTicker, newRegion.RegionName, regionMarketCap, referencePrice, someVals[255], someVals[76], someVals[74], someVals[66], someVals[48]).Scan()
 	if err != nil && err != pgx.ErrNoRows {
 		log.Println("DB Err 3", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	err = createShares(r.Context(), ourConn, newRegion.RegionName, 1000000)
-	if err != nil && err != pgx.ErrNoRows {
-		log.Println("Creation err", err)
+	err = openIpo(r.Context(), ourConn, newRegion.RegionTicker, referencePrice, newRegion.IpoShares, newRegion.IpoDays, newRegion.IpoAllocation)
+	if err != nil {
+		if err == errInvalidAction {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Println("IPO err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -91,7 +146,17 @@ func (Env env) regionInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer theConn.Release()
-	err = theConn.QueryRow(r.Context(), `SELECT account_name, cash_in_hand, cash_in_escrow FROM accounts, nation_permissions WHERE account_type = 'region' AND account_name = $1 AND (nation_permissions.region_name = accounts.account_name AND nation_permissions.nation_name = $2) LIMIT 1;`, regionToRet, requingNation).Scan(&returnObject.RegionName, &returnObject.HandValue, &returnObject.EscrowValue)
+	_, err = Env.authorize(r.Context(), requingNation, regionToRet, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	err = theConn.QueryRow(r.Context(), `SELECT account_name, cash_in_hand, cash_in_escrow FROM accounts WHERE account_type = 'region' AND account_name = $1;`, regionToRet).Scan(&returnObject.RegionName, &returnObject.HandValue, &returnObject.EscrowValue)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
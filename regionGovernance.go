@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	errRegionOwner   = errors.New("the region's owner must hand over ownership first")
+	errTooFewAdmins  = errors.New("the region would have fewer admins than it needs approvals from")
+	errActionDecided = errors.New("region action has already been decided")
+)
+
+type governanceFormat struct {
+	Region            string   `json:"region"`
+	Owner             *string  `json:"owner"`
+	RequiredApprovals int      `json:"requiredApprovals"`
+	MultisigThreshold float64  `json:"multisigThreshold"`
+	SyncOfficers      bool     `json:"syncOfficers"` // Residency sync makes the NS founder, delegate and officers the admins
+	Admins            []string `json:"admins"`
+}
+
+type regionActionFormat struct {
+	ActionId   string          `json:"actionId"`
+	Region     string          `json:"region"`
+	Kind       string          `json:"kind"` // cash_transfer, loan_issue, share_offering, share_buyback, dividend or bond_purchase
+	Payload    json.RawMessage `json:"payload"`
+	Value      float64         `json:"value"`
+	Status     string          `json:"status"`
+	ProposedBy string          `json:"proposedBy"`
+	ProposedAt time.Time       `json:"proposedAt"`
+	DecidedAt  *time.Time      `json:"decidedAt,omitempty"`
+	Approvals  []string        `json:"approvals"`
+}
+
+// getGovernance returns region's settings, or the single signature defaults if it's never set any
+func getGovernance(ctx context.Context, dbTx pgx.Tx, region string) (governanceFormat, error) {
+	theGov := governanceFormat{
+		Region:            region,
+		RequiredApprovals: 1,
+	}
+	err := dbTx.QueryRow(ctx, `SELECT region_owner, required_approvals, multisig_threshold, sync_officers FROM region_governance WHERE region_name = $1`, region).Scan(&theGov.Owner, &theGov.RequiredApprovals, &theGov.MultisigThreshold, &theGov.SyncOfficers)
+	if err != nil && err != pgx.ErrNoRows {
+		return theGov, err
+	}
+	adminRows, err := dbTx.Query(ctx, `SELECT nation_name FROM nation_permissions WHERE region_name = $1 AND permission = 'admin' ORDER BY nation_name`, region)
+	if err != nil {
+		return theGov, err
+	}
+	theGov.Admins, err = pgx.CollectRows(adminRows, pgx.RowTo[string])
+	return theGov, err
+}
+
+// canGovern is whether the actor may change the region's admins and settings, which
+// only its owner may
+func (theGov governanceFormat) canGovern(grant authGrant) bool {
+	return theGov.Owner != nil && *theGov.Owner == grant.Actor
+}
+
+// recordOwnerIfNone makes nation the owner of region if it has none yet. Called whenever
+// someone becomes an admin, so a region with admins always has an owner.
+func recordOwnerIfNone(ctx context.Context, dbTx pgx.Tx, region string, nation string) error {
+	err := dbTx.QueryRow(ctx, `INSERT INTO region_governance (region_name, region_owner) VALUES ($1, $2) ON CONFLICT (region_name) DO UPDATE SET region_owner = EXCLUDED.region_owner WHERE region_governance.region_owner IS NULL`, region, nation).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// checkAdminRemoval is called before nation stops being one of region's admins
+func checkAdminRemoval(ctx context.Context, dbTx pgx.Tx, region string, nation string) error {
+	theGov, err := getGovernance(ctx, dbTx, region)
+	if err != nil {
+		return err
+	}
+	if theGov.Owner != nil && *theGov.Owner == nation {
+		return errRegionOwner
+	}
+	if len(theGov.Admins)-1 < 1 {
+		return errLastAdmin
+	}
+	if len(theGov.Admins)-1 < theGov.RequiredApprovals {
+		return errTooFewAdmins
+	}
+	return nil
+}
+
+// proposeRegionAction holds back an action on a region account that its governance says
+// needs more than one admin to sign off, returning the pending action's id. It returns
+// an empty id if the action can go ahead straight away.
+func proposeRegionAction(ctx context.Context, dbTx pgx.Tx, region string, kind string, value float64, payload any, proposer string) (string, error) {
+	var requiredApprovals int
+	var threshold float64
+	err := dbTx.QueryRow(ctx, `SELECT required_approvals, multisig_threshold FROM region_governance WHERE region_name = $1`, region).Scan(&requiredApprovals, &threshold)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	if requiredApprovals <= 1 || value < threshold {
+		return "", nil
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	var actionId string
+	err = dbTx.QueryRow(ctx, `INSERT INTO region_actions (region_name, kind, payload, action_value, proposed_by, proposed_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING action_id`, region, kind, payloadBytes, value, proposer, time.Now().UTC()).Scan(&actionId)
+	if err != nil {
+		return "", err
+	}
+	// A proposing admin counts as the first signature
+	err = dbTx.QueryRow(ctx, `INSERT INTO region_action_approvals (action_id, admin_name, approved_at) SELECT $1, $2, $3 WHERE EXISTS(SELECT 1 FROM nation_permissions WHERE region_name = $4 AND nation_name = $2 AND permission = 'admin')`, actionId, proposer, time.Now().UTC(), region).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return "", err
+	}
+	return actionId, nil
+}
+
+func encodePendingAction(w http.ResponseWriter, actionId string) {
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		ActionId string `json:"actionId"`
+	}{
+		ActionId: actionId,
+	})
+}
+
+// executeRegionAction carries out an action once enough admins have approved it
+func (Env env) executeRegionAction(ctx context.Context, dbTx pgx.Tx, kind string, payload []byte, approver string) error {
+	switch kind {
+	case "cash_transfer":
+		var theTransaction transactionFormat
+		err := json.Unmarshal(payload, &theTransaction)
+		if err != nil {
+			return err
+		}
+		return Env.handCashTransaction(&theTransaction, ctx, dbTx)
+	case "loan_issue":
+		var theLoan loanFormat
+		err := json.Unmarshal(payload, &theLoan)
+		if err != nil {
+			return err
+		}
+		_, err = Env.loanIssue(ctx, &theLoan, dbTx)
+		return err
+	case "share_offering", "share_buyback":
+		var theIssuance issuanceFormat
+		err := json.Unmarshal(payload, &theIssuance)
+		if err != nil {
+			return err
+		}
+		var status string
+		err = dbTx.QueryRow(ctx, `SELECT issuance_status FROM share_issuances WHERE issuance_id = $1 FOR UPDATE`, theIssuance.IssuanceId).Scan(&status)
+		if err != nil {
+			return err
+		}
+		if status != "pending" {
+			return errActionDecided
+		}
+		return Env.executeIssuance(ctx, dbTx, theIssuance, approver)
+	case "dividend":
+		var theDividend dividendFormat
+		err := json.Unmarshal(payload, &theDividend)
+		if err != nil {
+			return err
+		}
+		_, err = recordDividend(ctx, dbTx, dropPassedDividendDates(theDividend, time.Now().UTC()))
+		return err
+	case "bond_purchase":
+		var thePurchase bondPurchase
+		err := json.Unmarshal(payload, &thePurchase)
+		if err != nil {
+			return err
+		}
+		return Env.settleBondPurchase(ctx, dbTx, thePurchase)
+	}
+	return errInvalidAction
+}
+
+func (Env env) authorizeRegionAdmin(r *http.Request, region string) (authGrant, int) {
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			return grant, http.StatusForbidden
+		}
+		log.Println("Auth Err", err)
+		return grant, http.StatusInternalServerError
+	}
+	if grant.Role != "admin" {
+		return grant, http.StatusForbidden
+	}
+	return grant, http.StatusOK
+}
+
+// decideRegionAction adds an admin's approval to a pending action, executing it once
+// enough have signed, or rejects it outright
+func (Env env) decideRegionAction(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	actionId := r.PathValue("id")
+	decision := r.PathValue("decision")
+	if decision != "approve" && decision != "reject" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	grant, status := Env.authorizeRegionAdmin(r, region)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	var kind, actionStatus string
+	var payload []byte
+	err = dbTx.QueryRow(r.Context(), `SELECT kind::TEXT, payload, action_status::TEXT FROM region_actions WHERE action_id = $1 AND region_name = $2 FOR UPDATE`, actionId, region).Scan(&kind, &payload, &actionStatus)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region action Err", err)
+		return
+	}
+	if actionStatus != "pending" {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	newStatus := "rejected"
+	if decision == "approve" {
+		err = dbTx.QueryRow(r.Context(), `INSERT INTO region_action_approvals (action_id, admin_name, approved_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, actionId, grant.Actor, time.Now().UTC()).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Region action approve Err", err)
+			return
+		}
+		theGov, err := getGovernance(r.Context(), dbTx, region)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Governance Err", err)
+			return
+		}
+		var approvals int
+		// Only approvals from nations who are still admins count
+		err = dbTx.QueryRow(r.Context(), `SELECT count(*) FROM region_action_approvals WHERE action_id = $1 AND admin_name = ANY($2)`, actionId, theGov.Admins).Scan(&approvals)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Region action count Err", err)
+			return
+		}
+		newStatus = "pending"
+		if approvals >= theGov.RequiredApprovals {
+			err = Env.executeRegionAction(r.Context(), dbTx, kind, payload, grant.Actor)
+			if err != nil {
+				if err == errIssuanceCap || err == errActionDecided {
+					w.WriteHeader(http.StatusConflict)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println("Region action execute Err", err)
+				return
+			}
+			newStatus = "executed"
+		}
+	}
+	if newStatus != "pending" {
+		err = dbTx.QueryRow(r.Context(), `UPDATE region_actions SET action_status = $1, decided_at = $2 WHERE action_id = $3`, newStatus, time.Now().UTC(), actionId).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Region action update Err", err)
+			return
+		}
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+	}{
+		Status: newStatus,
+	})
+}
+
+func (Env env) getRegionActions(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	encoder := json.NewEncoder(w)
+	_, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	actionRows, err := Env.DBPool.Query(r.Context(), `SELECT region_actions.action_id, kind::TEXT, payload, action_value, action_status::TEXT, proposed_by, proposed_at, decided_at, COALESCE(array_agg(admin_name) FILTER (WHERE admin_name IS NOT NULL), '{}') FROM region_actions LEFT JOIN region_action_approvals ON region_action_approvals.action_id = region_actions.action_id WHERE region_name = $1 GROUP BY region_actions.action_id ORDER BY proposed_at DESC LIMIT 50`, region)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Region actions Err", err)
+		return
+	}
+	defer actionRows.Close()
+	theActions := []regionActionFormat{}
+	for actionRows.Next() {
+		thisAction := regionActionFormat{Region: region}
+		var payload []byte
+		err = actionRows.Scan(&thisAction.ActionId, &thisAction.Kind, &payload, &thisAction.Value, &thisAction.Status, &thisAction.ProposedBy, &thisAction.ProposedAt, &thisAction.DecidedAt, &thisAction.Approvals)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Region actions scan Err", err)
+			return
+		}
+		thisAction.Payload = payload
+		theActions = append(theActions, thisAction)
+	}
+	encoder.Encode(theActions)
+}
+
+func (Env env) getRegionGovernance(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	_, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	theGov, err := getGovernance(r.Context(), dbTx, region)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Governance Err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(theGov)
+}
+
+// updateRegionGovernance sets how many admin signatures actions at or over the threshold
+// need, and whether admins follow the region's NS officers
+func (Env env) updateRegionGovernance(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	var received struct {
+		RequiredApprovals int
+		MultisigThreshold float64
+		SyncOfficers      bool
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil || received.RequiredApprovals < 1 || received.MultisigThreshold < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	grant, status := Env.authorizeRegionAdmin(r, region)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	theGov, err := getGovernance(r.Context(), dbTx, region)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Governance Err", err)
+		return
+	}
+	if !theGov.canGovern(grant) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if received.RequiredApprovals > len(theGov.Admins) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `INSERT INTO region_governance (region_name, required_approvals, multisig_threshold, sync_officers) VALUES ($1, $2, $3, $4) ON CONFLICT (region_name) DO UPDATE SET required_approvals = EXCLUDED.required_approvals, multisig_threshold = EXCLUDED.multisig_threshold, sync_officers = EXCLUDED.sync_officers`, region, received.RequiredApprovals, received.MultisigThreshold, received.SyncOfficers).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Governance update Err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// transferOwnership hands the region over to another of its admins
+func (Env env) transferOwnership(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	var received struct {
+		NationName string
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil || received.NationName == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	grant, status := Env.authorizeRegionAdmin(r, region)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	theGov, err := getGovernance(r.Context(), dbTx, region)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Governance Err", err)
+		return
+	}
+	if !theGov.canGovern(grant) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	isAdmin := false
+	for _, admin := range theGov.Admins {
+		isAdmin = isAdmin || admin == received.NationName
+	}
+	if !isAdmin {
+		// Make them an admin through updatePerm first
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `INSERT INTO region_governance (region_name, region_owner) VALUES ($1, $2) ON CONFLICT (region_name) DO UPDATE SET region_owner = EXCLUDED.region_owner`, region, received.NationName).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Ownership Err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type discrepancyFormat struct {
+	DiscrepancyId string     `json:"discrepancyId"`
+	DetectedAt    time.Time  `json:"detectedAt"`
+	NationName    string     `json:"nationName"`
+	Region        string     `json:"region"`
+	Kind          string     `json:"kind"` // moved, ceased_to_exist, became_officer or no_longer_officer
+	NSRegion      *string    `json:"nsRegion,omitempty"`
+	Resolution    string     `json:"resolution"` // migrated, awaiting_approval, flagged, promoted or demoted
+	ResolvedAt    *time.Time `json:"resolvedAt,omitempty"`
+}
+
+type regionMember struct {
+	NationName string
+	Permission string
+}
+
+// recordDiscrepancy logs what the sync found. Flagged discrepancies stay open, and
+// aren't repeated, until a later sync finds NS and the server agreeing again.
+func recordDiscrepancy(ctx context.Context, dbTx pgx.Tx, theDiscrepancy discrepancyFormat) error {
+	log.Println("Residency discrepancy", theDiscrepancy.Kind, theDiscrepancy.NationName, theDiscrepancy.Region, theDiscrepancy.Resolution)
+	err := dbTx.QueryRow(ctx, `INSERT INTO residency_discrepancies (detected_at, nation_name, region_name, kind, ns_region, resolution, resolved_at) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING`, time.Now().UTC(), theDiscrepancy.NationName, theDiscrepancy.Region, theDiscrepancy.Kind, theDiscrepancy.NSRegion, theDiscrepancy.Resolution, theDiscrepancy.ResolvedAt).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// inTx runs do in its own transaction, so one nation failing doesn't undo the rest of the sync
+func (Env env) inTx(ctx context.Context, do func(dbTx pgx.Tx) error) error {
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback(ctx)
+	err = do(dbTx)
+	if err != nil {
+		return err
+	}
+	return dbTx.Commit(ctx)
+}
+
+// syncResidency runs daily after runRealign, checking every region's members
+// still live there on NS
+func (Env env) syncResidency(ctx context.Context) {
+	regionRows, err := Env.DBPool.Query(ctx, `SELECT account_name FROM accounts WHERE account_type = 'region'`)
+	if err != nil {
+		log.Println("Residency sync Err", err)
+		return
+	}
+	regions, err := pgx.CollectRows(regionRows, pgx.RowTo[string])
+	if err != nil {
+		log.Println("Residency sync Err", err)
+		return
+	}
+	registeredRegions := map[string]string{}
+	for _, region := range regions {
+		registeredRegions[nsSlug(region)] = region
+	}
+	for _, region := range regions {
+		err = Env.syncRegionResidency(ctx, region, registeredRegions)
+		if err != nil {
+			log.Println("Residency sync Err", region, err)
+		}
+	}
+}
+
+func (Env env) syncRegionResidency(ctx context.Context, region string, registeredRegions map[string]string) error {
+	// NS allows 50 requests every 30 seconds
+	time.Sleep(time.Second)
+	residents, err := Env.NSClient.RegionNations(ctx, region)
+	if err != nil {
+		return err
+	}
+	residentSet := map[string]bool{}
+	for _, resident := range residents {
+		residentSet[nsSlug(resident)] = true
+	}
+	memberRows, err := Env.DBPool.Query(ctx, `SELECT nation_name, permission::TEXT FROM nation_permissions WHERE region_name = $1`, region)
+	if err != nil {
+		return err
+	}
+	members, err := pgx.CollectRows(memberRows, pgx.RowToStructByPos[regionMember])
+	if err != nil {
+		return err
+	}
+	var stillHere []regionMember
+	for _, member := range members {
+		if residentSet[nsSlug(member.NationName)] {
+			stillHere = append(stillHere, member)
+			err = Env.inTx(ctx, func(dbTx pgx.Tx) error {
+				err := dbTx.QueryRow(ctx, `UPDATE residency_discrepancies SET resolved_at = $1 WHERE nation_name = $2 AND region_name = $3 AND kind IN ('moved', 'ceased_to_exist') AND resolved_at IS NULL`, time.Now().UTC(), member.NationName, region).Scan()
+				if err != nil && err != pgx.ErrNoRows {
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		time.Sleep(time.Second)
+		nsRegion, err := Env.NSClient.NationRegion(ctx, member.NationName)
+		if err != nil && err != errNSNotFound {
+			return err
+		}
+		theDiscrepancy := discrepancyFormat{
+			NationName: member.NationName,
+			Region:     region,
+			Kind:       "moved",
+			Resolution: "flagged",
+		}
+		if err == errNSNotFound {
+			theDiscrepancy.Kind = "ceased_to_exist"
+		} else {
+			theDiscrepancy.NSRegion = &nsRegion
+		}
+		newRegion, registered := registeredRegions[nsSlug(nsRegion)]
+		if theDiscrepancy.Kind == "moved" && registered {
+			err = Env.inTx(ctx, func(dbTx pgx.Tx) error {
+				var loanOpen, alreadyReported bool
+				err := dbTx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM loans WHERE lendee = $1 AND lender = $2 AND membership_loan AND current_value > 0), EXISTS(SELECT 1 FROM residency_discrepancies WHERE nation_name = $1 AND region_name = $2 AND kind = 'moved' AND resolved_at IS NULL)`, member.NationName, region).Scan(&loanOpen, &alreadyReported)
+				if err != nil {
+					return err
+				}
+				if loanOpen {
+					if alreadyReported {
+						// The new region has had its request, a denial shouldn't be asked again every day
+						return nil
+					}
+					// Taking over the membership loan costs the new region, so it's theirs to approve
+					err = dbTx.QueryRow(ctx, `INSERT INTO membership_requests (region_name, nation_name, kind, requested_by, requested_at) VALUES ($1, $2, 'join', $2, $3) ON CONFLICT DO NOTHING`, newRegion, member.NationName, time.Now()).Scan()
+					if err != nil && err != pgx.ErrNoRows {
+						return err
+					}
+					theDiscrepancy.Resolution = "awaiting_approval"
+					return recordDiscrepancy(ctx, dbTx, theDiscrepancy)
+				}
+				err = Env.moveMembership(ctx, dbTx, member.NationName, newRegion)
+				if err != nil {
+					return err
+				}
+				now := time.Now().UTC()
+				theDiscrepancy.Resolution = "migrated"
+				theDiscrepancy.ResolvedAt = &now
+				return recordDiscrepancy(ctx, dbTx, theDiscrepancy)
+			})
+			if err == nil {
+				continue
+			}
+			// Couldn't migrate them, e.g. they're an admin the region can't spare
+			log.Println("Residency migrate Err", member.NationName, err)
+			theDiscrepancy.Resolution = "flagged"
+			theDiscrepancy.ResolvedAt = nil
+		}
+		err = Env.inTx(ctx, func(dbTx pgx.Tx) error {
+			return recordDiscrepancy(ctx, dbTx, theDiscrepancy)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var syncOfficers bool
+	err = Env.DBPool.QueryRow(ctx, `SELECT sync_officers FROM region_governance WHERE region_name = $1`, region).Scan(&syncOfficers)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	if !syncOfficers {
+		return nil
+	}
+	return Env.syncRegionOfficers(ctx, region, stillHere)
+}
+
+// syncRegionOfficers makes the region's NS founder, delegate and officers its admins,
+// and demotes admins who no longer hold any of those posts
+func (Env env) syncRegionOfficers(ctx context.Context, region string, members []regionMember) error {
+	time.Sleep(time.Second)
+	officers, err := Env.NSClient.RegionOfficers(ctx, region)
+	if err != nil {
+		return err
+	}
+	officerSet := map[string]bool{}
+	for _, officer := range officers {
+		officerSet[officer] = true
+	}
+	now := time.Now().UTC()
+	for _, member := range members {
+		isOfficer := officerSet[nsSlug(member.NationName)]
+		if isOfficer == (member.Permission == "admin") {
+			continue
+		}
+		theDiscrepancy := discrepancyFormat{
+			NationName: member.NationName,
+			Region:     region,
+			Kind:       "became_officer",
+			Resolution: "promoted",
+			ResolvedAt: &now,
+		}
+		newPermission := "admin"
+		if !isOfficer {
+			theDiscrepancy.Kind = "no_longer_officer"
+			theDiscrepancy.Resolution = "demoted"
+			newPermission = "citizen"
+		}
+		err = Env.inTx(ctx, func(dbTx pgx.Tx) error {
+			if !isOfficer {
+				err := checkAdminRemoval(ctx, dbTx, region, member.NationName)
+				if err != nil {
+					// Leave them be, but make sure someone sees it
+					theDiscrepancy.Resolution = "flagged"
+					theDiscrepancy.ResolvedAt = nil
+					return recordDiscrepancy(ctx, dbTx, theDiscrepancy)
+				}
+			}
+			err := dbTx.QueryRow(ctx, `UPDATE nation_permissions SET permission = $1, custom_role = NULL WHERE region_name = $2 AND nation_name = $3`, newPermission, region, member.NationName).Scan()
+			if err != nil && err != pgx.ErrNoRows {
+				return err
+			}
+			if isOfficer {
+				err = recordOwnerIfNone(ctx, dbTx, region, member.NationName)
+				if err != nil {
+					return err
+				}
+			}
+			return recordDiscrepancy(ctx, dbTx, theDiscrepancy)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanDiscrepancies(rows pgx.Rows) ([]discrepancyFormat, error) {
+	defer rows.Close()
+	theDiscrepancies := []discrepancyFormat{}
+	for rows.Next() {
+		var thisDiscrepancy discrepancyFormat
+		err := rows.Scan(&thisDiscrepancy.DiscrepancyId, &thisDiscrepancy.DetectedAt, &thisDiscrepancy.NationName, &thisDiscrepancy.Region, &thisDiscrepancy.Kind, &thisDiscrepancy.NSRegion, &thisDiscrepancy.Resolution, &thisDiscrepancy.ResolvedAt)
+		if err != nil {
+			return nil, err
+		}
+		theDiscrepancies = append(theDiscrepancies, thisDiscrepancy)
+	}
+	return theDiscrepancies, rows.Err()
+}
+
+const discrepancyColumns = `discrepancy_id, detected_at, nation_name, region_name, kind, ns_region, resolution, resolved_at`
+
+// regionResidency is a region's open discrepancies and the sync's recent changes to it
+func (Env env) regionResidency(w http.ResponseWriter, r *http.Request) {
+	region := r.PathValue("region")
+	_, err := Env.authorize(r.Context(), r.Header.Get("NationName"), region, capManageMembers)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	discrepancyRows, err := Env.DBPool.Query(r.Context(), `SELECT `+discrepancyColumns+` FROM residency_discrepancies WHERE region_name = $1 AND (resolved_at IS NULL OR detected_at >= $2) ORDER BY detected_at DESC`, region, time.Now().UTC().AddDate(0, 0, -30))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Residency Err", err)
+		return
+	}
+	theDiscrepancies, err := scanDiscrepancies(discrepancyRows)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Residency scan Err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(theDiscrepancies)
+}
+
+// openDiscrepancies is every flagged discrepancy across the platform, for platform admins
+func (Env env) openDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	discrepancyRows, err := Env.DBPool.Query(r.Context(), `SELECT `+discrepancyColumns+` FROM residency_discrepancies WHERE resolved_at IS NULL ORDER BY detected_at DESC`)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Residency Err", err)
+		return
+	}
+	theDiscrepancies, err := scanDiscrepancies(discrepancyRows)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Residency scan Err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(theDiscrepancies)
+}
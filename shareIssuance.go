@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Secondary offerings are capped at a percentage of the existing share volume
+// over a rolling period, and buybacks will pay at most a small premium over the
+// current quote.
+const (
+	offeringCapPercent    = 10
+	offeringCapPeriodDays = 30
+	buybackPriceTolerance = 1.05
+)
+
+var errIssuanceCap = errors.New("offering exceeds the issuance cap for this period")
+
+type issuanceFormat struct {
+	IssuanceId     string     `json:"issuanceId,omitempty"`
+	Ticker         string     `json:"ticker"`
+	Kind           string     `json:"kind"` // offering or buyback
+	Quantity       int        `json:"quantity"`
+	FilledQuantity int        `json:"filledQuantity"`
+	Price          *float64   `json:"price,omitempty"`
+	Status         string     `json:"status"`
+	RequestedBy    string     `json:"requestedBy"`
+	RequestedAt    time.Time  `json:"requestedAt"`
+	DecidedBy      *string    `json:"decidedBy,omitempty"`
+	DecidedAt      *time.Time `json:"decidedAt,omitempty"`
+}
+
+func recordIssuanceRequest(ctx context.Context, dbTx pgx.Tx, theIssuance issuanceFormat) (string, error) {
+	if theIssuance.Quantity < 1 || (theIssuance.Kind != "offering" && theIssuance.Kind != "buyback") {
+		return "", errInvalidAction
+	}
+	var theId string
+	err := dbTx.QueryRow(ctx, `INSERT INTO share_issuances (ticker, kind, quantity, requested_by, requested_at) VALUES ($1, $2, $3, $4, $5) RETURNING issuance_id`, theIssuance.Ticker, theIssuance.Kind, theIssuance.Quantity, theIssuance.RequestedBy, time.Now().UTC()).Scan(&theId)
+	return theId, err
+}
+
+func (Env env) requestIssuance(w http.ResponseWriter, r *http.Request) {
+	log.Println("Share Issuance Request")
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+	var theIssuance issuanceFormat
+	err := decoder.Decode(&theIssuance)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("JSON Err", err)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("requestIssuance tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	_, _, err = Env.authorizeTicker(r.Context(), dbTx, r.Header.Get("NationName"), theIssuance.Ticker, capMintShares)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("requestIssuance auth err", err)
+		return
+	}
+	theIssuance.RequestedBy = r.Header.Get("NationName")
+	theIssuance.IssuanceId, err = recordIssuanceRequest(r.Context(), dbTx, theIssuance)
+	if err != nil {
+		if err == errInvalidAction {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("requestIssuance insert err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("requestIssuance commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder.Encode(struct {
+		IssuanceId string `json:"issuanceId"`
+	}{
+		IssuanceId: theIssuance.IssuanceId,
+	})
+}
+
+// Region admins approve or reject pending issuances, approval executes it there and then
+func (Env env) decideIssuance(w http.ResponseWriter, r *http.Request) {
+	issuanceId := r.PathValue("id")
+	decision := r.PathValue("decision")
+	if decision != "approve" && decision != "reject" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("decideIssuance tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	theIssuance := issuanceFormat{IssuanceId: issuanceId}
+	err = dbTx.QueryRow(r.Context(), `SELECT ticker, kind, quantity, issuance_status, requested_by FROM share_issuances WHERE issuance_id = $1 FOR UPDATE`, issuanceId).Scan(&theIssuance.Ticker, &theIssuance.Kind, &theIssuance.Quantity, &theIssuance.Status, &theIssuance.RequestedBy)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("decideIssuance get err", err)
+		return
+	}
+	if theIssuance.Status != "pending" {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	region, _, err := Env.authorizeTicker(r.Context(), dbTx, r.Header.Get("NationName"), theIssuance.Ticker, capCorporateActions)
+	if err != nil {
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("decideIssuance perm err", err)
+		return
+	}
+	if decision == "approve" && theIssuance.RequestedBy == r.Header.Get("NationName") {
+		// A second pair of eyes is needed, unless there's nobody else to ask
+		theGov, err := getGovernance(r.Context(), dbTx, region)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("decideIssuance governance err", err)
+			return
+		}
+		if len(theGov.Admins) != 1 || theGov.Admins[0] != theIssuance.RequestedBy {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	var alreadyProposed bool
+	err = dbTx.QueryRow(r.Context(), `SELECT EXISTS(SELECT 1 FROM region_actions WHERE kind IN ('share_offering', 'share_buyback') AND action_status = 'pending' AND payload->>'issuanceId' = $1)`, issuanceId).Scan(&alreadyProposed)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("decideIssuance action err", err)
+		return
+	}
+	if alreadyProposed {
+		// Waiting on the region's admins to sign off
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if decision == "approve" {
+		actionId, err := proposeIssuance(r.Context(), dbTx, region, theIssuance, r.Header.Get("NationName"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("decideIssuance action err", err)
+			return
+		}
+		if actionId != "" {
+			err = dbTx.Commit(r.Context())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			encodePendingAction(w, actionId)
+			return
+		}
+	}
+	if decision == "reject" {
+		err = dbTx.QueryRow(r.Context(), `UPDATE share_issuances SET issuance_status = 'rejected', decided_by = $1, decided_at = $2 WHERE issuance_id = $3`, r.Header.Get("NationName"), time.Now().UTC(), issuanceId).Scan()
+	} else {
+		err = Env.executeIssuance(r.Context(), dbTx, theIssuance, r.Header.Get("NationName"))
+	}
+	if err != nil && err != pgx.ErrNoRows {
+		if err == errIssuanceCap {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("decideIssuance err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("decideIssuance commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// proposeIssuance holds an issuance back for the region's admins to sign off, valued at
+// what an offering raises or the most a buyback could spend
+func proposeIssuance(ctx context.Context, dbTx pgx.Tx, region string, theIssuance issuanceFormat, proposer string) (string, error) {
+	var price float64
+	err := dbTx.QueryRow(ctx, `SELECT share_price FROM stocks WHERE ticker = $1`, theIssuance.Ticker).Scan(&price)
+	if err != nil {
+		return "", err
+	}
+	if theIssuance.Kind == "buyback" {
+		return proposeRegionAction(ctx, dbTx, region, "share_buyback", price*buybackPriceTolerance*float64(theIssuance.Quantity), theIssuance, proposer)
+	}
+	return proposeRegionAction(ctx, dbTx, region, "share_offering", price*float64(theIssuance.Quantity), theIssuance, proposer)
+}
+
+func (Env env) executeIssuance(ctx context.Context, dbTx pgx.Tx, theIssuance issuanceFormat, decidedBy string) error {
+	var region string
+	var currentQuote Quote
+	err := dbTx.QueryRow(ctx, `SELECT region, share_price, total_share_volume, market_cap FROM stocks WHERE ticker = $1 FOR UPDATE`, theIssuance.Ticker).Scan(&region, &currentQuote.MarketPrice, &currentQuote.TotalVolume, &currentQuote.MarketCapitalisation)
+	if err != nil {
+		return err
+	}
+	price := float64(currentQuote.MarketPrice)
+	var filled int
+	if theIssuance.Kind == "offering" {
+		var recentlyOffered int
+		err = dbTx.QueryRow(ctx, `SELECT COALESCE(SUM(filled_quantity), 0) FROM share_issuances WHERE ticker = $1 AND kind = 'offering' AND issuance_status = 'executed' AND decided_at >= $2`, theIssuance.Ticker, time.Now().UTC().AddDate(0, 0, -offeringCapPeriodDays)).Scan(&recentlyOffered)
+		if err != nil {
+			return err
+		}
+		if (recentlyOffered+theIssuance.Quantity)*100 > currentQuote.TotalVolume*offeringCapPercent {
+			return errIssuanceCap
+		}
+		err = offerShares(ctx, dbTx, theIssuance.Ticker, region, theIssuance.Quantity, price)
+		filled = theIssuance.Quantity
+	} else {
+		filled, err = Env.buybackShares(ctx, dbTx, theIssuance.Ticker, region, theIssuance.Quantity, price*buybackPriceTolerance)
+	}
+	if err != nil {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE share_issuances SET issuance_status = 'executed', filled_quantity = $1, price = $2, decided_by = $3, decided_at = $4 WHERE issuance_id = $5`, filled, price, decidedBy, time.Now().UTC(), theIssuance.IssuanceId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// Mints new shares into the region's holding at the current quote, growing the
+// market cap rather than diluting the price, and lists them on the book.
+func offerShares(ctx context.Context, dbTx pgx.Tx, ticker string, region string, quantity int, price float64) error {
+	err := dbTx.QueryRow(ctx, `INSERT INTO stock_holdings (ticker, account_name, share_quant, avg_price) VALUES ($1, $2, $3, 0) ON CONFLICT (ticker, account_name) DO UPDATE SET share_quant = stock_holdings.share_quant + EXCLUDED.share_quant, `+weightedAvgPrice, ticker, region, quantity).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	err = addShareLot(ctx, dbTx, ticker, region, quantity, 0)
+	if err != nil {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE stocks SET total_share_volume = total_share_volume + $1, market_cap = market_cap + $2 WHERE ticker = $3`, quantity, price*float64(quantity), ticker).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `INSERT INTO open_orders (ticker, trader, quant, order_direction, price_type, order_price) VALUES ($1, $2, $3, 'sell', 'limit', $4)`, ticker, region, quantity, price).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// Buys shares off the cheapest open sell orders up to the price limit, then retires
+// them. Returns how many were actually bought back.
+func (Env env) buybackShares(ctx context.Context, dbTx pgx.Tx, ticker string, region string, quantity int, priceLimit float64) (int, error) {
+	sellRows, err := dbTx.Query(ctx, `SELECT trade_id, trader, quant, order_price FROM open_orders WHERE ticker = $1 AND order_direction = 'sell' AND trader != $2 AND order_price <= $3 ORDER BY order_price ASC FOR UPDATE`, ticker, region, priceLimit)
+	if err != nil {
+		return 0, err
+	}
+	var sellOrders []tradeFormat
+	for sellRows.Next() {
+		var thisOrder tradeFormat
+		err = sellRows.Scan(&thisOrder.TradeId, &thisOrder.Sender, &thisOrder.Quantity, &thisOrder.Price)
+		if err != nil {
+			sellRows.Close()
+			return 0, err
+		}
+		sellOrders = append(sellOrders, thisOrder)
+	}
+	sellRows.Close()
+	if sellRows.Err() != nil {
+		return 0, sellRows.Err()
+	}
+	remaining := quantity
+	var spent float64
+	for _, thisOrder := range sellOrders {
+		if remaining == 0 {
+			break
+		}
+		fillQuant := int(math.Min(float64(remaining), float64(thisOrder.Quantity)))
+		err = Env.handCashTransaction(&transactionFormat{
+			Sender:   region,
+			Receiver: thisOrder.Sender,
+			Value:    thisOrder.Price * float32(fillQuant),
+			Message:  ticker + ` Buyback`,
+			Kind:     "buyback",
+		}, ctx, dbTx)
+		if err != nil {
+			return 0, err
+		}
+		err = transferShares(ctx, dbTx, shareTransfer{Ticker: ticker, Sender: thisOrder.Sender, Receiver: region, Quantity: fillQuant, AvgPrice: thisOrder.Price})
+		if err != nil {
+			return 0, err
+		}
+		if fillQuant == thisOrder.Quantity {
+			err = dbTx.QueryRow(ctx, `DELETE FROM open_orders WHERE trade_id = $1`, thisOrder.TradeId).Scan()
+		} else {
+			err = dbTx.QueryRow(ctx, `UPDATE open_orders SET quant = quant - $1 WHERE trade_id = $2`, fillQuant, thisOrder.TradeId).Scan()
+		}
+		if err != nil && err != pgx.ErrNoRows {
+			return 0, err
+		}
+		remaining -= fillQuant
+		spent += float64(thisOrder.Price) * float64(fillQuant)
+	}
+	filled := quantity - remaining
+	if filled == 0 {
+		return 0, nil
+	}
+	// Retired shares leave at cost, buying back isn't a gain or loss for the issuer
+	var regionAvgPrice float64
+	err = dbTx.QueryRow(ctx, `SELECT COALESCE(avg_price, 0) FROM stock_holdings WHERE ticker = $1 AND account_name = $2`, ticker, region).Scan(&regionAvgPrice)
+	if err != nil {
+		return 0, err
+	}
+	_, err = consumeShareLots(ctx, dbTx, ticker, region, filled, regionAvgPrice)
+	if err != nil {
+		return 0, err
+	}
+	retireBatch := pgx.Batch{}
+	retireBatch.Queue(`UPDATE stock_holdings SET share_quant = share_quant - $1 WHERE ticker = $2 AND account_name = $3`, filled, ticker, region)
+	retireBatch.Queue(`UPDATE stocks SET total_share_volume = total_share_volume - $1, market_cap = GREATEST(market_cap - $2, 0) WHERE ticker = $3`, filled, spent, ticker)
+	retireBatch.Queue(`UPDATE stocks SET share_price = market_cap / NULLIF(total_share_volume, 0) WHERE ticker = $1`, ticker)
+	err = dbTx.SendBatch(ctx, &retireBatch).Close()
+	return filled, err
+}
+
+func (Env env) getIssuanceHistory(w http.ResponseWriter, r *http.Request) {
+	ticker := r.PathValue("ticker")
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	var theIssuances []issuanceFormat
+	issuanceRows, err := Env.DBPool.Query(r.Context(), `SELECT issuance_id, kind, quantity, filled_quantity, price, issuance_status, requested_by, requested_at, decided_by, decided_at FROM share_issuances WHERE ticker = $1 ORDER BY requested_at DESC`, ticker)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("issuanceHistory err", err)
+		return
+	}
+	defer issuanceRows.Close()
+	for issuanceRows.Next() {
+		thisIssuance := issuanceFormat{Ticker: ticker}
+		err = issuanceRows.Scan(&thisIssuance.IssuanceId, &thisIssuance.Kind, &thisIssuance.Quantity, &thisIssuance.FilledQuantity, &thisIssuance.Price, &thisIssuance.Status, &thisIssuance.RequestedBy, &thisIssuance.RequestedAt, &thisIssuance.DecidedBy, &thisIssuance.DecidedAt)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("issuanceHistory scan err", err)
+			return
+		}
+		theIssuances = append(theIssuances, thisIssuance)
+	}
+	encoder.Encode(struct {
+		Ticker     string           `json:"ticker"`
+		Issuances  []issuanceFormat `json:"issuances"`
+		CapPercent int              `json:"capPercent"`
+		CapPeriod  string           `json:"capPeriod"`
+	}{
+		Ticker:     ticker,
+		Issuances:  theIssuances,
+		CapPercent: offeringCapPercent,
+		CapPeriod:  strconv.Itoa(offeringCapPeriodDays) + " days",
+	})
+}
@@ -47,31 +47,7 @@ func (Env env) logPrices(ctx context.Context) error {
 		return err
 	}
 
-	return nil
-}
-
-func createShares(ctx context.Context, dbTx pgx.Tx, region string, numberofShares int) error {
-	var ticker string
-	var market_cap float32
-	var existingVolume int
-	err := dbTx.QueryRow(ctx, `SELECT ticker, market_cap, total_share_volume FROM stocks WHERE region = $1`, region).Scan(&ticker, &market_cap, &existingVolume)
-	if err != nil && err != pgx.ErrNoRows {
-		return err
-	}
-	newVol := float32(existingVolume + numberofShares)
-	err = dbTx.QueryRow(ctx, `INSERT INTO stock_holdings (ticker, account_name, share_quant, avg_price) VALUES ($1, $2, $3, 0) ON CONFLICT (ticker, account_name) DO UPDATE SET share_quant = stock_holdings.share_quant + EXCLUDED.share_quant`, ticker, region, numberofShares).Scan()
-	if err != nil && err != pgx.ErrNoRows {
-		return err
-	}
-	err = dbTx.QueryRow(ctx, `UPDATE stocks SET total_share_volume = total_share_volume + $1, share_price = $2 WHERE ticker = $3`, numberofShares, market_cap/newVol, ticker).Scan()
-	if err != nil && err != pgx.ErrNoRows {
-		return err
-	}
-	err = dbTx.QueryRow(ctx, `UPDATE open_orders SET order_price = $1 WHERE ticker = $2 AND price_type = 'market';`, market_cap/newVol, ticker).Scan()
-	if err != nil && err != pgx.ErrNoRows {
-		return err
-	}
-	return nil
+	return Env.updateIndices(ctx)
 }
 
 type createSend struct {
@@ -79,8 +55,10 @@ type createSend struct {
 	Quantity int    `json:"quantity"`
 }
 
+// Share creation is now a secondary offering, queued for region admin approval
 func (Env env) manualCreateShares(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
 	acct := r.Header.Get("NationName")
 	var sendingData createSend
 	err := decoder.Decode(&sendingData)
@@ -95,23 +73,36 @@ func (Env env) manualCreateShares(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer dbConn.Rollback(r.Context())
-	var natPerm string
-	err = dbConn.QueryRow(r.Context(), `SELECT permission FROM accounts WHERE nation_name = $1 AND region_name = $2`, acct, sendingData.Region).Scan(&natPerm)
+	_, err = Env.authorize(r.Context(), acct, sendingData.Region, capMintShares)
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("AccType Query Err", err)
+		log.Println("Auth Err", err)
 		return
 	}
-	if natPerm == "citizen" {
-		w.WriteHeader(http.StatusForbidden)
+	theOffering := issuanceFormat{
+		Kind:        "offering",
+		Quantity:    sendingData.Quantity,
+		RequestedBy: acct,
+	}
+	err = dbConn.QueryRow(r.Context(), `SELECT ticker FROM stocks WHERE region = $1`, sendingData.Region).Scan(&theOffering.Ticker)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	err = createShares(r.Context(), dbConn, sendingData.Region, sendingData.Quantity)
+	theOffering.IssuanceId, err = recordIssuanceRequest(r.Context(), dbConn, theOffering)
 	if err != nil {
+		if err == errInvalidAction {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -120,8 +111,12 @@ func (Env env) manualCreateShares(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	return
+	w.WriteHeader(http.StatusAccepted)
+	encoder.Encode(struct {
+		IssuanceId string `json:"issuanceId"`
+	}{
+		IssuanceId: theOffering.IssuanceId,
+	})
 }
 
 type Quote struct {
@@ -160,7 +155,7 @@ type shareTransfer struct {
 	Sender   string  `json:"sender"`
 	Receiver string  `json:"receiver"`
 	Quantity int     `json:"quantity"`
-	AvgPrice float32 `json:"avgprice"`
+	AvgPrice float32 `json:"avgprice"` // The execution price for matched trades, ignored on manual transfers
 }
 
 func (Env env) manualShareTransfer(w http.ResponseWriter, r *http.Request) {
@@ -168,7 +163,7 @@ func (Env env) manualShareTransfer(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var sentThing shareTransfer
 	err := decoder.Decode(&sentThing)
-	if err != nil {
+	if err != nil || sentThing.Quantity < 1 {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Println("JSON Err", err)
 		return
@@ -180,40 +175,21 @@ func (Env env) manualShareTransfer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer dbTx.Rollback(r.Context())
-	var account_type string
-	err = dbTx.QueryRow(r.Context(), `SELECT account_type FROM accounts WHERE account_name = $1`, sentThing.Sender).Scan(&account_type)
+	_, err = Env.authorize(r.Context(), r.Header.Get("NationName"), sentThing.Sender, capTrade)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		log.Println("Auth Err 1", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if account_type == "region" {
-		var permission string
-		err = dbTx.QueryRow(r.Context(), `SELECT permission FROM nation_permissions WHERE region_name = $1 AND nation_name = $2`, sentThing.Sender, r.Header.Get("NationName")).Scan(&permission)
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			log.Println("Auth Err 2", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if permission != "trader" && permission != "admin" && r.Header.Get("NationName") != "Gallaton" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-	} else if account_type == "nation" {
-		if sentThing.Sender != r.Header.Get("NationName") {
+		if err == errUnauthorized {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		log.Println("Auth Err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	if err = transferShares(r.Context(), dbTx, sentThing); err != nil {
+	if err = giftShares(r.Context(), dbTx, sentThing); err != nil {
 		if err == pgx.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -230,7 +206,8 @@ func (Env env) manualShareTransfer(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func transferShares(ctx context.Context, dbTx pgx.Tx, transfer shareTransfer) error {
+// checkSenderHolding returns pgx.ErrNoRows if the sender doesn't hold enough to transfer
+func checkSenderHolding(ctx context.Context, dbTx pgx.Tx, transfer shareTransfer) error {
 	var currentSenderQuantity int
 	err := dbTx.QueryRow(ctx, `SELECT share_quant FROM stock_holdings WHERE ticker = $1 AND account_name = $2`, transfer.Ticker, transfer.Sender).Scan(&currentSenderQuantity)
 	log.Println(currentSenderQuantity)
@@ -242,13 +219,60 @@ func transferShares(ctx context.Context, dbTx pgx.Tx, transfer shareTransfer) er
 		log.Println("Unprocessable")
 		return pgx.ErrNoRows
 	}
-	err = dbTx.QueryRow(ctx,
-		// `INSERT INTO stock_holdings (ticker, account_name, share_quant, avg_price) VALUES ($1, $2, $3, $4) ON CONFLICT (ticker, account_name) DO UPDATE SET share_quant = stock_holdings.share_quant + EXCLUDED.share_quant, avg_price = stock_holdings.avg_price + ((EXCLUDED.avg_price - stock_holdings.avg_price) * (stock_holdings.share_quant / EXCLUDED.share_quant));`,
-		`INSERT INTO stock_holdings (ticker, account_name, share_quant, avg_price) VALUES ($1, $2, $3, $4) ON CONFLICT (ticker, account_name) DO UPDATE SET share_quant = stock_holdings.share_quant + EXCLUDED.share_quant;`,
+	return nil
+}
+
+// giftShares moves shares with no money changing hands. The receiver takes on the sender's
+// cost basis and the sender realises nothing, so transfers can't be used to book P&L.
+func giftShares(ctx context.Context, dbTx pgx.Tx, transfer shareTransfer) error {
+	err := checkSenderHolding(ctx, dbTx, transfer)
+	if err != nil {
+		return err
+	}
+	var senderAvgPrice float64
+	err = dbTx.QueryRow(ctx, `SELECT COALESCE(avg_price, 0) FROM stock_holdings WHERE ticker = $1 AND account_name = $2`, transfer.Ticker, transfer.Sender).Scan(&senderAvgPrice)
+	if err != nil {
+		return err
+	}
+	carriedCost, err := carryShareLots(ctx, dbTx, transfer.Ticker, transfer.Sender, transfer.Receiver, transfer.Quantity, senderAvgPrice)
+	if err != nil {
+		return err
+	}
+	var unitCost float64
+	if transfer.Quantity > 0 {
+		unitCost = carriedCost / float64(transfer.Quantity)
+	}
+	err = dbTx.QueryRow(ctx, `INSERT INTO stock_holdings (ticker, account_name, share_quant, avg_price) VALUES ($1, $2, $3, $4) ON CONFLICT (ticker, account_name) DO UPDATE SET share_quant = stock_holdings.share_quant + EXCLUDED.share_quant, `+weightedAvgPrice,
+		transfer.Ticker, transfer.Receiver, transfer.Quantity, unitCost).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE stock_holdings SET share_quant = stock_holdings.share_quant - $3 WHERE ticker = $1 AND account_name = $2;`, transfer.Ticker, transfer.Sender, transfer.Quantity).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// transferShares settles a matched trade at the execution price in transfer.AvgPrice
+func transferShares(ctx context.Context, dbTx pgx.Tx, transfer shareTransfer) error {
+	err := checkSenderHolding(ctx, dbTx, transfer)
+	if err != nil {
+		return err
+	}
+	err = disposeShares(ctx, dbTx, transfer.Ticker, transfer.Sender, transfer.Quantity, float64(transfer.AvgPrice))
+	if err != nil {
+		return err
+	}
+	err = dbTx.QueryRow(ctx, `INSERT INTO stock_holdings (ticker, account_name, share_quant, avg_price) VALUES ($1, $2, $3, $4) ON CONFLICT (ticker, account_name) DO UPDATE SET share_quant = stock_holdings.share_quant + EXCLUDED.share_quant, `+weightedAvgPrice,
 		transfer.Ticker, transfer.Receiver, transfer.Quantity, transfer.AvgPrice).Scan()
 	if err != nil && err != pgx.ErrNoRows {
 		return err
 	}
+	err = addShareLot(ctx, dbTx, transfer.Ticker, transfer.Receiver, transfer.Quantity, float64(transfer.AvgPrice))
+	if err != nil {
+		return err
+	}
 	err = dbTx.QueryRow(ctx, `UPDATE stock_holdings SET share_quant = stock_holdings.share_quant - $3 WHERE ticker = $1 AND account_name = $2;`, transfer.Ticker, transfer.Sender, transfer.Quantity).Scan()
 	if err != nil && err != pgx.ErrNoRows {
 		return err
@@ -328,14 +352,34 @@ func (Env env) returnAssetBook(w http.ResponseWriter, r *http.Request) {
 }
 
 type holdingFormat struct {
-	Ticker        string
-	ShareQuantity int
-	AvgPrice      float32
+	Ticker            string
+	ShareQuantity     int
+	AvgPrice          float32
+	MarketPrice       float64
+	MarketValue       float64
+	CostBasis         float64 // At the average price
+	FifoCostBasis     float64 // Of the oldest lots not yet sold
+	UnrealisedPnL     float64
+	UnrealisedPnLFifo float64
+	RealisedPnL       float64
+	RealisedPnLFifo   float64
+}
+
+type portfolioTotals struct {
+	MarketValue       float64
+	CostBasis         float64
+	FifoCostBasis     float64
+	UnrealisedPnL     float64
+	UnrealisedPnLFifo float64
+	RealisedPnL       float64
+	RealisedPnLFifo   float64
 }
 
 type portfolioFormat struct {
 	Account    string
 	Holdings   []holdingFormat
+	Totals     portfolioTotals
+	Bonds      []bondHoldingFormat
 	OpenOrders []tradeFormat
 }
 
@@ -360,17 +404,29 @@ func getAcctOpenOrders(ctx context.Context, dbConn *pgxpool.Conn, acct string) (
 
 func getHoldings(ctx context.Context, dbConn *pgxpool.Conn, acct string) ([]holdingFormat, error) {
 	var holdings []holdingFormat
-	holdingsReader, err := dbConn.Query(ctx, `SELECT ticker, share_quant, avg_price FROM stock_holdings WHERE account_name = $1`, acct)
+	holdingsReader, err := dbConn.Query(ctx, `SELECT stock_holdings.ticker, share_quant, COALESCE(avg_price, 0), COALESCE(share_price, 0), COALESCE(lots.lot_quant, 0), COALESCE(lots.lot_cost, 0), COALESCE(disposals.fifo_pnl, 0), COALESCE(disposals.avg_pnl, 0)
+		FROM stock_holdings JOIN stocks ON stocks.ticker = stock_holdings.ticker
+		LEFT JOIN (SELECT ticker, SUM(remaining) AS lot_quant, SUM(remaining * unit_cost) AS lot_cost FROM share_lots WHERE account_name = $1 AND remaining > 0 GROUP BY ticker) lots ON lots.ticker = stock_holdings.ticker
+		LEFT JOIN (SELECT ticker, SUM(proceeds - fifo_cost) AS fifo_pnl, SUM(proceeds - average_cost) AS avg_pnl FROM share_disposals WHERE account_name = $1 GROUP BY ticker) disposals ON disposals.ticker = stock_holdings.ticker
+		WHERE account_name = $1 ORDER BY stock_holdings.ticker`, acct)
 	if err != nil {
 		return nil, err
 	}
 	defer holdingsReader.Close()
 	for holdingsReader.Next() {
 		var currentHolding holdingFormat
-		err := holdingsReader.Scan(&currentHolding.Ticker, &currentHolding.ShareQuantity, &currentHolding.AvgPrice)
+		var lotQuantity int
+		var lotCost float64
+		err := holdingsReader.Scan(&currentHolding.Ticker, &currentHolding.ShareQuantity, &currentHolding.AvgPrice, &currentHolding.MarketPrice, &lotQuantity, &lotCost, &currentHolding.RealisedPnLFifo, &currentHolding.RealisedPnL)
 		if err != nil {
 			return nil, err
 		}
+		currentHolding.MarketValue = currentHolding.MarketPrice * float64(currentHolding.ShareQuantity)
+		currentHolding.CostBasis = float64(currentHolding.AvgPrice) * float64(currentHolding.ShareQuantity)
+		// Shares held from before lots were kept are costed at the average
+		currentHolding.FifoCostBasis = lotCost + float64(max(currentHolding.ShareQuantity-lotQuantity, 0))*float64(currentHolding.AvgPrice)
+		currentHolding.UnrealisedPnL = currentHolding.MarketValue - currentHolding.CostBasis
+		currentHolding.UnrealisedPnLFifo = currentHolding.MarketValue - currentHolding.FifoCostBasis
 		holdings = append(holdings, currentHolding)
 	}
 	return holdings, holdingsReader.Err()
@@ -389,31 +445,19 @@ func (Env env) accountPortfolio(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer dbConn.Release()
-	if acctName != r.Header.Get("NationName") {
-		var accType string
-		err := dbConn.QueryRow(r.Context(), `SELECT account_type FROM accounts WHERE account_name = $1`, acctName).Scan(&accType)
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("AccType Query Err", err)
+	_, err = Env.authorize(r.Context(), r.Header.Get("NationName"), acctName, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		if accType == "region" {
-			var accPerms string
-			err := dbConn.QueryRow(r.Context(), `SELECT permission FROM nation_permissions WHERE region_name = $1 AND nation_name = $2;`, acctName, r.Header.Get("NationName")).Scan(&accPerms)
-			if err != nil {
-				if err == pgx.ErrNoRows {
-					w.WriteHeader(http.StatusForbidden)
-					return
-				}
-				w.WriteHeader(http.StatusInternalServerError)
-				log.Println("Perms Check Query Err", err)
-				return
-			}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
 		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
 	}
 	theHoldings, err := getHoldings(r.Context(), dbConn, acctName)
 	if err != nil {
@@ -421,6 +465,12 @@ func (Env env) accountPortfolio(w http.ResponseWriter, r *http.Request) {
 		log.Println("getHoldings Err", err)
 		return
 	}
+	theBonds, err := getBondHoldings(r.Context(), dbConn, acctName)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("getBondHoldings Err", err)
+		return
+	}
 	acctOpens, err := getAcctOpenOrders(r.Context(), dbConn, acctName)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -430,8 +480,18 @@ func (Env env) accountPortfolio(w http.ResponseWriter, r *http.Request) {
 	returnObj := portfolioFormat{
 		Account:    acctName,
 		Holdings:   theHoldings,
+		Bonds:      theBonds,
 		OpenOrders: acctOpens,
 	}
+	for _, holding := range theHoldings {
+		returnObj.Totals.MarketValue += holding.MarketValue
+		returnObj.Totals.CostBasis += holding.CostBasis
+		returnObj.Totals.FifoCostBasis += holding.FifoCostBasis
+		returnObj.Totals.UnrealisedPnL += holding.UnrealisedPnL
+		returnObj.Totals.UnrealisedPnLFifo += holding.UnrealisedPnLFifo
+		returnObj.Totals.RealisedPnL += holding.RealisedPnL
+		returnObj.Totals.RealisedPnLFifo += holding.RealisedPnLFifo
+	}
 	err = theEncoder.Encode(returnObj)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
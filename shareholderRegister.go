@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const registerChangeCount = 100
+
+type registerHolder struct {
+	Account  string  `json:"account,omitempty"` // Left out for holders whose privacy hides them
+	Private  bool    `json:"private,omitempty"`
+	Quantity int     `json:"quantity"`
+	Percent  float64 `json:"percent"`
+}
+
+type registerChange struct {
+	Account     string    `json:"account,omitempty"`
+	Private     bool      `json:"private,omitempty"`
+	ChangedAt   time.Time `json:"changedAt"`
+	OldQuantity int       `json:"oldQuantity"`
+	NewQuantity int       `json:"newQuantity"`
+	OldPercent  float64   `json:"oldPercent"`
+	NewPercent  float64   `json:"newPercent"`
+}
+
+type registerConcentration struct {
+	TopHolderPercent float64 `json:"topHolderPercent"`
+	Top5Percent      float64 `json:"top5Percent"`
+	Top10Percent     float64 `json:"top10Percent"`
+	Herfindahl       float64 `json:"herfindahl"`       // Sum of squared percentages, 10000 for a single holder
+	FreeFloatPercent float64 `json:"freeFloatPercent"` // Held by anyone but the issuing region
+}
+
+// registerVisibility works out, and remembers, which holders viewer may see named
+type registerVisibility struct {
+	Env      env
+	ctx      context.Context
+	viewer   string
+	seesAll  bool
+	accounts map[string]bool
+}
+
+func (visibility *registerVisibility) visible(account string, privacy string) (bool, error) {
+	if visibility.seesAll || privacy == "public" || account == visibility.viewer {
+		return true, nil
+	}
+	if seen, ok := visibility.accounts[account]; ok {
+		return seen, nil
+	}
+	seen, err := visibility.Env.canSeeDetails(visibility.ctx, visibility.viewer, account)
+	if err != nil {
+		return false, err
+	}
+	visibility.accounts[account] = seen
+	return seen, nil
+}
+
+// getShareholderRegister lists who holds ticker. Holders are named according to their privacy
+// setting, except to those who can take corporate actions for the issuing region, who see everyone.
+func (Env env) getShareholderRegister(w http.ResponseWriter, r *http.Request) {
+	ticker := r.PathValue("ticker")
+	var region *string
+	var totalShares int
+	err := Env.DBPool.QueryRow(r.Context(), `SELECT region, total_share_volume FROM stocks WHERE ticker = $1`, ticker).Scan(&region, &totalShares)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Register Err", err)
+		return
+	}
+	viewer, viewerCtx := Env.optionalViewer(r)
+	visibility := registerVisibility{Env: Env, ctx: viewerCtx, viewer: viewer, accounts: map[string]bool{}}
+	if viewer != "" && region != nil {
+		_, err = Env.authorize(viewerCtx, viewer, *region, capCorporateActions)
+		if err != nil && err != errUnauthorized {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Auth Err", err)
+			return
+		}
+		visibility.seesAll = err == nil
+	}
+	holderRows, err := Env.DBPool.Query(r.Context(), `SELECT stock_holdings.account_name, accounts.privacy::TEXT, share_quant FROM stock_holdings JOIN accounts ON accounts.account_name = stock_holdings.account_name WHERE ticker = $1 AND share_quant > 0 ORDER BY share_quant DESC, stock_holdings.account_name`, ticker)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Register Err", err)
+		return
+	}
+	type heldBy struct {
+		account, privacy string
+		quantity         int
+	}
+	var holdings []heldBy
+	for holderRows.Next() {
+		var curHolding heldBy
+		err = holderRows.Scan(&curHolding.account, &curHolding.privacy, &curHolding.quantity)
+		if err != nil {
+			holderRows.Close()
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Register scan Err", err)
+			return
+		}
+		holdings = append(holdings, curHolding)
+	}
+	holderRows.Close()
+	if holderRows.Err() != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Register Err", holderRows.Err())
+		return
+	}
+	if totalShares <= 0 {
+		for _, holding := range holdings {
+			totalShares += holding.quantity
+		}
+	}
+	percentOf := func(quantity int) float64 {
+		if totalShares <= 0 {
+			return 0
+		}
+		return float64(quantity) / float64(totalShares) * 100
+	}
+	returnObj := struct {
+		Ticker        string                `json:"ticker"`
+		Region        *string               `json:"region"`
+		TotalShares   int                   `json:"totalShares"`
+		HolderCount   int                   `json:"holderCount"`
+		Concentration registerConcentration `json:"concentration"`
+		Holders       []registerHolder      `json:"holders"`
+		LargeChanges  []registerChange      `json:"largeChanges"`
+	}{
+		Ticker:       ticker,
+		Region:       region,
+		TotalShares:  totalShares,
+		HolderCount:  len(holdings),
+		Holders:      []registerHolder{},
+		LargeChanges: []registerChange{},
+	}
+	for i, holding := range holdings {
+		percent := percentOf(holding.quantity)
+		if i == 0 {
+			returnObj.Concentration.TopHolderPercent = percent
+		}
+		if i < 5 {
+			returnObj.Concentration.Top5Percent += percent
+		}
+		if i < 10 {
+			returnObj.Concentration.Top10Percent += percent
+		}
+		returnObj.Concentration.Herfindahl += percent * percent
+		if region == nil || holding.account != *region {
+			returnObj.Concentration.FreeFloatPercent += percent
+		}
+		seen, err := visibility.visible(holding.account, holding.privacy)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Privacy Err", err)
+			return
+		}
+		curHolder := registerHolder{Quantity: holding.quantity, Percent: percent, Private: !seen}
+		if seen {
+			curHolder.Account = holding.account
+		}
+		returnObj.Holders = append(returnObj.Holders, curHolder)
+	}
+	changeRows, err := Env.DBPool.Query(r.Context(), `SELECT holder_changes.account_name, accounts.privacy::TEXT, changed_at, old_quantity, new_quantity, total_shares FROM holder_changes JOIN accounts ON accounts.account_name = holder_changes.account_name WHERE ticker = $1 ORDER BY changed_at DESC, change_id DESC LIMIT $2`, ticker, registerChangeCount)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Register changes Err", err)
+		return
+	}
+	defer changeRows.Close()
+	for changeRows.Next() {
+		var curChange registerChange
+		var account, privacy string
+		var sharesThen int
+		err = changeRows.Scan(&account, &privacy, &curChange.ChangedAt, &curChange.OldQuantity, &curChange.NewQuantity, &sharesThen)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Register changes scan Err", err)
+			return
+		}
+		if sharesThen > 0 {
+			curChange.OldPercent = float64(curChange.OldQuantity) / float64(sharesThen) * 100
+			curChange.NewPercent = float64(curChange.NewQuantity) / float64(sharesThen) * 100
+		}
+		seen, err := visibility.visible(account, privacy)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Privacy Err", err)
+			return
+		}
+		curChange.Private = !seen
+		if seen {
+			curChange.Account = account
+		}
+		returnObj.LargeChanges = append(returnObj.LargeChanges, curChange)
+	}
+	if changeRows.Err() != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Register changes Err", changeRows.Err())
+		return
+	}
+	json.NewEncoder(w).Encode(returnObj)
+}
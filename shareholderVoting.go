@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultVotingDays       = 7
+	maxVotingDays           = 30
+	defaultQuorumPercent    = 25
+	defaultThresholdPercent = 50
+)
+
+// proposalPayload is the corporate action a proposal carries out if it passes
+type proposalPayload struct {
+	Dividend *dividendFormat `json:"dividend,omitempty"`
+	Quantity int             `json:"quantity,omitempty"` // For issuance and buyback proposals
+	Split    *splitFormat    `json:"split,omitempty"`
+}
+
+type proposalFormat struct {
+	ProposalId       string          `json:"proposalId"`
+	Ticker           string          `json:"ticker"`
+	Kind             string          `json:"kind"` // dividend, issuance, buyback, split or text
+	Title            string          `json:"title"`
+	Description      string          `json:"description"`
+	Payload          proposalPayload `json:"payload"`
+	ProposedBy       string          `json:"proposedBy"`
+	OpenedAt         time.Time       `json:"openedAt"`
+	ClosesAt         time.Time       `json:"closesAt"`
+	QuorumPercent    float64         `json:"quorumPercent"`    // Of eligible shares that must vote, abstentions included
+	ThresholdPercent float64         `json:"thresholdPercent"` // Of for and against votes that must be for, strictly more than
+	Status           string          `json:"status"`
+	EligibleShares   int             `json:"eligibleShares"`
+	VotesFor         int             `json:"votesFor"`
+	VotesAgainst     int             `json:"votesAgainst"`
+	VotesAbstain     int             `json:"votesAbstain"`
+	DecidedAt        *time.Time      `json:"decidedAt,omitempty"`
+	Outcome          *string         `json:"outcome,omitempty"`        // The corporate action a passed proposal produced
+	ExecutionError   *string         `json:"executionError,omitempty"` // Why a passed proposal's action couldn't be carried out
+}
+
+func (theProposal proposalFormat) passes() bool {
+	turnout := theProposal.VotesFor + theProposal.VotesAgainst + theProposal.VotesAbstain
+	if theProposal.EligibleShares <= 0 || float64(turnout)*100 < theProposal.QuorumPercent*float64(theProposal.EligibleShares) {
+		return false
+	}
+	return float64(theProposal.VotesFor)*100 > theProposal.ThresholdPercent*float64(theProposal.VotesFor+theProposal.VotesAgainst)
+}
+
+func validProposal(theProposal proposalFormat) bool {
+	if theProposal.Title == "" || theProposal.QuorumPercent <= 0 || theProposal.QuorumPercent > 100 || theProposal.ThresholdPercent < 50 || theProposal.ThresholdPercent >= 100 {
+		return false
+	}
+	switch theProposal.Kind {
+	case "dividend":
+		theDividend := theProposal.Payload.Dividend
+		if theDividend == nil || theDividend.PerShare <= 0 {
+			return false
+		}
+		// Holders can't be recorded for a dividend that hasn't been approved yet
+		if !theDividend.RecordDate.IsZero() && theDividend.RecordDate.Before(theProposal.ClosesAt) {
+			return false
+		}
+		return theDividend.PayDate.IsZero() || !theDividend.PayDate.Before(theDividend.RecordDate)
+	case "issuance", "buyback":
+		return theProposal.Payload.Quantity > 0
+	case "split":
+		theSplit := theProposal.Payload.Split
+		return theSplit != nil && theSplit.SplitFrom > 0 && theSplit.SplitTo > 0 && theSplit.SplitFrom != theSplit.SplitTo
+	case "text":
+		return true
+	}
+	return false
+}
+
+const proposalColumns = `shareholder_proposals.proposal_id, ticker, kind::TEXT, title, description, payload, proposed_by, opened_at, closes_at, quorum_percent, threshold_percent, proposal_status::TEXT, eligible_shares, decided_at, outcome, execution_error,
+	COALESCE((SELECT SUM(weight) FROM proposal_votes WHERE proposal_votes.proposal_id = shareholder_proposals.proposal_id AND choice = 'for'), 0),
+	COALESCE((SELECT SUM(weight) FROM proposal_votes WHERE proposal_votes.proposal_id = shareholder_proposals.proposal_id AND choice = 'against'), 0),
+	COALESCE((SELECT SUM(weight) FROM proposal_votes WHERE proposal_votes.proposal_id = shareholder_proposals.proposal_id AND choice = 'abstain'), 0)`
+
+func scanProposal(row pgx.Row) (proposalFormat, error) {
+	var theProposal proposalFormat
+	err := row.Scan(&theProposal.ProposalId, &theProposal.Ticker, &theProposal.Kind, &theProposal.Title, &theProposal.Description, &theProposal.Payload, &theProposal.ProposedBy, &theProposal.OpenedAt, &theProposal.ClosesAt, &theProposal.QuorumPercent, &theProposal.ThresholdPercent, &theProposal.Status, &theProposal.EligibleShares, &theProposal.DecidedAt, &theProposal.Outcome, &theProposal.ExecutionError, &theProposal.VotesFor, &theProposal.VotesAgainst, &theProposal.VotesAbstain)
+	return theProposal, err
+}
+
+// openProposal puts a question to ticker's shareholders. Votes are weighted by what each
+// holder owns as the proposal opens; the issuing region's own shares don't vote.
+func (Env env) openProposal(w http.ResponseWriter, r *http.Request) {
+	var received struct {
+		proposalFormat
+		VotingDays int
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("JSON Err", err)
+		return
+	}
+	theProposal := received.proposalFormat
+	if received.VotingDays == 0 {
+		received.VotingDays = defaultVotingDays
+	}
+	if theProposal.QuorumPercent == 0 {
+		theProposal.QuorumPercent = defaultQuorumPercent
+	}
+	if theProposal.ThresholdPercent == 0 {
+		theProposal.ThresholdPercent = defaultThresholdPercent
+	}
+	theProposal.OpenedAt = time.Now().UTC()
+	theProposal.ClosesAt = theProposal.OpenedAt.AddDate(0, 0, received.VotingDays)
+	if received.VotingDays < 1 || received.VotingDays > maxVotingDays || !validProposal(theProposal) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("openProposal tx err", err)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	region, _, err := Env.authorizeTicker(r.Context(), dbTx, r.Header.Get("NationName"), theProposal.Ticker, capCorporateActions)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("openProposal perm err", err)
+		return
+	}
+	theProposal.ProposedBy = r.Header.Get("NationName")
+	err = dbTx.QueryRow(r.Context(), `INSERT INTO shareholder_proposals (ticker, kind, title, description, payload, proposed_by, opened_at, closes_at, quorum_percent, threshold_percent) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING proposal_id`, theProposal.Ticker, theProposal.Kind, theProposal.Title, theProposal.Description, theProposal.Payload, theProposal.ProposedBy, theProposal.OpenedAt, theProposal.ClosesAt, theProposal.QuorumPercent, theProposal.ThresholdPercent).Scan(&theProposal.ProposalId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("openProposal insert err", err)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `INSERT INTO proposal_entitlements (proposal_id, account_name, shares) SELECT $1, account_name, share_quant FROM stock_holdings WHERE ticker = $2 AND account_name != $3 AND share_quant > 0`, theProposal.ProposalId, theProposal.Ticker, region).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("openProposal snapshot err", err)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `UPDATE shareholder_proposals SET eligible_shares = (SELECT COALESCE(SUM(shares), 0) FROM proposal_entitlements WHERE proposal_id = $1) WHERE proposal_id = $1`, theProposal.ProposalId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("openProposal snapshot err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("openProposal commit err", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		ProposalId string `json:"proposalId"`
+	}{theProposal.ProposalId})
+}
+
+// castVote records, or changes, an account's vote while the proposal is open
+func (Env env) castVote(w http.ResponseWriter, r *http.Request) {
+	proposalId := r.PathValue("id")
+	var received struct {
+		Account string // The holding account, the requesting nation if empty
+		Choice  string // for, against or abstain
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil || (received.Choice != "for" && received.Choice != "against" && received.Choice != "abstain") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if received.Account == "" {
+		received.Account = r.Header.Get("NationName")
+	}
+	_, err = Env.authorize(r.Context(), r.Header.Get("NationName"), received.Account, capTrade)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	var status string
+	var closesAt time.Time
+	err = Env.DBPool.QueryRow(r.Context(), `SELECT proposal_status::TEXT, closes_at FROM shareholder_proposals WHERE proposal_id = $1`, proposalId).Scan(&status, &closesAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("castVote get err", err)
+		return
+	}
+	if status != "open" || !time.Now().UTC().Before(closesAt) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	// Only holders at the snapshot have a weight to vote with
+	var weight int
+	err = Env.DBPool.QueryRow(r.Context(), `INSERT INTO proposal_votes (proposal_id, account_name, choice, weight, voted_at, voted_by) SELECT proposal_id, account_name, $3::voteChoice, shares, $4, $5 FROM proposal_entitlements WHERE proposal_id = $1 AND account_name = $2
+		ON CONFLICT (proposal_id, account_name) DO UPDATE SET choice = EXCLUDED.choice, voted_at = EXCLUDED.voted_at, voted_by = EXCLUDED.voted_by RETURNING weight`, proposalId, received.Account, received.Choice, time.Now().UTC(), r.Header.Get("NationName")).Scan(&weight)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("castVote err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Weight int `json:"weight"`
+	}{weight})
+}
+
+func (Env env) cancelProposal(w http.ResponseWriter, r *http.Request) {
+	proposalId := r.PathValue("id")
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	var ticker, status string
+	err = dbTx.QueryRow(r.Context(), `SELECT ticker, proposal_status::TEXT FROM shareholder_proposals WHERE proposal_id = $1 FOR UPDATE`, proposalId).Scan(&ticker, &status)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelProposal get err", err)
+		return
+	}
+	_, _, err = Env.authorizeTicker(r.Context(), dbTx, r.Header.Get("NationName"), ticker, capCorporateActions)
+	if err != nil {
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelProposal perm err", err)
+		return
+	}
+	if status != "open" {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `UPDATE shareholder_proposals SET proposal_status = 'cancelled', decided_at = $1 WHERE proposal_id = $2`, time.Now().UTC(), proposalId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("cancelProposal err", err)
+		return
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (Env env) getProposals(w http.ResponseWriter, r *http.Request) {
+	proposalRows, err := Env.DBPool.Query(r.Context(), `SELECT `+proposalColumns+` FROM shareholder_proposals WHERE ticker = $1 ORDER BY opened_at DESC`, r.PathValue("ticker"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("getProposals err", err)
+		return
+	}
+	defer proposalRows.Close()
+	theProposals := []proposalFormat{}
+	for proposalRows.Next() {
+		theProposal, err := scanProposal(proposalRows)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("getProposals scan err", err)
+			return
+		}
+		theProposals = append(theProposals, theProposal)
+	}
+	json.NewEncoder(w).Encode(theProposals)
+}
+
+func (Env env) getProposal(w http.ResponseWriter, r *http.Request) {
+	theProposal, err := scanProposal(Env.DBPool.QueryRow(r.Context(), `SELECT `+proposalColumns+` FROM shareholder_proposals WHERE proposal_id = $1`, r.PathValue("id")))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("getProposal err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(theProposal)
+}
+
+// closeDueProposals tallies proposals whose voting has ended, run by the scheduler
+func (Env env) closeDueProposals(ctx context.Context) error {
+	dueRows, err := Env.DBPool.Query(ctx, `SELECT proposal_id FROM shareholder_proposals WHERE proposal_status = 'open' AND closes_at <= $1`, time.Now().UTC())
+	if err != nil {
+		log.Println("Proposal close job err", err)
+		return err
+	}
+	dueProposals, err := pgx.CollectRows(dueRows, pgx.RowTo[string])
+	if err != nil {
+		log.Println("Proposal close job err", err)
+		return err
+	}
+	for _, proposalId := range dueProposals {
+		err = Env.closeProposal(ctx, proposalId)
+		if err != nil {
+			log.Println("Proposal", proposalId, "close err", err)
+		}
+	}
+	return nil
+}
+
+// closeProposal decides a proposal and carries out its corporate action if it passed.
+// An action that can't be carried out, such as a buyback the region can't afford, leaves
+// the proposal passed with the reason recorded.
+func (Env env) closeProposal(ctx context.Context, proposalId string) error {
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback(ctx)
+	theProposal, err := scanProposal(dbTx.QueryRow(ctx, `SELECT `+proposalColumns+` FROM shareholder_proposals WHERE proposal_id = $1 AND proposal_status = 'open' FOR UPDATE`, proposalId))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	status := "failed"
+	var outcome, executionError *string
+	if theProposal.passes() {
+		status = "passed"
+		actionTx, err := dbTx.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		result, err := Env.executeProposal(ctx, actionTx, theProposal)
+		if err != nil {
+			log.Println("Proposal", proposalId, "action err", err)
+			actionTx.Rollback(ctx)
+			reason := err.Error()
+			executionError = &reason
+		} else {
+			err = actionTx.Commit(ctx)
+			if err != nil {
+				return err
+			}
+			outcome = &result
+		}
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE shareholder_proposals SET proposal_status = $1, decided_at = $2, outcome = $3, execution_error = $4 WHERE proposal_id = $5`, status, time.Now().UTC(), outcome, executionError, proposalId).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	return dbTx.Commit(ctx)
+}
+
+// executeProposal carries out a passed proposal as if its proposer had declared it directly
+func (Env env) executeProposal(ctx context.Context, dbTx pgx.Tx, theProposal proposalFormat) (string, error) {
+	switch theProposal.Kind {
+	case "dividend":
+		theDividend := *theProposal.Payload.Dividend
+		theDividend.Ticker = theProposal.Ticker
+		theDividend.DeclaredBy = theProposal.ProposedBy
+		theDividend = dropPassedDividendDates(theDividend, time.Now().UTC())
+		var region string
+		err := dbTx.QueryRow(ctx, `SELECT region FROM stocks WHERE ticker = $1`, theDividend.Ticker).Scan(&region)
+		if err != nil {
+			return "", err
+		}
+		actionId, err := proposeDividend(ctx, dbTx, region, theDividend, theProposal.ProposedBy)
+		if err != nil {
+			return "", err
+		}
+		if actionId != "" {
+			return "dividend awaiting region action " + actionId, nil
+		}
+		dividendId, err := recordDividend(ctx, dbTx, theDividend)
+		return "dividend " + dividendId, err
+	case "issuance", "buyback":
+		theIssuance := issuanceFormat{
+			Ticker:      theProposal.Ticker,
+			Kind:        "buyback",
+			Quantity:    theProposal.Payload.Quantity,
+			RequestedBy: theProposal.ProposedBy,
+		}
+		if theProposal.Kind == "issuance" {
+			theIssuance.Kind = "offering"
+		}
+		var err error
+		theIssuance.IssuanceId, err = recordIssuanceRequest(ctx, dbTx, theIssuance)
+		if err != nil {
+			return "", err
+		}
+		// Shareholder approval doesn't stand in for the region's own admins signing off
+		var region string
+		err = dbTx.QueryRow(ctx, `SELECT region FROM stocks WHERE ticker = $1`, theIssuance.Ticker).Scan(&region)
+		if err != nil {
+			return "", err
+		}
+		actionId, err := proposeIssuance(ctx, dbTx, region, theIssuance, theProposal.ProposedBy)
+		if err != nil {
+			return "", err
+		}
+		if actionId != "" {
+			return "issuance " + theIssuance.IssuanceId + " awaiting region action " + actionId, nil
+		}
+		return "issuance " + theIssuance.IssuanceId, Env.executeIssuance(ctx, dbTx, theIssuance, theProposal.ProposedBy)
+	case "split":
+		theSplit := *theProposal.Payload.Split
+		theSplit.Ticker = theProposal.Ticker
+		theSplit.DeclaredBy = theProposal.ProposedBy
+		return "split", Env.applySplit(ctx, dbTx, theSplit)
+	}
+	// Text proposals only record the shareholders' view
+	return "", nil
+}
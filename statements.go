@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// statementLine is anything that moved the account's cash, signed from its side
+type statementLine struct {
+	Timecode     time.Time `json:"timecode"`
+	Kind         string    `json:"kind"` // A cash transaction kind, or adjustment for platform admin corrections
+	Counterparty string    `json:"counterparty"`
+	Description  string    `json:"description"`
+	Amount       float64   `json:"amount"`
+	Balance      float64   `json:"balance"`
+}
+
+type statementTrade struct {
+	Timecode     time.Time `json:"timecode"`
+	Ticker       string    `json:"ticker"`
+	Side         string    `json:"side"`
+	Counterparty string    `json:"counterparty"`
+	Quantity     int       `json:"quantity"`
+	Price        float64   `json:"price"`
+	Value        float64   `json:"value"`
+}
+
+type statementLoanEvent struct {
+	Timecode     time.Time `json:"timecode"`
+	LoanId       string    `json:"loanId"`
+	Event        string    `json:"event"`
+	Role         string    `json:"role"` // lender or lendee
+	Counterparty string    `json:"counterparty"`
+	Amount       float64   `json:"amount"`
+	Outstanding  *float64  `json:"outstanding,omitempty"` // Only known for accruals
+}
+
+var loanEventNames = map[string]string{
+	"issue":     "Loan Issue",
+	"repayment": "Loan Repayment",
+	"transfer":  "Membership Loan Transfer",
+}
+
+type accountStatement struct {
+	Account        string               `json:"account"`
+	From           time.Time            `json:"from"`
+	To             time.Time            `json:"to"`
+	OpeningBalance float64              `json:"openingBalance"`
+	ClosingBalance float64              `json:"closingBalance"`
+	Lines          []statementLine      `json:"lines"`
+	Trades         []statementTrade     `json:"trades"`
+	LoanEvents     []statementLoanEvent `json:"loanEvents"`
+}
+
+// cashFlowSince is the net cash that's moved into account from since onwards. Balances
+// include escrow, as moving cash in and out of escrow never leaves the account.
+func cashFlowSince(ctx context.Context, dbTx pgx.Tx, account string, since time.Time) (float64, error) {
+	var transacted, adjusted float64
+	err := dbTx.QueryRow(ctx, `SELECT COALESCE(SUM(CASE WHEN receiver = $1 THEN transaction_value ELSE 0 END) - SUM(CASE WHEN sender = $1 AND NOT minted THEN transaction_value ELSE 0 END), 0) FROM cash_transactions WHERE (sender = $1 OR receiver = $1) AND timecode >= $2`, account, since).Scan(&transacted)
+	if err != nil {
+		return 0, err
+	}
+	err = dbTx.QueryRow(ctx, `SELECT COALESCE(SUM((details->>'amount')::NUMERIC), 0) FROM admin_audit_log WHERE admin_action = 'adjust_balance' AND target = $1 AND timecode >= $2`, account, since).Scan(&adjusted)
+	return transacted + adjusted, err
+}
+
+func buildStatement(ctx context.Context, dbTx pgx.Tx, account string, from time.Time, to time.Time) (accountStatement, error) {
+	theStatement := accountStatement{
+		Account:    account,
+		From:       from,
+		To:         to,
+		Lines:      []statementLine{},
+		Trades:     []statementTrade{},
+		LoanEvents: []statementLoanEvent{},
+	}
+	var currentBalance float64
+	err := dbTx.QueryRow(ctx, `SELECT cash_in_hand + cash_in_escrow FROM accounts WHERE account_name = $1`, account).Scan(&currentBalance)
+	if err != nil {
+		return theStatement, err
+	}
+	flowSinceFrom, err := cashFlowSince(ctx, dbTx, account, from)
+	if err != nil {
+		return theStatement, err
+	}
+	flowSinceTo, err := cashFlowSince(ctx, dbTx, account, to)
+	if err != nil {
+		return theStatement, err
+	}
+	theStatement.OpeningBalance = currentBalance - flowSinceFrom
+	theStatement.ClosingBalance = currentBalance - flowSinceTo
+
+	lineRows, err := dbTx.Query(ctx, `SELECT timecode, transaction_kind::TEXT, CASE WHEN sender = $1 THEN receiver ELSE sender END, transaction_message, CASE WHEN sender = $1 AND (receiver = $1 OR minted) THEN 0 WHEN sender = $1 THEN -transaction_value ELSE transaction_value END, transaction_id, loan_id::TEXT, loan_event::TEXT, sender = $1 FROM cash_transactions WHERE (sender = $1 OR receiver = $1) AND timecode >= $2 AND timecode < $3
+		UNION ALL
+		SELECT timecode, 'adjustment', admin_name, reason, (details->>'amount')::NUMERIC, audit_id, NULL, NULL, (details->>'amount')::NUMERIC < 0 FROM admin_audit_log WHERE admin_action = 'adjust_balance' AND target = $1 AND timecode >= $2 AND timecode < $3
+		ORDER BY 1, 6`, account, from, to)
+	if err != nil {
+		return theStatement, err
+	}
+	runningBalance := theStatement.OpeningBalance
+	for lineRows.Next() {
+		var curLine statementLine
+		var rowId int64
+		var loanId, loanEvent *string
+		var sent bool
+		err = lineRows.Scan(&curLine.Timecode, &curLine.Kind, &curLine.Counterparty, &curLine.Description, &curLine.Amount, &rowId, &loanId, &loanEvent, &sent)
+		if err != nil {
+			lineRows.Close()
+			return theStatement, err
+		}
+		runningBalance += curLine.Amount
+		curLine.Balance = runningBalance
+		theStatement.Lines = append(theStatement.Lines, curLine)
+		if loanId != nil && loanEvent != nil {
+			// Issues, repayments and transfers are cash lines too
+			role := "lendee"
+			switch {
+			case *loanEvent == "transfer":
+				// Membership loans moving regions, paid from the new lender to the old
+				role = "lender"
+			case *loanEvent == "issue" && sent, *loanEvent == "repayment" && !sent:
+				role = "lender"
+			}
+			theStatement.LoanEvents = append(theStatement.LoanEvents, statementLoanEvent{
+				Timecode:     curLine.Timecode,
+				LoanId:       *loanId,
+				Event:        loanEventNames[*loanEvent],
+				Role:         role,
+				Counterparty: curLine.Counterparty,
+				Amount:       curLine.Amount,
+			})
+		}
+	}
+	lineRows.Close()
+	if lineRows.Err() != nil {
+		return theStatement, lineRows.Err()
+	}
+
+	tradeRows, err := dbTx.Query(ctx, `SELECT timecode, ticker, CASE WHEN buyer = $1 THEN 'buy' ELSE 'sell' END, CASE WHEN buyer = $1 THEN seller ELSE buyer END, quantity, price FROM trade_executions WHERE (buyer = $1 OR seller = $1) AND timecode >= $2 AND timecode < $3 ORDER BY timecode, execution_id`, account, from, to)
+	if err != nil {
+		return theStatement, err
+	}
+	for tradeRows.Next() {
+		var curTrade statementTrade
+		err = tradeRows.Scan(&curTrade.Timecode, &curTrade.Ticker, &curTrade.Side, &curTrade.Counterparty, &curTrade.Quantity, &curTrade.Price)
+		if err != nil {
+			tradeRows.Close()
+			return theStatement, err
+		}
+		curTrade.Value = curTrade.Price * float64(curTrade.Quantity)
+		theStatement.Trades = append(theStatement.Trades, curTrade)
+	}
+	tradeRows.Close()
+	if tradeRows.Err() != nil {
+		return theStatement, tradeRows.Err()
+	}
+
+	accrualRows, err := dbTx.Query(ctx, `SELECT period_end, loan_id::TEXT, CASE WHEN lender = $1 THEN 'lender' ELSE 'lendee' END, CASE WHEN lender = $1 THEN lendee ELSE lender END, interest, closing_value FROM loan_accruals WHERE (lender = $1 OR lendee = $1) AND period_end >= $2 AND period_end < $3`, account, from, to)
+	if err != nil {
+		return theStatement, err
+	}
+	defer accrualRows.Close()
+	for accrualRows.Next() {
+		curEvent := statementLoanEvent{Event: "Interest Accrual"}
+		err = accrualRows.Scan(&curEvent.Timecode, &curEvent.LoanId, &curEvent.Role, &curEvent.Counterparty, &curEvent.Amount, &curEvent.Outstanding)
+		if err != nil {
+			return theStatement, err
+		}
+		theStatement.LoanEvents = append(theStatement.LoanEvents, curEvent)
+	}
+	if accrualRows.Err() != nil {
+		return theStatement, accrualRows.Err()
+	}
+	slices.SortStableFunc(theStatement.LoanEvents, func(a, b statementLoanEvent) int {
+		return a.Timecode.Compare(b.Timecode)
+	})
+	return theStatement, nil
+}
+
+func formatMoney(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+// csvText stops text a user wrote, like a transfer message, being read as a formula when
+// the statement is opened in a spreadsheet
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// writeStatementCSV puts every section in one sheet, told apart by the first column
+func writeStatementCSV(w http.ResponseWriter, theStatement accountStatement) error {
+	csvWriter := csv.NewWriter(w)
+	rows := [][]string{
+		{"section", "timecode", "kind", "counterparty", "description", "quantity", "price", "amount", "balance"},
+		{"opening", theStatement.From.Format(time.RFC3339), "", "", "Opening balance", "", "", "", formatMoney(theStatement.OpeningBalance)},
+	}
+	for _, line := range theStatement.Lines {
+		rows = append(rows, []string{"cash", line.Timecode.Format(time.RFC3339), line.Kind, csvText(line.Counterparty), csvText(line.Description), "", "", formatMoney(line.Amount), formatMoney(line.Balance)})
+	}
+	for _, trade := range theStatement.Trades {
+		rows = append(rows, []string{"trade", trade.Timecode.Format(time.RFC3339), trade.Side, csvText(trade.Counterparty), csvText(trade.Ticker), strconv.Itoa(trade.Quantity), formatMoney(trade.Price), formatMoney(trade.Value), ""})
+	}
+	for _, event := range theStatement.LoanEvents {
+		rows = append(rows, []string{"loan", event.Timecode.Format(time.RFC3339), event.Event, csvText(event.Counterparty), "Loan " + event.LoanId + " as " + event.Role, "", "", formatMoney(event.Amount), ""})
+	}
+	rows = append(rows, []string{"closing", theStatement.To.Format(time.RFC3339), "", "", "Closing balance", "", "", "", formatMoney(theStatement.ClosingBalance)})
+	err := csvWriter.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+	return csvWriter.Error()
+}
+
+func writeStatementPDF(w http.ResponseWriter, theStatement accountStatement) error {
+	pdf := gofpdf.New("L", "mm", "A4", "")
+	toLatin := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle("Statement for "+theStatement.Account, true)
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, toLatin("Account statement - "+theStatement.Account), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, fmt.Sprintf("%s to %s", theStatement.From.Format(time.DateTime), theStatement.To.Format(time.DateTime)), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, "Opening balance: "+formatMoney(theStatement.OpeningBalance), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, "Closing balance: "+formatMoney(theStatement.ClosingBalance), "", 1, "L", false, 0, "")
+	table := func(title string, widths []float64, headers []string, rows [][]string) {
+		pdf.Ln(4)
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.CellFormat(0, 8, title, "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.SetFillColor(220, 220, 220)
+		for i, header := range headers {
+			pdf.CellFormat(widths[i], 6, header, "1", 0, "L", true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+		if len(rows) == 0 {
+			pdf.CellFormat(0, 6, "None in this period", "", 1, "L", false, 0, "")
+			return
+		}
+		for _, row := range rows {
+			for i, cell := range row {
+				align := "L"
+				if i >= len(row)-2 {
+					align = "R"
+				}
+				pdf.CellFormat(widths[i], 6, toLatin(cell), "1", 0, align, false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+	}
+	cashRows := [][]string{}
+	for _, line := range theStatement.Lines {
+		cashRows = append(cashRows, []string{line.Timecode.Format(time.DateTime), line.Kind, line.Counterparty, line.Description, formatMoney(line.Amount), formatMoney(line.Balance)})
+	}
+	table("Cash", []float64{38, 25, 50, 107, 28, 29}, []string{"Time", "Kind", "Counterparty", "Description", "Amount", "Balance"}, cashRows)
+	tradeRows := [][]string{}
+	for _, trade := range theStatement.Trades {
+		tradeRows = append(tradeRows, []string{trade.Timecode.Format(time.DateTime), trade.Ticker, trade.Side, trade.Counterparty, strconv.Itoa(trade.Quantity), formatMoney(trade.Price), formatMoney(trade.Value)})
+	}
+	table("Trades", []float64{38, 30, 20, 80, 30, 29, 50}, []string{"Time", "Ticker", "Side", "Counterparty", "Quantity", "Price", "Value"}, tradeRows)
+	loanRows := [][]string{}
+	for _, event := range theStatement.LoanEvents {
+		outstanding := ""
+		if event.Outstanding != nil {
+			outstanding = formatMoney(*event.Outstanding)
+		}
+		loanRows = append(loanRows, []string{event.Timecode.Format(time.DateTime), event.LoanId, event.Event, event.Role, event.Counterparty, formatMoney(event.Amount), outstanding})
+	}
+	table("Loan events", []float64{38, 20, 55, 25, 79, 30, 30}, []string{"Time", "Loan", "Event", "Role", "Counterparty", "Amount", "Outstanding"}, loanRows)
+	return pdf.Output(w)
+}
+
+// accountStatement covers from to to, defaulting to the month so far. Takes the same
+// permissions as regionInfo: an account's own nation, or those who can view a region.
+func (Env env) accountStatement(w http.ResponseWriter, r *http.Request) {
+	account := r.PathValue("name")
+	_, err := Env.authorize(r.Context(), r.Header.Get("NationName"), account, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows || err == errUnauthorized {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	params := r.URL.Query()
+	to := time.Now().UTC()
+	if params.Has("to") {
+		to, err = parseHistoryTime(params.Get("to"), true)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	from := time.Date(to.Year(), to.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if params.Has("from") {
+		from, err = parseHistoryTime(params.Get("from"), false)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if !from.Before(to) || (format != "json" && format != "csv" && format != "pdf") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Repeatable read so the balances and the lines between them agree
+	dbTx, err := Env.DBPool.BeginTx(r.Context(), pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	theStatement, err := buildStatement(r.Context(), dbTx, account, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Statement Err", err)
+		return
+	}
+	fileName := fmt.Sprintf("statement-%s-%s.%s", nsSlug(account), from.Format(time.DateOnly), format)
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+		err = writeStatementCSV(w, theStatement)
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+		err = writeStatementPDF(w, theStatement)
+	default:
+		err = json.NewEncoder(w).Encode(theStatement)
+	}
+	if err != nil {
+		log.Println("Statement write Err", err)
+	}
+}
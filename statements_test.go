@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCSVText(t *testing.T) {
+	cases := map[string]string{
+		"":                   "",
+		"Rent":               "Rent",
+		"=HYPERLINK(\"x\")":  "'=HYPERLINK(\"x\")",
+		"+1":                 "'+1",
+		"-2+3":               "'-2+3",
+		"@SUM(A1)":           "'@SUM(A1)",
+		"\t=1":               "'\t=1",
+		"Loan Issue - ID 12": "Loan Issue - ID 12",
+	}
+	for value, want := range cases {
+		if got := csvText(value); got != want {
+			t.Errorf("csvText(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestWriteStatementCSVEscapesText(t *testing.T) {
+	theStatement := accountStatement{
+		Lines: []statementLine{{Timecode: time.Now(), Kind: "transfer", Counterparty: "Foo", Description: "=cmd()", Amount: -5}},
+	}
+	w := httptest.NewRecorder()
+	if err := writeStatementCSV(w, theStatement); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(w.Body.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cashRow := rows[2]
+	if cashRow[4] != "'=cmd()" {
+		t.Errorf("description = %q, want it escaped", cashRow[4])
+	}
+	if cashRow[7] != "-5.00" {
+		t.Errorf("amount = %q, numbers shouldn't be escaped", cashRow[7])
+	}
+}
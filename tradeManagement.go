@@ -50,42 +50,30 @@ func (Env env) openTrade(w http.ResponseWriter, r *http.Request) {
 		log.Println("JSON Err", err)
 		return
 	}
-	var account_type string
-	var traderCash float32
-	err = dbTx.QueryRow(r.Context(), `SELECT account_type, cash_in_hand FROM accounts WHERE account_name = $1`, sentThing.Sender).Scan(&account_type, &traderCash)
+	grant, err := Env.authorize(r.Context(), r.Header.Get("NationName"), sentThing.Sender, capTrade)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		log.Println("Auth Err 1", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if account_type == "region" {
-		var permission string
-		err = dbTx.QueryRow(r.Context(), `SELECT permission FROM nation_permissions WHERE region_name = $1 AND nation_name = $2`, sentThing.Sender, r.Header.Get("NationName")).Scan(&permission)
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			log.Println("Auth Err 2", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if permission != "trader" && permission != "admin" && r.Header.Get("NationName") != "Gallaton" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-	} else if account_type == "nation" {
-		if sentThing.Sender != r.Header.Get("NationName") {
+		if err == errUnauthorized {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		log.Println("Auth Err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var traderCash float32
+	err = dbTx.QueryRow(r.Context(), `SELECT cash_in_hand FROM accounts WHERE account_name = $1`, sentThing.Sender).Scan(&traderCash)
+	if err != nil {
+		log.Println("Cash Err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	jsonEncoder := json.NewEncoder(w)
-	err = dbTx.QueryRow(r.Context(), `SELECT share_price, total_share_volume, market_cap FROM stocks WHERE ticker = $1`, sentThing.Ticker).Scan(&currentQuote.MarketPrice, &currentQuote.TotalVolume, &currentQuote.MarketCapitalisation)
+	var tradingOpen, halted bool
+	err = dbTx.QueryRow(r.Context(), `SELECT share_price, total_share_volume, market_cap, trading_open, halted FROM stocks WHERE ticker = $1`, sentThing.Ticker).Scan(&currentQuote.MarketPrice, &currentQuote.TotalVolume, &currentQuote.MarketCapitalisation, &tradingOpen, &halted)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -95,6 +83,16 @@ func (Env env) openTrade(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !tradingOpen {
+		w.WriteHeader(http.StatusConflict)
+		log.Println("Ticker still in IPO", sentThing.Ticker)
+		return
+	}
+	if halted {
+		w.WriteHeader(http.StatusConflict)
+		log.Println("Ticker halted", sentThing.Ticker)
+		return
+	}
 	var opposingDirect string
 	if strings.EqualFold(sentThing.Direction, "buy") {
 		opposingDirect = "sell"
@@ -109,6 +107,11 @@ func (Env env) openTrade(w http.ResponseWriter, r *http.Request) {
 	if strings.EqualFold(sentThing.PriceType, "market") {
 		sentThing.Price = currentQuote.MarketPrice
 	}
+	if !grant.canSpend(float64(sentThing.Price) * float64(sentThing.Quantity)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Println("Spending limit exceeded", grant.Actor, grant.Role)
+		return
+	}
 	if strings.EqualFold(sentThing.Direction, "buy") {
 		if strings.EqualFold(sentThing.PriceType, "market") {
 			if (sentThing.Price*1.15)*float32(sentThing.Quantity) > float32(traderCash) {
@@ -180,6 +183,7 @@ func (Env env) openTrade(w http.ResponseWriter, r *http.Request) {
 	}
 	var updSentThing tradeFormat
 	matchTrades := 0
+	filled := false
 	for i := 0; i < len(oppOrders); i++ {
 		oppTrade := oppOrders[i]
 		matchTrades += 1
@@ -196,6 +200,7 @@ func (Env env) openTrade(w http.ResponseWriter, r *http.Request) {
 				Receiver: updOppTrade.Sender,
 				Value:    cashValue,
 				Message:  sentThing.Ticker + ` Trade`,
+				Kind:     "trade",
 			}
 			shareTrans = shareTransfer{
 				Ticker:   sentThing.Ticker,
@@ -210,6 +215,7 @@ func (Env env) openTrade(w http.ResponseWriter, r *http.Request) {
 				Sender:   updOppTrade.Sender,
 				Value:    cashValue,
 				Message:  sentThing.Ticker + ` Trade`,
+				Kind:     "trade",
 			}
 			shareTrans = shareTransfer{
 				Ticker:   sentThing.Ticker,
@@ -229,6 +235,12 @@ func (Env env) openTrade(w http.ResponseWriter, r *http.Request) {
 			log.Println("Shares Err", err)
 			continue
 		}
+		err = dbTx.QueryRow(r.Context(), `INSERT INTO trade_executions (timecode, ticker, buyer, seller, quantity, price) VALUES ($1, $2, $3, $4, $5, $6)`, cashTransfer.Timecode, sentThing.Ticker, shareTrans.Receiver, shareTrans.Sender, transferAmount, sentThing.Price).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println("Execution log Err", err)
+			continue
+		}
+		filled = true
 		if updOppTrade.Quantity == 0 {
 			err = dbTx.QueryRow(r.Context(), `DELETE FROM open_orders WHERE trade_id = $1`, oppTrade.TradeId).Scan()
 		} else {
@@ -256,6 +268,10 @@ func (Env env) openTrade(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// Unmatched orders are left for logPrices to pick up
+	if filled {
+		Env.requestIndexUpdate()
+	}
 	if enteredTradeId != 0 {
 		w.WriteHeader(http.StatusCreated)
 		jsonEncoder.Encode(struct {
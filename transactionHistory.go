@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultHistoryPage = 25
+	maxHistoryPage     = 200
+)
+
+var cashTransactionKinds = []string{"transfer", "trade", "loan", "dividend", "split", "buyback", "ipo", "bond"}
+
+type historyTransaction struct {
+	transactionFormat
+	TransactionId string `json:"transactionId"`
+}
+
+// The cursor is the timecode and id of the last row handed out, so pages stay stable
+// while new transactions come in on top
+func encodeHistoryCursor(timecode time.Time, transactionId string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(timecode.Format(time.RFC3339Nano) + "|" + transactionId))
+}
+
+func decodeHistoryCursor(cursor string) (time.Time, int64, bool) {
+	rawCursor, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	timePart, idPart, found := strings.Cut(string(rawCursor), "|")
+	if !found {
+		return time.Time{}, 0, false
+	}
+	timecode, err := time.Parse(time.RFC3339Nano, timePart)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	transactionId, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return timecode, transactionId, true
+}
+
+// parseHistoryTime takes either a full timestamp or a plain date. A plain date that
+// ends a range includes the whole of that day.
+func parseHistoryTime(value string, rangeEnd bool) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed.UTC(), nil
+	}
+	parsed, err := time.Parse(time.DateOnly, value)
+	if err == nil && rangeEnd {
+		parsed = parsed.AddDate(0, 0, 1)
+	}
+	return parsed, err
+}
+
+// getCashTransactions pages back through an account's cash history, newest first.
+// Accepts account, cursor, limit, from, to, counterparty, min, max, type (repeatable),
+// direction (sent or received) and q, a full text search on the message.
+func (Env env) getCashTransactions(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	account := params.Get("account")
+	if account == "" {
+		account = r.Header.Get("NationName")
+	}
+	_, err := Env.authorize(r.Context(), r.Header.Get("NationName"), account, capView)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == errUnauthorized {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Auth Err", err)
+		return
+	}
+	limit := defaultHistoryPage
+	if params.Has("limit") {
+		limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > maxHistoryPage {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	conditions := []string{}
+	args := []any{account}
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.ReplaceAll(condition, "$?", "$"+strconv.Itoa(len(args))))
+	}
+	switch params.Get("direction") {
+	case "":
+		conditions = append(conditions, "(sender = $1 OR receiver = $1)")
+	case "sent":
+		conditions = append(conditions, "sender = $1")
+	case "received":
+		conditions = append(conditions, "receiver = $1")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if counterparty := params.Get("counterparty"); counterparty != "" {
+		addCondition("((sender = $1 AND receiver = $?) OR (receiver = $1 AND sender = $?))", counterparty)
+	}
+	for _, timeParam := range []struct{ name, condition string }{{"from", "timecode >= $?"}, {"to", "timecode < $?"}} {
+		if !params.Has(timeParam.name) {
+			continue
+		}
+		parsed, err := parseHistoryTime(params.Get(timeParam.name), timeParam.name == "to")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		addCondition(timeParam.condition, parsed)
+	}
+	for _, valueParam := range []struct{ name, condition string }{{"min", "transaction_value >= $?"}, {"max", "transaction_value <= $?"}} {
+		if !params.Has(valueParam.name) {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(params.Get(valueParam.name), 64)
+		if err != nil || parsed < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		addCondition(valueParam.condition, parsed)
+	}
+	if kinds := params["type"]; len(kinds) > 0 {
+		for _, kind := range kinds {
+			if !slices.Contains(cashTransactionKinds, kind) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		addCondition("transaction_kind::TEXT = ANY($?)", kinds)
+	}
+	if search := params.Get("q"); search != "" {
+		addCondition("message_search @@ websearch_to_tsquery('english', $?)", search)
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		cursorTime, cursorId, ok := decodeHistoryCursor(cursor)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		args = append(args, cursorTime, cursorId)
+		conditions = append(conditions, "(timecode, transaction_id) < ($"+strconv.Itoa(len(args)-1)+", $"+strconv.Itoa(len(args))+")")
+	}
+	// One extra row tells us whether there's another page
+	args = append(args, limit+1)
+	historyRows, err := Env.DBPool.Query(r.Context(), `SELECT transaction_id::TEXT, timecode, sender, receiver, transaction_value, transaction_message, transaction_kind::TEXT FROM cash_transactions WHERE `+strings.Join(conditions, " AND ")+` ORDER BY timecode DESC, transaction_id DESC LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Transaction history Err", err)
+		return
+	}
+	defer historyRows.Close()
+	returnPage := struct {
+		Transactions []historyTransaction `json:"transactions"`
+		NextCursor   string               `json:"nextCursor,omitempty"`
+	}{Transactions: []historyTransaction{}}
+	for historyRows.Next() {
+		var curTransact historyTransaction
+		err = historyRows.Scan(&curTransact.TransactionId, &curTransact.Timecode, &curTransact.Sender, &curTransact.Receiver, &curTransact.Value, &curTransact.Message, &curTransact.Kind)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Transaction history scan Err", err)
+			return
+		}
+		returnPage.Transactions = append(returnPage.Transactions, curTransact)
+	}
+	if historyRows.Err() != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Transaction history Err", historyRows.Err())
+		return
+	}
+	if len(returnPage.Transactions) > limit {
+		returnPage.Transactions = returnPage.Transactions[:limit]
+		lastTransact := returnPage.Transactions[limit-1]
+		returnPage.NextCursor = encodeHistoryCursor(lastTransact.Timecode, lastTransact.TransactionId)
+	}
+	json.NewEncoder(w).Encode(returnPage)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TOTP as in RFC 6238 with the defaults every authenticator app supports: SHA-1,
+// 30 second steps and 6 digits. One step either side is accepted for clock drift.
+const (
+	totpStep          = 30
+	totpDigits        = 6
+	totpDrift         = 1
+	totpIssuer        = "NWC Finance"
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, truncated%uint32(math.Pow10(totpDigits)))
+}
+
+// matchTotp returns the step code matched at, or 0 if it didn't match any step in the
+// window after lastStep. Steps up to lastStep have been used already and can't be replayed.
+func matchTotp(encodedSecret string, code string, now time.Time, lastStep int64) int64 {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	currentStep := now.Unix() / totpStep
+	for step := max(currentStep-totpDrift, lastStep+1); step <= currentStep+totpDrift; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+func hashRecoveryCode(code string) string {
+	codeHash := sha256.Sum256([]byte(strings.ToLower(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(codeHash[:])
+}
+
+// secondFactorEnabled is whether account has confirmed TOTP, and the cash transfer size above which it's asked for again
+func (Env env) secondFactorEnabled(ctx context.Context, account string) (bool, *float64, error) {
+	var enabled bool
+	var threshold *float64
+	err := Env.DBPool.QueryRow(ctx, `SELECT enabled, step_up_threshold FROM account_totp WHERE account_name = $1`, account).Scan(&enabled, &threshold)
+	if err == pgx.ErrNoRows {
+		return false, nil, nil
+	}
+	return enabled, threshold, err
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery code,
+// using it up so it can't be replayed
+func (Env env) checkSecondFactor(ctx context.Context, account string, totp string, recoveryCode string) (bool, error) {
+	dbTx, err := Env.DBPool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer dbTx.Rollback(ctx)
+	if recoveryCode != "" {
+		tag, err := dbTx.Exec(ctx, `UPDATE totp_recovery_codes SET used_at = $1 WHERE account_name = $2 AND code_hash = $3 AND used_at IS NULL`, time.Now().UTC(), account, hashRecoveryCode(recoveryCode))
+		if err != nil || tag.RowsAffected() == 0 {
+			return false, err
+		}
+		return true, dbTx.Commit(ctx)
+	}
+	var secret string
+	var lastStep int64
+	err = dbTx.QueryRow(ctx, `SELECT totp_secret, last_used_step FROM account_totp WHERE account_name = $1 FOR UPDATE`, account).Scan(&secret, &lastStep)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	step := matchTotp(secret, totp, time.Now(), lastStep)
+	if step == 0 {
+		return false, nil
+	}
+	err = dbTx.QueryRow(ctx, `UPDATE account_totp SET last_used_step = $1 WHERE account_name = $2`, step, account).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		return false, err
+	}
+	return true, dbTx.Commit(ctx)
+}
+
+// requireSecondFactor checks a code outside of login, writing the failure response
+// itself. Wrong codes count towards the same lockout as failed logins, so a stolen
+// AuthKey can't be used to run through every code.
+func (Env env) requireSecondFactor(w http.ResponseWriter, r *http.Request, account string, totp string, recoveryCode string) bool {
+	ip := Env.clientIP(r)
+	lockedUntil, err := Env.loginLockedUntil(r.Context(), account, ip)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Lockout Err", err)
+		return false
+	}
+	if !lockedUntil.IsZero() {
+		writeLockedOut(w, lockedUntil)
+		return false
+	}
+	passed, err := Env.checkSecondFactor(r.Context(), account, totp, recoveryCode)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("TOTP check Err", err)
+		return false
+	}
+	if !passed {
+		if recordErr := Env.recordLoginAttempt(r.Context(), account, ip, false); recordErr != nil {
+			log.Println("Login attempt Err", recordErr)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// enrollTotp starts enrollment with a new secret. It isn't required until confirmed.
+func (Env env) enrollTotp(w http.ResponseWriter, r *http.Request) {
+	account := r.Header.Get("NationName")
+	secretBytes := make([]byte, 20)
+	_, err := rand.Read(secretBytes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	secret := totpEncoding.EncodeToString(secretBytes)
+	// Re-enrolling while enabled would let a stolen AuthKey swap the secret out
+	tag, err := Env.DBPool.Exec(r.Context(), `INSERT INTO account_totp (account_name, totp_secret, enrolled_at) VALUES ($1, $2, $3) ON CONFLICT (account_name) DO UPDATE SET totp_secret = EXCLUDED.totp_secret, enrolled_at = EXCLUDED.enrolled_at, last_used_step = 0 WHERE account_totp.enabled = FALSE`, account, secret, time.Now().UTC())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("TOTP enroll Err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	otpauth := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + account,
+		RawQuery: url.Values{
+			"secret": {secret},
+			"issuer": {totpIssuer},
+		}.Encode(),
+	}
+	json.NewEncoder(w).Encode(struct {
+		Secret     string `json:"secret"`
+		OtpauthUri string `json:"otpauthUri"`
+	}{
+		Secret:     secret,
+		OtpauthUri: otpauth.String(),
+	})
+}
+
+// confirmTotp turns TOTP on once the user proves their app has the secret, and hands
+// out the recovery codes, which are never shown again
+func (Env env) confirmTotp(w http.ResponseWriter, r *http.Request) {
+	account := r.Header.Get("NationName")
+	var received struct {
+		TotpCode string
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	var secret string
+	var enabled bool
+	err = dbTx.QueryRow(r.Context(), `SELECT totp_secret, enabled FROM account_totp WHERE account_name = $1 FOR UPDATE`, account).Scan(&secret, &enabled)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("TOTP confirm Err", err)
+		return
+	}
+	if enabled {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	step := matchTotp(secret, received.TotpCode, time.Now(), 0)
+	if step == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `UPDATE account_totp SET enabled = TRUE, last_used_step = $1 WHERE account_name = $2`, step, account).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("TOTP confirm Err", err)
+		return
+	}
+	err = dbTx.QueryRow(r.Context(), `DELETE FROM totp_recovery_codes WHERE account_name = $1`, account).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("TOTP recovery Err", err)
+		return
+	}
+	recoveryCodes := make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		codeBytes := make([]byte, 5)
+		_, err = rand.Read(codeBytes)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		codeHex := hex.EncodeToString(codeBytes)
+		recoveryCodes[i] = codeHex[:5] + "-" + codeHex[5:]
+		err = dbTx.QueryRow(r.Context(), `INSERT INTO totp_recovery_codes (account_name, code_hash) VALUES ($1, $2)`, account, hashRecoveryCode(recoveryCodes[i])).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("TOTP recovery Err", err)
+			return
+		}
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// disableTotp needs a code, so a stolen AuthKey alone can't strip the second factor
+func (Env env) disableTotp(w http.ResponseWriter, r *http.Request) {
+	account := r.Header.Get("NationName")
+	var received struct {
+		TotpCode     string
+		RecoveryCode string
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !Env.requireSecondFactor(w, r, account, received.TotpCode, received.RecoveryCode) {
+		return
+	}
+	dbTx, err := Env.DBPool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbTx.Rollback(r.Context())
+	for _, query := range []string{`DELETE FROM totp_recovery_codes WHERE account_name = $1`, `DELETE FROM account_totp WHERE account_name = $1`} {
+		err = dbTx.QueryRow(r.Context(), query, account).Scan()
+		if err != nil && err != pgx.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("TOTP disable Err", err)
+			return
+		}
+	}
+	err = dbTx.Commit(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// setStepUpThreshold sets the cash transfer size above which a code is asked for again
+func (Env env) setStepUpThreshold(w http.ResponseWriter, r *http.Request) {
+	account := r.Header.Get("NationName")
+	var received struct {
+		StepUpThreshold *float64 // null to stop asking
+		TotpCode        string
+	}
+	err := json.NewDecoder(r.Body).Decode(&received)
+	if err != nil || (received.StepUpThreshold != nil && *received.StepUpThreshold < 0) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	enabled, _, err := Env.secondFactorEnabled(r.Context(), account)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("TOTP Err", err)
+		return
+	}
+	if !enabled {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if !Env.requireSecondFactor(w, r, account, received.TotpCode, "") {
+		return
+	}
+	err = Env.DBPool.QueryRow(r.Context(), `UPDATE account_totp SET step_up_threshold = $1 WHERE account_name = $2`, received.StepUpThreshold, account).Scan()
+	if err != nil && err != pgx.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("TOTP threshold Err", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Codes are the last six digits of the RFC 6238 SHA-1 test vectors
+func TestMatchTotp(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	issuedAt := time.Unix(1234567890, 0)
+	const issuedStep = 1234567890 / totpStep
+	cases := []struct {
+		name     string
+		secret   string
+		code     string
+		now      time.Time
+		lastStep int64
+		want     int64
+	}{
+		{"current step", secret, "005924", issuedAt, 0, issuedStep},
+		{"other vector", secret, "081804", time.Unix(1111111109, 0), 0, 1111111109 / totpStep},
+		{"clock a step behind", secret, "005924", issuedAt.Add(totpStep * time.Second), 0, issuedStep},
+		{"clock a step ahead", secret, "005924", issuedAt.Add(-totpStep * time.Second), 0, issuedStep},
+		{"outside the drift window", secret, "005924", issuedAt.Add(2 * totpStep * time.Second), 0, 0},
+		{"wrong code", secret, "005925", issuedAt, 0, 0},
+		{"wrong length", secret, "05924", issuedAt, 0, 0},
+		{"undecodable secret", "not base32!", "005924", issuedAt, 0, 0},
+		{"replayed", secret, "005924", issuedAt, issuedStep, 0},
+		{"replayed after drift", secret, "005924", issuedAt.Add(totpStep * time.Second), issuedStep, 0},
+		{"earlier step used", secret, "005924", issuedAt, issuedStep - 1, issuedStep},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := matchTotp(tc.secret, tc.code, tc.now, tc.lastStep)
+			if got != tc.want {
+				t.Errorf("matchTotp(%q, %v, %v) = %v, want %v", tc.code, tc.now.Unix(), tc.lastStep, got, tc.want)
+			}
+		})
+	}
+}
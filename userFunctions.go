@@ -2,9 +2,8 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
@@ -13,24 +12,76 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	errNotVerified = errors.New("nation ownership not verified")
+	errWrongRegion = errors.New("nation doesn't reside in the region")
+)
+
+// checkSignupNation asks NS whether the nation's owner is the one signing up, and
+// whether it lives in region
+func (Env env) checkSignupNation(ctx context.Context, nation string, checksum string, region string) error {
+	verified, err := Env.NSClient.VerifyNation(ctx, nation, checksum)
+	if err != nil && err != errNSNotFound {
+		return err
+	}
+	if err == errNSNotFound || !verified {
+		return errNotVerified
+	}
+	residentRegion, err := Env.NSClient.NationRegion(ctx, nation)
+	if err != nil {
+		return err
+	}
+	if nsSlug(residentRegion) != nsSlug(region) {
+		return errWrongRegion
+	}
+	return nil
+}
+
 func (Env env) signupFunc(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var newUser struct {
 		NationName     string `json:"NationName"`
 		PasswordString string `json:"PasswordString"`
 		RegionName     string `json:"RegionName"`
+		Checksum       string `json:"Checksum"` // Verification code from nationstates.net/page=verify
+	}
+	err := decoder.Decode(&newUser)
+	log.Println("NewUser Signup Request")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("JSON Err 1", err)
+		return
+	}
+	err = Env.checkSignupNation(r.Context(), newUser.NationName, newUser.Checksum, newUser.RegionName)
+	if err != nil {
+		if err == errNotVerified || err == errWrongRegion {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println("Signup refused", newUser.NationName, err)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		log.Println("NS Err", err)
+		return
 	}
 	ourTx, err := Env.DBPool.Begin(r.Context())
-	defer ourTx.Rollback(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("DB Err 0", err)
+		return
 	}
-	err = decoder.Decode(&newUser)
-	log.Println("NewUser Signup Request")
+	defer ourTx.Rollback(r.Context())
+	// NS treats "Foo Bar", "foo_bar" and "FOO BAR" as one nation, so only one account may have it
+	slugged := nsSlug(newUser.NationName)
+	var taken bool
+	err = ourTx.QueryRow(r.Context(), `SELECT pg_advisory_xact_lock(hashtext($1)), EXISTS(SELECT 1 FROM accounts WHERE lower(replace(btrim(account_name), ' ', '_')) = $1)`, slugged).Scan(nil, &taken)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Println("JSON Err 1", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("DB Err 2", err)
+		return
+	}
+	if taken {
+		w.WriteHeader(http.StatusConflict)
+		log.Println("Nation already signed up", newUser.NationName)
 		return
 	}
 	log.Println("Bcrypt started")
@@ -41,20 +92,28 @@ func (Env env) signupFunc(w http.ResponseWriter, r *http.Request) {
 		log.Println("DB Err 3", err)
 		return
 	}
-	err = ourTx.QueryRow(r.Context(), "INSERT INTO nation_permissions (region_name, nation_name, permission) VALUES ($1, $2, 'citizen')", newUser.RegionName, newUser.NationName).Scan()
-	if err != nil && err != pgx.ErrNoRows {
+	err = checkIsRegion(r.Context(), ourTx, newUser.RegionName)
+	if err != nil {
+		w.WriteHeader(membershipErrorStatus(err))
+		log.Println("Signup region Err", err)
+		return
+	}
+	err = startMembership(r.Context(), ourTx, newUser.NationName, newUser.RegionName)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("DB Err 4", err)
 		return
 	}
-	err = ourTx.QueryRow(r.Context(), `INSERT INTO loans (lendee, lender, lent_value, rate, current_value) VALUES ($1, $2, $3, $4, $5);`, newUser.NationName, newUser.RegionName, 10000, 2.5, 10000).Scan()
-	if err != nil && err != pgx.ErrNoRows {
+	var loanId string
+	err = ourTx.QueryRow(r.Context(), `INSERT INTO loans (lendee, lender, lent_value, rate, current_value, membership_loan) VALUES ($1, $2, $3, $4, $5, TRUE) RETURNING loan_id`, newUser.NationName, newUser.RegionName, 10000, 2.5, 10000).Scan(&loanId)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("Loan Err", err)
 		return
 	}
-	err = ourTx.QueryRow(r.Context(), `UPDATE accounts SET cash_in_hand = cash_in_hand + 10000 WHERE account_name = $1`, newUser.NationName).Scan()
-	if err != nil && err != pgx.ErrNoRows {
+	// The signup credit is new cash, the region is lender without paying it out
+	err = Env.handCashTransaction(&transactionFormat{Sender: newUser.RegionName, Receiver: newUser.NationName, Value: 10000, Message: "Membership Loan Issue - ID " + loanId, Kind: "loan", LoanId: loanId, LoanEvent: "issue", Minted: true}, r.Context(), ourTx)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("Loan Err", err)
 		return
@@ -71,6 +130,8 @@ func (Env env) userVerification(w http.ResponseWriter, r *http.Request) {
 	var user struct {
 		NationName     string
 		PasswordString string
+		TotpCode       string // Needed once the nation has enabled two-factor
+		RecoveryCode   string // In place of TotpCode if the authenticator is lost
 	}
 	err := decoder.Decode(&user)
 	if err != nil {
@@ -79,6 +140,7 @@ func (Env env) userVerification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var dbPassHash string = ""
+	var sessionVersion int
 	var userReturn = struct {
 		AuthKey        string `json:"AuthKey"`
 		UserRegion     string `json:"UserRegion"`
@@ -87,27 +149,63 @@ func (Env env) userVerification(w http.ResponseWriter, r *http.Request) {
 	}{
 		UserName: user.NationName,
 	}
-	err = Env.DBPool.QueryRow(r.Context(), "SELECT account_pass_hash, region_name, permission FROM accounts, nation_permissions WHERE account_name = $1 AND account_name = nation_name AND account_type = 'nation';", user.NationName).Scan(&dbPassHash, &userReturn.UserRegion, &userReturn.UserPermission)
+	ip := Env.clientIP(r)
+	lockedUntil, err := Env.loginLockedUntil(r.Context(), user.NationName, ip)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("DB Err", err)
+		log.Println("Lockout Err", err)
 		return
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(dbPassHash), []byte(user.PasswordString))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		w.WriteHeader(http.StatusForbidden)
+	if !lockedUntil.IsZero() {
+		writeLockedOut(w, lockedUntil)
 		return
 	}
-	authKeyHex := md5.Sum([]byte(user.NationName + Env.KeyString))
-	userReturn.AuthKey = hex.EncodeToString(authKeyHex[:])
-	if err != nil {
-		log.Println("JSON err", err)
+	err = Env.DBPool.QueryRow(r.Context(), "SELECT account_pass_hash, session_version, COALESCE(region_name, ''), COALESCE(permission::TEXT, '') FROM accounts LEFT JOIN nation_permissions ON account_name = nation_name WHERE account_name = $1 AND account_type = 'nation';", user.NationName).Scan(&dbPassHash, &sessionVersion, &userReturn.UserRegion, &userReturn.UserPermission)
+	if err != nil && err != pgx.ErrNoRows {
 		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("DB Err", err)
+		return
+	}
+	if err == pgx.ErrNoRows {
+		// Fails exactly like a wrong password, so guessing can't find which nations exist
+		Env.burnBcrypt(user.PasswordString)
+	} else {
+		err = bcrypt.CompareHashAndPassword([]byte(dbPassHash), []byte(user.PasswordString))
+	}
+	succeeded := err == nil
+	if succeeded {
+		twoFactor, _, err := Env.secondFactorEnabled(r.Context(), user.NationName)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("TOTP Err", err)
+			return
+		}
+		if twoFactor && user.TotpCode == "" && user.RecoveryCode == "" {
+			// Only said once the password is right, and not a guess worth counting
+			w.WriteHeader(http.StatusUnauthorized)
+			outEncoder.Encode(struct {
+				TotpRequired bool `json:"TotpRequired"`
+			}{true})
+			return
+		}
+		if twoFactor {
+			succeeded, err = Env.checkSecondFactor(r.Context(), user.NationName, user.TotpCode, user.RecoveryCode)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println("TOTP check Err", err)
+				return
+			}
+		}
 	}
+	if recordErr := Env.recordLoginAttempt(r.Context(), user.NationName, ip, succeeded); recordErr != nil {
+		log.Println("Login attempt Err", recordErr)
+	}
+	if !succeeded {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	Env.rehashIfStale(r.Context(), user.NationName, dbPassHash, user.PasswordString)
+	userReturn.AuthKey = authKeyFor(user.NationName, Env.KeyString, sessionVersion)
 	outEncoder.Encode(userReturn)
 }
 
@@ -116,12 +214,13 @@ func (Env env) nationInfo(w http.ResponseWriter, r *http.Request) {
 	returnHello := struct {
 		NationName   string
 		Region       string
-		CashInHand   float32
-		CashInEscrow float32
+		CashInHand   *float32 `json:",omitempty"` // Left out when the nation's privacy hides it from the requester
+		CashInEscrow *float32 `json:",omitempty"`
 	}{}
 	requedNat := r.PathValue("natName")
 	log.Println("Nation info requested for", requedNat)
-	err := Env.DBPool.QueryRow(r.Context(), "SELECT account_name, nation_permissions.region_name, cash_in_hand, cash_in_escrow FROM accounts, nation_permissions WHERE nation_name = $1 AND nation_permissions.nation_name = accounts.account_name;", requedNat).Scan(&returnHello.NationName, &returnHello.Region, &returnHello.CashInHand, &returnHello.CashInEscrow)
+	viewer, viewerCtx := Env.optionalViewer(r)
+	err := Env.DBPool.QueryRow(r.Context(), "SELECT account_name, COALESCE(nation_permissions.region_name, ''), cash_in_hand, cash_in_escrow FROM accounts LEFT JOIN nation_permissions ON nation_permissions.nation_name = accounts.account_name WHERE account_name = $1 AND account_type = 'nation';", requedNat).Scan(&returnHello.NationName, &returnHello.Region, &returnHello.CashInHand, &returnHello.CashInEscrow)
 	if err == pgx.ErrNoRows {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -131,6 +230,16 @@ func (Env env) nationInfo(w http.ResponseWriter, r *http.Request) {
 		log.Println("DB Err", err)
 		return
 	}
+	visible, err := Env.canSeeDetails(viewerCtx, viewer, requedNat)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Privacy Err", err)
+		return
+	}
+	if !visible {
+		returnHello.CashInHand = nil
+		returnHello.CashInEscrow = nil
+	}
 	w.WriteHeader(http.StatusAccepted)
 	respEncoder.Encode(returnHello)
 }
@@ -143,11 +252,20 @@ type cashReturn struct {
 }
 
 func buildNetWorth(ctx context.Context, dbConn *pgxpool.Conn, user string, cashValue float32) (float32, error) {
-	var shareGetter, debtGetter *float32
+	var shareGetter, debtGetter, bondGetter, bondDebtGetter *float32
 	err := dbConn.QueryRow(ctx, `SELECT SUM(share_quant*share_price) as shareWorth FROM stock_holdings, stocks WHERE stocks.ticker = stock_holdings.ticker AND stock_holdings.account_name = $1`, user).Scan(&shareGetter)
 	if err != nil {
 		return 0, err
 	}
+	// Bonds in a defaulted series are worth nothing to their holders, the issuer still carries the debt until maturity
+	err = dbConn.QueryRow(ctx, `SELECT SUM(quantity*face_value) as bondWorth FROM bond_holdings, bond_series WHERE bond_series.series_id = bond_holdings.series_id AND bond_holdings.account_name = $1 AND bond_series.bond_status != 'defaulted'`, user).Scan(&bondGetter)
+	if err != nil {
+		return 0, err
+	}
+	err = dbConn.QueryRow(ctx, `SELECT SUM(quantity_sold*face_value) as bondDebt FROM bond_series WHERE region = $1 AND matured = FALSE`, user).Scan(&bondDebtGetter)
+	if err != nil {
+		return 0, err
+	}
 	err = dbConn.QueryRow(ctx, `SELECT SUM(current_value) as debtValue FROM loans where lendee = $1`, user).Scan(&debtGetter)
 	var shareValue, debtValue float32
 	if shareGetter == nil {
@@ -155,11 +273,17 @@ func buildNetWorth(ctx context.Context, dbConn *pgxpool.Conn, user string, cashV
 	} else {
 		shareValue = *shareGetter
 	}
+	if bondGetter != nil {
+		shareValue += *bondGetter
+	}
 	if debtGetter == nil {
 		debtValue = 0
 	} else {
 		debtValue = *debtGetter
 	}
+	if bondDebtGetter != nil {
+		debtValue += *bondDebtGetter
+	}
 	return ((cashValue + shareValue) - debtValue), err
 }
 
@@ -167,6 +291,9 @@ func (Env env) nationCashDetails(w http.ResponseWriter, r *http.Request) {
 	encoder := json.NewEncoder(w)
 	theReturn := cashReturn{}
 	theNation := r.PathValue("natName")
+	if !Env.checkDetailsVisible(w, r, theNation) {
+		return
+	}
 	dbConn, err := Env.DBPool.Acquire(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -206,6 +333,9 @@ func (Env env) nationCashQuick(w http.ResponseWriter, r *http.Request) {
 	}{
 		AcctName: theNation,
 	}
+	if !Env.checkDetailsVisible(w, r, theNation) {
+		return
+	}
 	err := Env.DBPool.QueryRow(r.Context(), `SELECT cash_in_hand FROM accounts WHERE account_name = $1;`, theNation).Scan(&theReturn.CashInHand)
 	if err != nil {
 		if err == pgx.ErrNoRows {
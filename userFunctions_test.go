@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func signupTestEnv() env {
+	return env{
+		HashCost: 4,
+		NSClient: fakeNSClient{
+			checksums: map[string]string{"foo_bar": "good-code"},
+			regions:   map[string]string{"foo_bar": "The Conifer"},
+		},
+	}
+}
+
+func TestCheckSignupNation(t *testing.T) {
+	Env := signupTestEnv()
+	cases := []struct {
+		name     string
+		nation   string
+		checksum string
+		region   string
+		want     error
+	}{
+		{"verified", "Foo Bar", "good-code", "the_conifer", nil},
+		{"verified other spelling", "FOO_BAR", "good-code", "The Conifer", nil},
+		{"wrong checksum", "Foo Bar", "bad-code", "The Conifer", errNotVerified},
+		{"unknown nation", "Nobody", "good-code", "The Conifer", errNotVerified},
+		{"wrong region", "Foo Bar", "good-code", "Elsewhere", errWrongRegion},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Env.checkSignupNation(context.Background(), tc.nation, tc.checksum, tc.region)
+			if got != tc.want {
+				t.Errorf("checkSignupNation() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckSignupNationUnavailable(t *testing.T) {
+	Env := env{NSClient: fakeNSClient{err: errNSUnavailable}}
+	err := Env.checkSignupNation(context.Background(), "Foo Bar", "good-code", "The Conifer")
+	if !errors.Is(err, errNSUnavailable) {
+		t.Errorf("checkSignupNation() = %v, want %v", err, errNSUnavailable)
+	}
+}
+
+// Refused signups must be turned away before the handler touches the database, which
+// these tests don't have
+func TestSignupRefused(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		client nsClient
+		want   int
+	}{
+		{"unverified", `{"NationName":"Foo Bar","PasswordString":"pw","RegionName":"The Conifer","Checksum":"bad-code"}`, signupTestEnv().NSClient, http.StatusForbidden},
+		{"wrong region", `{"NationName":"Foo Bar","PasswordString":"pw","RegionName":"Elsewhere","Checksum":"good-code"}`, signupTestEnv().NSClient, http.StatusForbidden},
+		{"NS down", `{"NationName":"Foo Bar","PasswordString":"pw","RegionName":"The Conifer","Checksum":"good-code"}`, fakeNSClient{err: errNSUnavailable}, http.StatusBadGateway},
+		{"bad JSON", `{`, signupTestEnv().NSClient, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			Env := signupTestEnv()
+			Env.NSClient = tc.client
+			w := httptest.NewRecorder()
+			Env.signupFunc(w, httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(tc.body)))
+			if w.Code != tc.want {
+				t.Errorf("signupFunc() status = %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
@@ -3,9 +3,48 @@ package main
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
-func authKeyVerification(authKey string, userName string, extraString string) bool {
-	checkKey := md5.Sum([]byte(userName + extraString))
-	return hex.EncodeToString(checkKey[:]) == authKey
+// authKeyFor is a nation's AuthKey for its current session version. Version 0 keeps
+// the keys handed out before versions existed.
+func authKeyFor(userName string, extraString string, sessionVersion int) string {
+	keySource := userName + extraString
+	if sessionVersion > 0 {
+		keySource += "|" + strconv.Itoa(sessionVersion)
+	}
+	authKey := md5.Sum([]byte(keySource))
+	return hex.EncodeToString(authKey[:])
+}
+
+func authKeyVerification(authKey string, userName string, extraString string, sessionVersion int) bool {
+	return authKeyFor(userName, extraString, sessionVersion) == authKey
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is only believed when
+// the connection is from one of the configured trusted proxies, and then only as far back
+// as the first hop that isn't one, as anything before that the client can write itself.
+func (Env env) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if len(Env.TrustedProxies) == 0 || !ipAllowed(Env.TrustedProxies, host) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !ipAllowed(Env.TrustedProxies, hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		name      string
+		proxies   []string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"no proxies ignores header", nil, "203.0.113.5:4000", "198.51.100.1", "203.0.113.5"},
+		{"untrusted peer ignores header", []string{"10.0.0.0/8"}, "203.0.113.5:4000", "198.51.100.1", "203.0.113.5"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, "10.1.2.3:4000", "198.51.100.1", "198.51.100.1"},
+		{"forged hops before the real client", []string{"10.0.0.0/8"}, "10.1.2.3:4000", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"chained proxies", []string{"10.0.0.0/8", "192.0.2.7"}, "10.1.2.3:4000", "1.1.1.1, 198.51.100.1, 192.0.2.7", "198.51.100.1"},
+		{"trusted proxy without header", []string{"10.0.0.0/8"}, "10.1.2.3:4000", "", "10.1.2.3"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			Env := env{TrustedProxies: tc.proxies}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			if got := Env.clientIP(r); got != tc.want {
+				t.Errorf("clientIP() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}